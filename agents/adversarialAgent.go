@@ -2,11 +2,11 @@ package agents
 
 import (
 	"math"
-	"math/rand"
 	"sort"
 
 	"github.com/MadSP-McDaniel/eipsim/policies"
 	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
 )
 
 type adversaryIpMeta struct {
@@ -20,6 +20,8 @@ type adversaryIpMeta struct {
 	newIP           bool
 	hasLatentConf   bool
 	segmentTimer    types.Duration
+	expansion       bool // The IP was added to the pool after it was created
+	newSubnet       bool
 }
 
 type AdversarialAgent struct {
@@ -28,18 +30,22 @@ type AdversarialAgent struct {
 	statsIndex            int
 	benignAllocs          int
 	benignExploitedAllocs int
+	expansionUniques      int
 
-	uniques map[types.IPAddress]struct{}
+	uniques       map[types.IPAddress]struct{}
+	subnets       map[types.Subnet]struct{} // Distinct subnets of the IPs in uniques
+	regionUniques map[string]int
+	nextRegion    int
 
 	SegmentedPool *policies.SegmentedPool `json:"-"`
 
 	// How many IPs to create in total throughout the simulation
 	MaxCreated uint64
-	// Max simulatenous IPs
+	// Max simulatenous IPs (0 to allocate as many as the provider's limits allow)
 	MaxIPs int
 	// How long to hold each IP for
 	HoldDuration types.Duration
-	// Max IPs to create each cycle
+	// Max IPs to create each cycle (0 to allocate as many as the provider's limits allow)
 	MaxPerCycle int
 	// Number of allocations before moving to next tenant
 	AllocationsPerTenant int
@@ -47,6 +53,8 @@ type AdversarialAgent struct {
 	MaxTenants int
 	// Don't do any processing before this time
 	StartTime types.Duration
+	// Regions to spread allocations across in turn, skipping exhausted regions (only the agent's Region if empty)
+	Regions []string `json:",omitempty"`
 	BaseAgent
 }
 
@@ -80,7 +88,8 @@ func (a *AdversarialAgent) Process(s types.Simulator) {
 		return
 	}
 	// Allocate up to maxPerCycle IP addresses
-	for i := 0; len(a.allAllocs)-a.oldestActiveAlloc < a.MaxIPs && i < r.Int()%a.MaxPerCycle; i++ {
+	failures := 0
+	for i := 0; (a.MaxIPs <= 0 || len(a.allAllocs)-a.oldestActiveAlloc < a.MaxIPs) && (a.MaxPerCycle <= 0 || i < r.Int()%a.MaxPerCycle); i++ {
 		if uint64(len(a.allAllocs)) >= a.MaxCreated && a.MaxCreated != 0 {
 			s.Done()
 			break
@@ -89,8 +98,23 @@ func (a *AdversarialAgent) Process(s types.Simulator) {
 		meta.createdAt = t
 		meta.tenantId = a.minID + (types.TenantId(len(a.allAllocs)) / types.TenantId(a.AllocationsPerTenant) % types.TenantId(a.MaxTenants))
 
-		meta.ip = s.GetIP(meta.tenantId)
-		if a.SegmentedPool != nil {
+		region := a.Region
+		if len(a.Regions) > 0 {
+			region = a.Regions[a.nextRegion%len(a.Regions)]
+			a.nextRegion++
+		}
+		var err error
+		meta.ip, err = s.GetIPInRegion(region, meta.tenantId)
+		if err != nil {
+			failures++
+			if failures < len(a.Regions) {
+				continue
+			}
+			// Every pool is exhausted, try again next cycle
+			break
+		}
+		failures = 0
+		if a.SegmentedPool != nil && s.GetInfo(meta.ip).Region == types.DefaultRegion {
 			meta.segmentTimer = a.SegmentedPool.GetIPTimer(s, meta.ip)
 		}
 		_, existingIP := a.uniques[meta.ip]
@@ -102,6 +126,17 @@ func (a *AdversarialAgent) Process(s types.Simulator) {
 		meta.prevTenantCount = info.UniqueOwners()
 		meta.timeSinceReuse = int(info.ReleasedBenign)
 		meta.hasLatentConf = info.HasConfig(t, a.minID)
+		meta.expansion = info.AddedAt > 0
+		if meta.newIP && meta.expansion {
+			a.expansionUniques++
+		}
+		if meta.newIP {
+			a.regionUniques[info.Region]++
+		}
+		if _, ok := a.subnets[info.Subnet]; !ok {
+			meta.newSubnet = true
+			a.subnets[info.Subnet] = struct{}{}
+		}
 		a.allAllocs = append(a.allAllocs, meta)
 	}
 	// Free any IP addresses that have reached holdDuration age
@@ -109,7 +144,10 @@ func (a *AdversarialAgent) Process(s types.Simulator) {
 		meta := &a.allAllocs[a.oldestActiveAlloc]
 		// Check if the oldest allocation is ready to be freed.
 		if t > meta.createdAt+a.HoldDuration {
-			s.ReleaseIP(meta.ip, meta.tenantId, false)
+			if s.ReleaseIP(meta.ip, meta.tenantId, false) != nil {
+				// Throttled, try again next cycle
+				break
+			}
 			a.oldestActiveAlloc++
 		} else {
 			break
@@ -117,6 +155,21 @@ func (a *AdversarialAgent) Process(s types.Simulator) {
 	}
 }
 
+// NextWakeup skips the time before the adversary starts, and any time in which it holds its max IPs and none are ready to be released.
+func (a *AdversarialAgent) NextWakeup(s types.Simulator) types.Duration {
+	t := s.GetTime()
+	if t < a.StartTime {
+		return nextTick(s, a.StartTime)
+	}
+	if a.MaxIPs <= 0 || len(a.allAllocs)-a.oldestActiveAlloc < a.MaxIPs {
+		return t + s.GetTimeDelta()
+	}
+	if a.oldestActiveAlloc == len(a.allAllocs) {
+		return types.Never
+	}
+	return nextTick(s, a.allAllocs[a.oldestActiveAlloc].createdAt+a.HoldDuration+1)
+}
+
 func (a *AdversarialAgent) Init(s types.Simulator, minID types.TenantId, maxID types.TenantId) {
 	a.BaseAgent.Init(s, minID, maxID)
 	if a.AllocationsPerTenant <= 0 {
@@ -129,6 +182,109 @@ func (a *AdversarialAgent) Init(s types.Simulator, minID types.TenantId, maxID t
 	s.RegisterStatCollector(a.CollectStats)
 	s.RegisterIPAllocationCallback(a.IPAllocationCallback)
 	a.uniques = make(map[types.IPAddress]struct{})
+	a.subnets = make(map[types.Subnet]struct{})
+	a.regionUniques = make(map[string]int)
+}
+
+type adversaryIpMetaCheckpoint struct {
+	CreatedAt       types.Duration
+	TenantId        types.TenantId
+	IP              types.IPAddress
+	PrevTenantCount int
+	TimeSinceReuse  int
+	NewIP           bool
+	HasLatentConf   bool
+	SegmentTimer    types.Duration
+	Expansion       bool
+	NewSubnet       bool
+}
+
+type adversaryCheckpoint struct {
+	Base                  baseAgentCheckpoint
+	AllAllocs             []adversaryIpMetaCheckpoint
+	OldestActiveAlloc     int
+	StatsIndex            int
+	BenignAllocs          int
+	BenignExploitedAllocs int
+	ExpansionUniques      int
+	Uniques               []types.IPAddress
+	Subnets               []types.Subnet
+	RegionUniques         map[string]int
+	NextRegion            int
+	// Whether the adversary was linked to the simulator's SegmentedPool
+	Segmented bool
+}
+
+func (a *AdversarialAgent) Checkpoint() ([]byte, error) {
+	c := adversaryCheckpoint{
+		Base:                  a.BaseAgent.checkpoint(),
+		OldestActiveAlloc:     a.oldestActiveAlloc,
+		StatsIndex:            a.statsIndex,
+		BenignAllocs:          a.benignAllocs,
+		BenignExploitedAllocs: a.benignExploitedAllocs,
+		ExpansionUniques:      a.expansionUniques,
+		Segmented:             a.SegmentedPool != nil,
+		RegionUniques:         a.regionUniques,
+		NextRegion:            a.nextRegion,
+	}
+	for _, m := range a.allAllocs {
+		c.AllAllocs = append(c.AllAllocs, adversaryIpMetaCheckpoint{m.createdAt, m.tenantId, m.ip, m.prevTenantCount, m.timeSinceReuse, m.newIP, m.hasLatentConf, m.segmentTimer, m.expansion, m.newSubnet})
+	}
+	for ip := range a.uniques {
+		c.Uniques = append(c.Uniques, ip)
+	}
+	sort.Slice(c.Uniques, func(i, j int) bool { return c.Uniques[i] < c.Uniques[j] })
+	for subnet := range a.subnets {
+		c.Subnets = append(c.Subnets, subnet)
+	}
+	sort.Slice(c.Subnets, func(i, j int) bool { return c.Subnets[i] < c.Subnets[j] })
+	return util.EncodeGob(c)
+}
+
+// Restore resumes the adversary from a checkpoint. An adversary that was linked to a SegmentedPool is linked to the restored simulator's policy.
+func (a *AdversarialAgent) Restore(s types.Simulator, b []byte) error {
+	var c adversaryCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	a.BaseAgent.restore(c.Base)
+	a.allAllocs = nil
+	for _, m := range c.AllAllocs {
+		a.allAllocs = append(a.allAllocs, adversaryIpMeta{m.CreatedAt, m.TenantId, m.IP, m.PrevTenantCount, m.TimeSinceReuse, m.NewIP, m.HasLatentConf, m.SegmentTimer, m.Expansion, m.NewSubnet})
+	}
+	a.oldestActiveAlloc = c.OldestActiveAlloc
+	a.statsIndex = c.StatsIndex
+	a.benignAllocs = c.BenignAllocs
+	a.benignExploitedAllocs = c.BenignExploitedAllocs
+	a.expansionUniques = c.ExpansionUniques
+	a.uniques = make(map[types.IPAddress]struct{}, len(c.Uniques))
+	for _, ip := range c.Uniques {
+		a.uniques[ip] = struct{}{}
+	}
+	a.subnets = make(map[types.Subnet]struct{}, len(c.Subnets))
+	for _, subnet := range c.Subnets {
+		a.subnets[subnet] = struct{}{}
+	}
+	a.regionUniques = c.RegionUniques
+	if a.regionUniques == nil {
+		a.regionUniques = make(map[string]int)
+	}
+	a.nextRegion = c.NextRegion
+	if c.Segmented {
+		if p, ok := policies.Innermost(s.GetPolicy()).(interface{ Segmented() *policies.SegmentedPool }); ok {
+			a.SegmentedPool = p.Segmented()
+		}
+	}
+	if a.AllocationsPerTenant <= 0 {
+		a.AllocationsPerTenant = math.MaxInt
+	}
+	if a.MaxTenants <= 0 {
+		a.MaxTenants = math.MaxInt
+	}
+	s.RegisterStatCollector(a.CollectStats)
+	s.RegisterIPAllocationCallback(a.IPAllocationCallback)
+	return nil
 }
 
 func (a *AdversarialAgent) IPAllocationCallback(s types.Simulator, ip types.IPAddress, tenant types.TenantId) {
@@ -158,6 +314,8 @@ func (a *AdversarialAgent) CollectStats(s types.Simulator, stats map[string]inte
 	var sumSeconds uint64
 	var numNewIps uint64
 	var numNewLCs uint64
+	var numNewExpansion uint64
+	var numNewSubnets uint64
 	numEntries := len(a.allAllocs) - a.statsIndex
 	for i := a.statsIndex; i < len(a.allAllocs); i++ {
 		meta := &a.allAllocs[i]
@@ -168,6 +326,12 @@ func (a *AdversarialAgent) CollectStats(s types.Simulator, stats map[string]inte
 			if meta.hasLatentConf {
 				numNewLCs++
 			}
+			if meta.expansion {
+				numNewExpansion++
+			}
+		}
+		if meta.newSubnet {
+			numNewSubnets++
 		}
 	}
 	advStats["avgTimeSinceReuse"] = sumSeconds / uint64(numEntries)
@@ -175,12 +339,34 @@ func (a *AdversarialAgent) CollectStats(s types.Simulator, stats map[string]inte
 	advStats["totalUniques"] = len(a.uniques)
 	advStats["newUniques"] = numNewIps
 	advStats["newLatentConfs"] = numNewLCs
+	advStats["totalUniqueSubnets"] = len(a.subnets)
+	advStats["newUniqueSubnets"] = numNewSubnets
+	if len(a.Regions) > 0 {
+		regionUniques := make(map[string]int, len(a.regionUniques))
+		for region, n := range a.regionUniques {
+			regionUniques[region] = n
+		}
+		advStats["totalUniquesByRegion"] = regionUniques
+	}
+	if a.expansionUniques > 0 {
+		advStats["newExpansionUniques"] = numNewExpansion
+		advStats["totalExpansionUniques"] = a.expansionUniques
+	}
 	advStats["adversaryBenignAllocs"] = a.benignAllocs
 	advStats["adversaryBenignExploitedAllocs"] = a.benignExploitedAllocs
 
 	a.statsIndex = len(a.allAllocs)
 }
 
+// IdleTime reports the adversary's IPs as idle for as long as it holds them, since it never uses them.
+func (a *AdversarialAgent) IdleTime(ip types.IPAddress, tenant types.TenantId, held types.Duration) types.Duration {
+	return held
+}
+
+func (a *AdversarialAgent) Adversarial() bool {
+	return true
+}
+
 func (a *AdversarialAgent) Cleanup(s types.Simulator) {
 	stats := s.GetOverallStats()
 	if a.statsIndex == 0 {
@@ -188,10 +374,21 @@ func (a *AdversarialAgent) Cleanup(s types.Simulator) {
 	}
 	a.statsIndex = 0
 	a.CollectStats(s, stats)
+	if bill, ok := s.GetBill(a.minID); ok {
+		// The cost of everything the adversary obtained over the whole simulation
+		advStats := stats["adversary"].(map[string]interface{})
+		advStats["cost"] = bill
+		if uniques := advStats["newUniques"].(uint64); uniques > 0 {
+			advStats["dollarsPerUniqueIP"] = bill / float64(uniques)
+		}
+		if confs := advStats["newLatentConfs"].(uint64); confs > 0 {
+			advStats["dollarsPerLatentConf"] = bill / float64(confs)
+		}
+	}
 
 	cdf := []int{}
 	for i := 0; i < 1000; i++ {
-		cdf = append(cdf, int(a.allAllocs[rand.Intn(len(a.allAllocs))].segmentTimer))
+		cdf = append(cdf, int(a.allAllocs[s.Rand().Intn(len(a.allAllocs))].segmentTimer))
 	}
 	sort.Ints(cdf)
 	stats["adversarySegmentCDF"] = cdf
@@ -2,11 +2,60 @@ package agents
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
 )
 
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]func() types.Agent{}
+)
+
+// Register makes an agent type available to AgentWrapper, so that it can be loaded from JSON. The factory should return a new agent with its defaults set; fields present in the JSON are then unmarshalled into it.
+func Register(typeName string, factory func() types.Agent) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[typeName]; ok {
+		panic("agent type " + typeName + " registered twice")
+	}
+	registry[typeName] = factory
+}
+
+// Registered lists the registered agent types.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates an agent of a registered type.
+func New(typeName string) (types.Agent, error) {
+	registryLock.RLock()
+	factory, ok := registry[typeName]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown agent type %q", typeName)
+	}
+	return factory(), nil
+}
+
+func init() {
+	Register("multi", func() types.Agent { return &MultiTenantAgent{BaseAgent: BaseAgent{Type: "multi"}} })
+	Register("adversary", func() types.Agent { return &AdversarialAgent{BaseAgent: BaseAgent{Type: "adversary"}} })
+	Register("dynamic", func() types.Agent { return &DynamicTenantAgent{BaseAgent: BaseAgent{Type: "dynamic"}} })
+	Register("autoscale", func() types.Agent { return &AutoscaleAgent{BaseAgent: BaseAgent{Type: "autoscale"}} })
+	Register("csv", func() types.Agent { return &CSVAgent{BaseAgent: BaseAgent{Type: "csv"}} })
+}
+
 type AgentWrapper struct {
 	Type        string
 	types.Agent `json:"-"`
@@ -20,19 +69,10 @@ func (a *AgentWrapper) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	a.Agent, err = New(a.Type)
 	if err != nil {
 		return err
 	}
-	switch a.Type {
-	case "multi":
-		a.Agent = &MultiTenantAgent{}
-	case "adversary":
-		a.Agent = &AdversarialAgent{}
-	case "dynamic":
-		a.Agent = &DynamicTenantAgent{}
-	default:
-		return errors.New("unknown agent type")
-	}
 	err = json.Unmarshal(b, a.Agent)
 	if err != nil {
 		return err
@@ -41,13 +81,18 @@ func (a *AgentWrapper) UnmarshalJSON(b []byte) error {
 }
 
 func (a *AgentWrapper) MarshalJSON() ([]byte, error) {
-
-	return json.Marshal(a.Agent)
+	b, err := json.Marshal(a.Agent)
+	if err != nil {
+		return nil, err
+	}
+	return util.WithType(b, a.Type)
 }
 
 type BaseAgent struct {
 	minID, maxID types.TenantId
 	Type         string
+	// Region that the agent allocates IPs from (the simulator's default region if empty)
+	Region string `json:",omitempty"`
 }
 
 func (b *BaseAgent) GetType() string {
@@ -58,3 +103,28 @@ func (b *BaseAgent) Init(s types.Simulator, minID types.TenantId, maxID types.Te
 	b.minID = minID
 	b.maxID = maxID
 }
+
+// getIP allocates an IP to a tenant in the agent's region
+func (b *BaseAgent) getIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	return s.GetIPInRegion(b.Region, id)
+}
+
+// baseAgentCheckpoint is the serialized state of a BaseAgent, included in the checkpoints of each agent
+type baseAgentCheckpoint struct {
+	MinID, MaxID types.TenantId
+}
+
+func (b *BaseAgent) checkpoint() baseAgentCheckpoint {
+	return baseAgentCheckpoint{b.minID, b.maxID}
+}
+
+func (b *BaseAgent) restore(c baseAgentCheckpoint) {
+	b.minID = c.MinID
+	b.maxID = c.MaxID
+}
+
+// nextTick returns the first time step (a multiple of the simulator's TimeDelta) at or after t
+func nextTick(s types.Simulator, t types.Duration) types.Duration {
+	d := s.GetTimeDelta()
+	return (t + d - 1) / d * d
+}
@@ -1,7 +1,10 @@
 package agents
 
 import (
+	"container/heap"
+	"errors"
 	"math"
+	"sort"
 
 	"github.com/MadSP-McDaniel/eipsim/types"
 	"github.com/MadSP-McDaniel/eipsim/util"
@@ -16,11 +19,31 @@ type autoscaleConfig struct {
 	targets [dailyTerms]float64
 	expires types.Duration
 	//f       util.Fourier
-	ips map[types.IPAddress]struct{}
+	ips     *util.IPSet
+	pending int             // Requests queued by the simulator
+	churned bool            // The tenant has churned, but some of its releases were throttled
+	last    types.IPAddress // The IP the tenant released last, if it hasn't tried to recover it yet
+	hasLast bool
+}
+
+// durationHeap is a min-heap of times
+type durationHeap []types.Duration
+
+func (h durationHeap) Len() int            { return len(h) }
+func (h durationHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h durationHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *durationHeap) Push(x interface{}) { *h = append(*h, x.(types.Duration)) }
+func (h *durationHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
 }
 
 type AutoscaleAgent struct {
 	tenantAutoscales map[types.Duration][]*autoscaleConfig
+	processTimes     durationHeap // Keys of tenantAutoscales
+	tenants          map[types.TenantId]*autoscaleConfig
 
 	NumTenants  int
 	MaxWait     int // Max timesteps between processing
@@ -28,6 +51,8 @@ type AutoscaleAgent struct {
 	NMin        int
 	maxHeadroom float64
 	TenantChurn types.Duration // Mean time between tenant churn
+	// Probability that a tenant scaling up first tries to recover the IP it released last (see Simulator.GetSpecificIP)
+	RecoverProbability float64 `json:",omitempty"`
 
 	maxTenantId int
 
@@ -41,7 +66,7 @@ func (a *AutoscaleAgent) getNewConfig(s types.Simulator) *autoscaleConfig {
 	nMax := int(float64(a.NMin) * math.Pow(math.E, s.Rand().Float64()*scale))
 	nMin := s.Rand().Intn(nMax)
 	f := util.RandomFourier(s.Rand(), 24)
-	config := &autoscaleConfig{id: id, nMax: float64(nMax), nMin: float64(nMin), ips: map[types.IPAddress]struct{}{}}
+	config := &autoscaleConfig{id: id, nMax: float64(nMax), nMin: float64(nMin), ips: util.NewIPSet()}
 	for i := 0; i < dailyTerms; i++ {
 		fTime := float64(i) / float64(dailyTerms)
 		config.targets[i] = f.Compute(fTime)
@@ -52,16 +77,112 @@ func (a *AutoscaleAgent) getNewConfig(s types.Simulator) *autoscaleConfig {
 	} else {
 		config.expires = math.MaxInt64
 	}
+	a.tenants[id] = config
 	return config
 }
 
 func (a *AutoscaleAgent) Init(s types.Simulator, minID types.TenantId, maxID types.TenantId) {
 	a.BaseAgent.Init(s, minID, maxID)
 	a.tenantAutoscales = make(map[types.Duration][]*autoscaleConfig)
+	a.processTimes = nil
+	a.tenants = make(map[types.TenantId]*autoscaleConfig)
 	t := s.GetTime()
 	for i := 0; i < a.NumTenants; i++ {
-		a.tenantAutoscales[t] = append(a.tenantAutoscales[t], a.getNewConfig(s))
+		a.schedule(t, a.getNewConfig(s))
+	}
+}
+
+// schedule queues a tenant to be processed at time t
+func (a *AutoscaleAgent) schedule(t types.Duration, config *autoscaleConfig) {
+	if len(a.tenantAutoscales[t]) == 0 {
+		heap.Push(&a.processTimes, t)
+	}
+	a.tenantAutoscales[t] = append(a.tenantAutoscales[t], config)
+}
+
+// NextWakeup returns the next time at which a tenant is scheduled to be processed
+func (a *AutoscaleAgent) NextWakeup(s types.Simulator) types.Duration {
+	if len(a.processTimes) == 0 {
+		return types.Never
 	}
+	return a.processTimes[0]
+}
+
+type autoscaleConfigCheckpoint struct {
+	ID      types.TenantId
+	NMax    float64
+	NMin    float64
+	Targets [dailyTerms]float64
+	Expires types.Duration
+	IPs     []types.IPAddress
+	Pending int
+	Churned bool
+	Last    types.IPAddress
+	HasLast bool
+}
+
+type autoscaleCheckpoint struct {
+	Base  baseAgentCheckpoint
+	Times []types.Duration
+	// Tenants to be processed at each of Times, in order
+	Tenants     [][]autoscaleConfigCheckpoint
+	MaxHeadroom float64
+	MaxTenantId int
+}
+
+func (a *AutoscaleAgent) Checkpoint() ([]byte, error) {
+	c := autoscaleCheckpoint{Base: a.BaseAgent.checkpoint(), Times: append([]types.Duration{}, a.processTimes...), MaxHeadroom: a.maxHeadroom, MaxTenantId: a.maxTenantId}
+	sort.Slice(c.Times, func(i, j int) bool { return c.Times[i] < c.Times[j] })
+	for _, t := range c.Times {
+		var tenants []autoscaleConfigCheckpoint
+		for _, config := range a.tenantAutoscales[t] {
+			tenants = append(tenants, autoscaleConfigCheckpoint{config.id, config.nMax, config.nMin, config.targets, config.expires, config.ips.Slice(), config.pending, config.churned, config.last, config.hasLast})
+		}
+		c.Tenants = append(c.Tenants, tenants)
+	}
+	return util.EncodeGob(c)
+}
+
+func (a *AutoscaleAgent) Restore(s types.Simulator, b []byte) error {
+	var c autoscaleCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	a.BaseAgent.restore(c.Base)
+	a.tenantAutoscales = make(map[types.Duration][]*autoscaleConfig)
+	a.processTimes = nil
+	a.tenants = make(map[types.TenantId]*autoscaleConfig)
+	for i, t := range c.Times {
+		for _, tenant := range c.Tenants[i] {
+			config := &autoscaleConfig{id: tenant.ID, nMax: tenant.NMax, nMin: tenant.NMin, targets: tenant.Targets, expires: tenant.Expires, ips: util.NewIPSet(), pending: tenant.Pending, churned: tenant.Churned, last: tenant.Last, hasLast: tenant.HasLast}
+			a.tenants[config.id] = config
+			for _, ip := range tenant.IPs {
+				config.ips.Add(ip)
+			}
+			a.schedule(t, config)
+		}
+	}
+	a.maxHeadroom = c.MaxHeadroom
+	a.maxTenantId = c.MaxTenantId
+	return nil
+}
+
+// ReceiveIP adds an IP from a queued request to its tenant. The tenant scales back down at its next processing if needed, and IPs for tenants that have since churned are released immediately.
+func (a *AutoscaleAgent) ReceiveIP(s types.Simulator, id types.TenantId, ip types.IPAddress) {
+	config, ok := a.tenants[id]
+	if !ok {
+		if s.ReleaseIP(ip, id, true) != nil {
+			// Throttled, so the churned tenant releases it at the next time step
+			config = &autoscaleConfig{id: id, ips: util.NewIPSet(), churned: true}
+			config.ips.Add(ip)
+			a.tenants[id] = config
+			a.schedule(s.GetTime()+s.GetTimeDelta(), config)
+		}
+		return
+	}
+	config.pending--
+	config.ips.Add(ip)
 }
 
 func (a *AutoscaleAgent) Process(s types.Simulator) {
@@ -71,6 +192,9 @@ func (a *AutoscaleAgent) Process(s types.Simulator) {
 	// Pull the tenants we should process this cycle
 	toProcess := a.tenantAutoscales[t]
 	delete(a.tenantAutoscales, t)
+	for len(a.processTimes) > 0 && a.processTimes[0] <= t {
+		heap.Pop(&a.processTimes)
+	}
 
 	//currentTimestep := (t * dailyTerms / types.Day) * types.Day / dailyTerms
 	nextTimestep := (t*dailyTerms/types.Day + 1) * types.Day / dailyTerms
@@ -79,12 +203,24 @@ func (a *AutoscaleAgent) Process(s types.Simulator) {
 		config := toProcess[i]
 		if config.expires < t {
 			// Release all IPs from this tenant as they are churning
-			for ip := range config.ips {
-				delete(config.ips, ip)
-				s.ReleaseIP(ip, config.id, true)
+			for config.ips.Len() > 0 {
+				ip := config.ips.At(config.ips.Len() - 1)
+				if s.ReleaseIP(ip, config.id, true) != nil {
+					break
+				}
+				config.ips.Remove(ip)
+			}
+			if config.ips.Len() > 0 {
+				// Throttled, finish releasing at the next time step
+				a.schedule(t+s.GetTimeDelta(), config)
+			} else {
+				delete(a.tenants, config.id)
+			}
+			if !config.churned {
+				config.churned = true
+				// Generate a new config
+				toProcess = append(toProcess, a.getNewConfig(s))
 			}
-			// Generate a new config
-			toProcess = append(toProcess, a.getNewConfig(s))
 			continue
 		}
 
@@ -99,21 +235,37 @@ func (a *AutoscaleAgent) Process(s types.Simulator) {
 		targetIPs := int(config.nMin + float64(config.nMax-config.nMin)*config.targets[targetIndex%dailyTerms])
 
 		// Allocate IPs as needed
-		for len(config.ips) < targetIPs {
-			config.ips[s.GetIP(config.id)] = struct{}{}
+		if config.hasLast && config.ips.Len()+config.pending < targetIPs {
+			if a.RecoverProbability > 0 && s.Rand().Float64() < a.RecoverProbability && s.GetSpecificIP(config.id, config.last) == nil {
+				config.ips.Add(config.last)
+			}
+			config.hasLast = false
+		}
+		for config.ips.Len()+config.pending < targetIPs {
+			ip, err := a.getIP(s, config.id)
+			if errors.Is(err, types.ErrRequestQueued) {
+				config.pending++
+				continue
+			} else if err != nil {
+				break
+			}
+			config.ips.Add(ip)
 		}
 		// Free IPs as needed
-		for len(config.ips) > targetIPs {
-			for ip := range config.ips {
-				delete(config.ips, ip)
-				s.ReleaseIP(ip, config.id, true)
+		for config.ips.Len() > targetIPs {
+			ip := config.ips.Random(s.Rand())
+			if s.ReleaseIP(ip, config.id, true) != nil {
+				// Throttled, scale down at the next processing
 				break
 			}
+			config.ips.Remove(ip)
+			config.last = ip
+			config.hasLast = true
 		}
 		//targetIndexDelta := 1
 		//for ; config.targets[(targetIndex+targetIndexDelta)%dailyTerms] == targetIPs && targetIndexDelta < 24; targetIndexDelta++ {
 		//}
 		nextProcess := nextTimestep + types.Duration(s.Rand().Intn(int(types.Day)/dailyTerms))
-		a.tenantAutoscales[nextProcess] = append(a.tenantAutoscales[nextProcess], config)
+		a.schedule(nextProcess, config)
 	}
 }
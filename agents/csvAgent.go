@@ -9,17 +9,23 @@ import (
 	"strconv"
 
 	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
 	"github.com/klauspost/compress/zstd"
 )
 
 /*
 CSVAgent reads an allocation trace from a file and replays it
 Rows in the CSV file should take the form of comma-separate integers: Time (seconds),Type(1=allocate,0=release),ID(unique across allocated IPs),TenantID
+Rows may also have a fifth column naming the region to allocate from, overriding the agent's Region. It is ignored for releases.
 */
 type CSVAgent struct {
 	instanceSlotIds map[uint64]types.IPAddress
+	rejected        map[uint64]struct{} // Instances that weren't given an IP because the pool was exhausted
 	input           io.Reader
 	scanner         *bufio.Scanner
+	lines           int // Number of lines scanned
+	finished        bool
+	throttled       []csvRelease // Releases to retry, in order
 
 	InputFilename string
 	Zstd          bool
@@ -27,30 +33,126 @@ type CSVAgent struct {
 	BaseAgent
 }
 
+// csvRelease is a release from the trace that was throttled
+type csvRelease struct {
+	Instance uint64
+	Tenant   types.TenantId
+}
+
 func (a *CSVAgent) Init(s types.Simulator, minID types.TenantId, maxID types.TenantId) {
+	err := a.open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.scan() // Process assumes a scan has already happened
+	a.BaseAgent.Init(s, minID, maxID)
+	a.instanceSlotIds = make(map[uint64]types.IPAddress)
+	a.rejected = make(map[uint64]struct{})
+}
+
+func (a *CSVAgent) open() error {
 	var err error
 	a.input, err = os.Open(a.InputFilename)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if a.Zstd {
 		a.input, err = zstd.NewReader(a.input)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 	a.scanner = bufio.NewScanner(a.input)
-	a.scanner.Scan() // Process assumes a scan has already happened
-	a.BaseAgent.Init(s, minID, maxID)
-	a.instanceSlotIds = make(map[uint64]types.IPAddress)
+	a.lines = 0
+	return nil
+}
+
+func (a *CSVAgent) scan() bool {
+	a.lines++
+	return a.scanner.Scan()
+}
+
+type csvCheckpoint struct {
+	Base            baseAgentCheckpoint
+	InstanceSlotIds map[uint64]types.IPAddress
+	Rejected        map[uint64]struct{}
+	Lines           int
+	Finished        bool
+	Throttled       []csvRelease
+}
+
+func (a *CSVAgent) Checkpoint() ([]byte, error) {
+	return util.EncodeGob(csvCheckpoint{a.BaseAgent.checkpoint(), a.instanceSlotIds, a.rejected, a.lines, a.finished, a.throttled})
+}
+
+// Restore reopens the trace and skips the rows that were already replayed.
+func (a *CSVAgent) Restore(s types.Simulator, b []byte) error {
+	var c csvCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	a.BaseAgent.restore(c.Base)
+	err = a.open()
+	if err != nil {
+		return err
+	}
+	for a.lines < c.Lines {
+		a.scan()
+	}
+	a.instanceSlotIds = c.InstanceSlotIds
+	if a.instanceSlotIds == nil {
+		a.instanceSlotIds = make(map[uint64]types.IPAddress)
+	}
+	a.rejected = c.Rejected
+	if a.rejected == nil {
+		a.rejected = make(map[uint64]struct{})
+	}
+	a.finished = c.Finished
+	a.throttled = c.Throttled
+	return nil
+}
+
+// NextWakeup returns the time of the next row of the trace
+func (a *CSVAgent) NextWakeup(s types.Simulator) types.Duration {
+	if a.finished {
+		return types.Never
+	}
+	if len(a.throttled) > 0 {
+		return s.GetTime() + s.GetTimeDelta()
+	}
+	line := bytes.SplitN(a.scanner.Bytes(), []byte{','}, 2)
+	time, err := strconv.ParseUint(string(line[0]), 10, 64)
+	if err != nil {
+		// Let Process report the malformed row
+		return s.GetTime() + s.GetTimeDelta()
+	}
+	return types.Duration(time)
+}
+
+// release releases an instance's IP, or saves it to retry if the release is throttled
+func (a *CSVAgent) release(s types.Simulator, r csvRelease) {
+	if s.ReleaseIP(a.instanceSlotIds[r.Instance], r.Tenant, true) != nil {
+		a.throttled = append(a.throttled, r)
+		return
+	}
+	delete(a.instanceSlotIds, r.Instance)
 }
 
 func (a *CSVAgent) Process(s types.Simulator) {
 	t := s.GetTime()
+	retries := a.throttled
+	a.throttled = nil
+	for _, r := range retries {
+		a.release(s, r)
+	}
+	if a.finished {
+		return
+	}
 	for {
 		line := bytes.Split(a.scanner.Bytes(), []byte{','})
-		if len(line) != 4 {
-			log.Fatal("CSV trace lines must have 4 entries")
+		if len(line) != 4 && len(line) != 5 {
+			log.Fatal("CSV trace lines must have 4 or 5 entries")
 		}
 		time, err := strconv.ParseUint(string(line[0]), 10, 64)
 		if err != nil {
@@ -75,20 +177,31 @@ func (a *CSVAgent) Process(s types.Simulator) {
 		}
 
 		if Type == 1 {
-			ip := s.GetIP(a.minID + types.TenantId(user))
-			a.instanceSlotIds[instanceId] = ip
+			region := a.Region
+			if len(line) == 5 && len(line[4]) > 0 {
+				region = string(line[4])
+			}
+			ip, err := s.GetIPInRegion(region, a.minID+types.TenantId(user))
+			if err != nil {
+				a.rejected[instanceId] = struct{}{}
+			} else {
+				a.instanceSlotIds[instanceId] = ip
+			}
 		} else if Type == 0 {
-			ip, ok := a.instanceSlotIds[instanceId]
-			if !ok {
-				log.Fatal("CSV contains released instance not allocated")
+			if _, ok := a.instanceSlotIds[instanceId]; !ok {
+				if _, rejected := a.rejected[instanceId]; !rejected {
+					log.Fatal("CSV contains released instance not allocated")
+				}
+				delete(a.rejected, instanceId)
+			} else {
+				a.release(s, csvRelease{instanceId, a.minID + types.TenantId(user)})
 			}
-			s.ReleaseIP(ip, a.minID+types.TenantId(user), true)
-			delete(a.instanceSlotIds, instanceId)
 		} else {
 			log.Fatal("CSV trace type must be 1 or 0")
 		}
 
-		if !a.scanner.Scan() {
+		if !a.scan() {
+			a.finished = true
 			s.Done()
 			break
 		}
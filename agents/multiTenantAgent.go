@@ -1,16 +1,20 @@
 package agents
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
 )
 
 type MultiTenantAgent struct {
 	activeIPs    map[types.IPAddress]types.TenantId
+	activeSet    *util.IPSet // Keys of activeIPs, for choosing IPs to release
 	currentIPs   int
 	nextChange   types.Duration
 	totalcreated int
+	pending      int // Requests queued by the simulator
 
 	MaxIPs            int
 	MinIPs            int
@@ -25,6 +29,56 @@ func NewMultiTenantAgent(maxIPs int, minIPs int, maxChangeInterval types.Duratio
 	return &MultiTenantAgent{MaxIPs: maxIPs, MinIPs: minIPs, MaxChangeInterval: maxChangeInterval, ID: id, MaxPerCycle: maxPerCycle, activeIPs: map[types.IPAddress]types.TenantId{}, NumTenants: numTenants, BaseAgent: BaseAgent{Type: "multi"}}
 }
 
+func (a *MultiTenantAgent) Init(s types.Simulator, minID types.TenantId, maxID types.TenantId) {
+	a.BaseAgent.Init(s, minID, maxID)
+	if a.activeIPs == nil {
+		a.activeIPs = map[types.IPAddress]types.TenantId{}
+	}
+	a.activeSet = util.NewIPSet()
+}
+
+type multiTenantIPCheckpoint struct {
+	IP     types.IPAddress
+	Tenant types.TenantId
+}
+
+type multiTenantCheckpoint struct {
+	Base         baseAgentCheckpoint
+	ActiveIPs    []multiTenantIPCheckpoint
+	CurrentIPs   int
+	NextChange   types.Duration
+	TotalCreated int
+	Pending      int
+}
+
+func (a *MultiTenantAgent) Checkpoint() ([]byte, error) {
+	c := multiTenantCheckpoint{Base: a.BaseAgent.checkpoint(), CurrentIPs: a.currentIPs, NextChange: a.nextChange, TotalCreated: a.totalcreated, Pending: a.pending}
+	for _, ip := range a.activeSet.Slice() {
+		c.ActiveIPs = append(c.ActiveIPs, multiTenantIPCheckpoint{ip, a.activeIPs[ip]})
+	}
+	return util.EncodeGob(c)
+}
+
+func (a *MultiTenantAgent) Restore(s types.Simulator, b []byte) error {
+	var c multiTenantCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	a.BaseAgent.restore(c.Base)
+	a.activeIPs = map[types.IPAddress]types.TenantId{}
+	a.activeSet = util.NewIPSet()
+	for _, active := range c.ActiveIPs {
+		a.activeIPs[active.IP] = active.Tenant
+		a.activeSet.Add(active.IP)
+	}
+	a.currentIPs = c.CurrentIPs
+	a.nextChange = c.NextChange
+	a.totalcreated = c.TotalCreated
+	a.pending = c.Pending
+	return nil
+}
+
 func (a *MultiTenantAgent) SetIPs(s types.Simulator) {
 	r := s.Rand()
 	// The workload scales randomly over time.
@@ -34,25 +88,51 @@ func (a *MultiTenantAgent) SetIPs(s types.Simulator) {
 	}
 }
 
+// NextWakeup skips time in which the agent holds its target number of IPs, until the target next changes.
+func (a *MultiTenantAgent) NextWakeup(s types.Simulator) types.Duration {
+	if len(a.activeIPs)+a.pending != a.currentIPs {
+		return s.GetTime() + s.GetTimeDelta()
+	}
+	return nextTick(s, a.nextChange+1)
+}
+
 func (a *MultiTenantAgent) GetID() string {
 	a.totalcreated++
 	return fmt.Sprintf("%s.%d", a.ID, a.totalcreated)
 }
+
+// ReceiveIP adds an IP from a queued request to the active IPs
+func (a *MultiTenantAgent) ReceiveIP(s types.Simulator, id types.TenantId, ip types.IPAddress) {
+	a.pending--
+	a.activeIPs[ip] = id
+	a.activeSet.Add(ip)
+}
+
 func (a *MultiTenantAgent) Process(s types.Simulator) {
 	r := s.Rand()
 	a.SetIPs(s)
 	// Allocate up to maxPerCycle IP addresses
-	for i := 0; len(a.activeIPs) < a.currentIPs && i < a.MaxPerCycle; i++ {
+	for i := 0; len(a.activeIPs)+a.pending < a.currentIPs && i < a.MaxPerCycle; i++ {
 		id := a.minID + types.TenantId(r.Int()%a.NumTenants)
-		ip := s.GetIP(id)
+		ip, err := a.getIP(s, id)
+		if errors.Is(err, types.ErrRequestQueued) {
+			a.pending++
+			continue
+		} else if err != nil {
+			break
+		}
 		a.activeIPs[ip] = id
+		a.activeSet.Add(ip)
 	}
 	// Free IPs down to desired count
 	for i := 0; len(a.activeIPs) > a.currentIPs && i < a.MaxPerCycle; i++ {
-		for ip, id := range a.activeIPs {
-			delete(a.activeIPs, ip)
-			s.ReleaseIP(ip, id, true)
+		ip := a.activeSet.Random(r)
+		id := a.activeIPs[ip]
+		if s.ReleaseIP(ip, id, true) != nil {
+			// Throttled, try again next cycle
 			break
 		}
+		delete(a.activeIPs, ip)
+		a.activeSet.Remove(ip)
 	}
 }
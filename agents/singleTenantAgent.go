@@ -1,11 +1,14 @@
 package agents
 
 import (
+	"errors"
+
 	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
 )
 
 type DynamicTenantAgent struct {
-	activeIPs         map[types.IPAddress]struct{}
+	activeIPs         *util.IPSet
 	maxIPs            int
 	minIPs            int
 	currentIPs        int
@@ -13,6 +16,7 @@ type DynamicTenantAgent struct {
 	maxChangeInterval types.Duration
 	id                string
 	maxPerCycle       int
+	pending           int // Requests queued by the simulator
 	BaseAgent
 }
 
@@ -24,6 +28,54 @@ func (a *DynamicTenantAgent) SetIPs(s types.Simulator) {
 	}
 }
 
+func (a *DynamicTenantAgent) Init(s types.Simulator, minID types.TenantId, maxID types.TenantId) {
+	a.BaseAgent.Init(s, minID, maxID)
+	a.activeIPs = util.NewIPSet()
+}
+
+// NextWakeup skips time in which the agent holds its target number of IPs, until the target next changes.
+func (a *DynamicTenantAgent) NextWakeup(s types.Simulator) types.Duration {
+	if a.activeIPs.Len()+a.pending != a.currentIPs {
+		return s.GetTime() + s.GetTimeDelta()
+	}
+	return nextTick(s, a.nextChange+1)
+}
+
+type dynamicTenantCheckpoint struct {
+	Base              baseAgentCheckpoint
+	ActiveIPs         []types.IPAddress
+	MaxIPs            int
+	MinIPs            int
+	CurrentIPs        int
+	NextChange        types.Duration
+	MaxChangeInterval types.Duration
+	ID                string
+	MaxPerCycle       int
+	Pending           int
+}
+
+func (a *DynamicTenantAgent) Checkpoint() ([]byte, error) {
+	return util.EncodeGob(dynamicTenantCheckpoint{a.BaseAgent.checkpoint(), a.activeIPs.Slice(), a.maxIPs, a.minIPs, a.currentIPs, a.nextChange, a.maxChangeInterval, a.id, a.maxPerCycle, a.pending})
+}
+
+func (a *DynamicTenantAgent) Restore(s types.Simulator, b []byte) error {
+	var c dynamicTenantCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	a.BaseAgent.restore(c.Base)
+	a.activeIPs = util.NewIPSet()
+	for _, ip := range c.ActiveIPs {
+		a.activeIPs.Add(ip)
+	}
+	a.maxIPs, a.minIPs, a.currentIPs = c.MaxIPs, c.MinIPs, c.CurrentIPs
+	a.nextChange, a.maxChangeInterval = c.NextChange, c.MaxChangeInterval
+	a.id, a.maxPerCycle = c.ID, c.MaxPerCycle
+	a.pending = c.Pending
+	return nil
+}
+
 func (a *DynamicTenantAgent) Type() string {
 	return "dynamic"
 }
@@ -32,18 +84,32 @@ func (a *DynamicTenantAgent) GetID() string {
 	return a.id
 }
 
+// ReceiveIP adds an IP from a queued request to the active IPs
+func (a *DynamicTenantAgent) ReceiveIP(s types.Simulator, id types.TenantId, ip types.IPAddress) {
+	a.pending--
+	a.activeIPs.Add(ip)
+}
+
 func (a *DynamicTenantAgent) Process(s types.Simulator) {
 	a.SetIPs(s)
 	// Allocate up to maxPerCycle IP addresses
-	for i := 0; len(a.activeIPs) < a.currentIPs && i < a.maxPerCycle; i++ {
-		ip := s.GetIP(a.minID)
-		a.activeIPs[ip] = struct{}{}
+	for i := 0; a.activeIPs.Len()+a.pending < a.currentIPs && i < a.maxPerCycle; i++ {
+		ip, err := a.getIP(s, a.minID)
+		if errors.Is(err, types.ErrRequestQueued) {
+			a.pending++
+			continue
+		} else if err != nil {
+			break
+		}
+		a.activeIPs.Add(ip)
 	}
 	// Free any IP addresses that have reached holdDuration age
-	for i := 0; len(a.activeIPs) > a.currentIPs && i < a.maxPerCycle; i++ {
-		for ip := range a.activeIPs {
-			delete(a.activeIPs, ip)
-			s.ReleaseIP(ip, a.minID, true)
+	for i := 0; a.activeIPs.Len() > a.currentIPs && i < a.maxPerCycle; i++ {
+		ip := a.activeIPs.Random(s.Rand())
+		if s.ReleaseIP(ip, a.minID, true) != nil {
+			// Throttled, try again next cycle
+			break
 		}
+		a.activeIPs.Remove(ip)
 	}
 }
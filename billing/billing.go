@@ -0,0 +1,108 @@
+/*
+Package billing prices tenants' use of the provider, so that the cost of an attack can be compared with what it obtains.
+
+A Model is loaded from JSON through ModelWrapper, by the type it was registered under. The simulator charges each agent for the tenant accounts it creates, the allocations it makes, and the time its tenants hold IPs.
+*/
+package billing
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+// Model prices the actions of a tenant.
+type Model interface {
+	GetType() string
+	// HoldCost returns the charge for holding an IP for held time, of which idle was spent not in use
+	HoldCost(held, idle types.Duration) float64
+	// AllocationCost returns the fee for a successful allocation
+	AllocationCost() float64
+	// AccountCost returns the cost of creating a tenant account
+	AccountCost() float64
+}
+
+// Bill is the amount charged to an agent, in dollars.
+type Bill struct {
+	Holding     float64
+	Allocations float64
+	Accounts    float64
+}
+
+func (b Bill) Total() float64 {
+	return b.Holding + b.Allocations + b.Accounts
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]func() Model{}
+)
+
+// Register makes a model type available to ModelWrapper, so that it can be loaded from JSON. The factory should return a new model with its defaults set; fields present in the JSON are then unmarshalled into it.
+func Register(typeName string, factory func() Model) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[typeName]; ok {
+		panic("billing model type " + typeName + " registered twice")
+	}
+	registry[typeName] = factory
+}
+
+// Registered lists the registered model types.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a model of a registered type.
+func New(typeName string) (Model, error) {
+	registryLock.RLock()
+	factory, ok := registry[typeName]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown billing model type %q", typeName)
+	}
+	return factory(), nil
+}
+
+func init() {
+	Register("linear", NewLinear)
+}
+
+type ModelWrapper struct {
+	Type  string
+	Model `json:"-"`
+}
+
+func (m *ModelWrapper) UnmarshalJSON(b []byte) error {
+	type w ModelWrapper
+
+	err := json.Unmarshal(b, (*w)(m))
+	if err != nil {
+		return err
+	}
+
+	m.Model, err = New(m.Type)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, m.Model)
+}
+
+func (m *ModelWrapper) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(m.Model)
+	if err != nil {
+		return nil, err
+	}
+	return util.WithType(b, m.Type)
+}
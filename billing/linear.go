@@ -0,0 +1,33 @@
+package billing
+
+import "github.com/MadSP-McDaniel/eipsim/types"
+
+// Linear charges fixed rates: an hourly rate for each IP held, a surcharge for each hour it is idle, and flat fees for allocations and accounts.
+type Linear struct {
+	Type           string
+	HourlyRate     float64
+	IdleHourlyRate float64 `json:",omitempty"`
+	AllocationFee  float64 `json:",omitempty"`
+	AccountFee     float64 `json:",omitempty"`
+}
+
+// NewLinear returns a model charging $0.005 per IP-hour, like public IPv4 addresses on AWS.
+func NewLinear() Model {
+	return &Linear{Type: "linear", HourlyRate: 0.005}
+}
+
+func (l *Linear) GetType() string {
+	return l.Type
+}
+
+func (l *Linear) HoldCost(held, idle types.Duration) float64 {
+	return (l.HourlyRate*float64(held) + l.IdleHourlyRate*float64(idle)) / float64(types.Hour)
+}
+
+func (l *Linear) AllocationCost() float64 {
+	return l.AllocationFee
+}
+
+func (l *Linear) AccountCost() float64 {
+	return l.AccountFee
+}
@@ -0,0 +1,207 @@
+/*
+eipsim runs simulations described by JSON scenario files and writes the results as JSONL.
+
+Usage:
+
+	eipsim [-o results.jsonl] [-v] scenario.json...
+
+A scenario uses the same format that a simulator is marshalled to, for example:
+
+	{
+		"TotalIPs": 100000,
+		"TimeDelta": 1,
+		"MaxTime": 864000,
+		"StatCollectionInterval": 3600,
+		"LatentConfProbability": 0.1,
+		"Policy": {"Type": "segmented", "TimerMultiplier": 1},
+		"Agents": [
+			{"Type": "autoscale", "NumTenants": 6000, "MaxWait": 600, "NMax": 30, "NMin": 2, "TenantChurn": 31536000}
+		]
+	}
+
+Each scenario is run to completion and written as one line of output, in the order given. Scenarios may set "Seed" to vary the simulator's random source; with -replicates n, each scenario is instead run with n consecutive seeds and a summary (mean, standard deviation, and 95% confidence interval of each stat) is written.
+
+With -sweep, each file instead describes a parameter sweep over a base scenario (see package sweep):
+
+	{
+		"Base": { ...scenario... },
+		"Axes": [
+			{"Name": "policy", "Path": "Policy", "Values": [{"Type": "fifo"}, {"Type": "random"}]},
+			{"Name": "numAdversaryTenants", "Path": "Agents.1.MaxTenants", "Values": [1, 10, 100]}
+		]
+	}
+
+Every point of the sweep is written as one line of output as it completes. A sweep with "AllocRatio" set to the name of an axis sizes each pool to reach that allocation ratio (in percent), using a calibration run of the base scenario. The calibration can be cached and reused across sweeps with -calibration; with -calibrate, eipsim only measures and writes the calibration of each scenario (the base scenario of each sweep).
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/MadSP-McDaniel/eipsim/agents"
+	"github.com/MadSP-McDaniel/eipsim/billing"
+	"github.com/MadSP-McDaniel/eipsim/policies"
+	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/sweep"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+func main() {
+	output := flag.String("o", "-", "file to write JSONL results to (- for stdout)")
+	verbose := flag.Bool("v", false, "log simulation time at each stat collection")
+	isSweep := flag.Bool("sweep", false, "treat input files as parameter sweeps")
+	workers := flag.Int("parallel", 0, "max simulations to run at once in a sweep (defaults to the number of CPUs)")
+	calibrate := flag.Bool("calibrate", false, "write the pool-sizing calibration of each scenario instead of running it")
+	replicates := flag.Int("replicates", 0, "run each scenario (or sweep point) with this many consecutive seeds and write a summary with 95% confidence intervals")
+	list := flag.Bool("list", false, "list the registered agent, policy, and billing model types")
+	calibrationFile := flag.String("calibration", "", "file to load a sweep's calibration from, or save it to if it doesn't exist")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] scenario.json...\n       %s -sweep [flags] sweep.json...\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *list {
+		fmt.Println("agents:", strings.Join(agents.Registered(), " "))
+		fmt.Println("policies:", strings.Join(policies.Registered(), " "))
+		fmt.Println("billing models:", strings.Join(billing.Registered(), " "))
+		return
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	for _, filename := range flag.Args() {
+		if *isSweep {
+			err := runSweep(filename, *workers, *replicates, *verbose, *calibrate, *calibrationFile, out)
+			if err != nil {
+				log.Fatalf("%s: %v", filename, err)
+			}
+			continue
+		}
+		s, err := simulator.LoadScenarioFile(filename)
+		if err != nil {
+			log.Fatalf("%s: %v", filename, err)
+		}
+		if *calibrate {
+			c, err := simulator.Calibrate(s)
+			if err != nil {
+				log.Fatalf("%s: %v", filename, err)
+			}
+			err = json.NewEncoder(out).Encode(c)
+			if err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+		logTime := func(s *simulator.Simulator, p sweep.Point) error {
+			s.RegisterStatCollector(func(types.Simulator, map[string]interface{}) {
+				log.Println(filename, s.Seed, s.GetTime())
+			})
+			return nil
+		}
+		if *replicates > 0 {
+			var setup func(*simulator.Simulator, sweep.Point) error
+			if *verbose {
+				setup = logTime
+			}
+			summary, err := sweep.Replicate(s, *replicates, *workers, setup)
+			if err != nil {
+				log.Fatalf("%s: %v", filename, err)
+			}
+			err = json.NewEncoder(out).Encode(summary)
+			if err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+		if *verbose {
+			logTime(s, nil)
+		}
+		s.ProcessAll()
+		err = s.WriteJSONL(out)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func runSweep(filename string, workers int, replicates int, verbose bool, calibrate bool, calibrationFile string, out io.Writer) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sw, err := sweep.Load(f)
+	if err != nil {
+		return err
+	}
+	if workers > 0 {
+		sw.Workers = workers
+	}
+	if replicates > 0 {
+		sw.Replicates = replicates
+	}
+	if calibrationFile != "" {
+		err = cacheCalibration(calibrationFile, sw)
+		if err != nil {
+			return err
+		}
+	}
+	if calibrate {
+		// A sweep that doesn't size pools by allocation ratio has no calibration of its own, so its base scenario is calibrated directly
+		if sw.Calibration == nil {
+			sw.Calibration, err = simulator.Calibrate(sw.Base)
+			if err != nil {
+				return err
+			}
+		}
+		return json.NewEncoder(out).Encode(sw.Calibration)
+	}
+	if verbose {
+		sw.Setup = func(s *simulator.Simulator, p sweep.Point) error {
+			s.RegisterStatCollector(func(s types.Simulator, m map[string]interface{}) {
+				log.Println(filename, p, s.GetTime())
+			})
+			return nil
+		}
+	}
+	return sw.Run(out)
+}
+
+// cacheCalibration loads the sweep's calibration from filename, or calibrates the sweep and saves it there.
+func cacheCalibration(filename string, sw *sweep.Sweep) error {
+	b, err := os.ReadFile(filename)
+	if err == nil {
+		return json.Unmarshal(b, &sw.Calibration)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = sw.Calibrate()
+	if err != nil || sw.Calibration == nil {
+		return err
+	}
+	b, err = json.Marshal(sw.Calibration)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
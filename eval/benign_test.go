@@ -1,15 +1,13 @@
 package eval
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
 	"os"
 	"testing"
 
 	"github.com/MadSP-McDaniel/eipsim/agents"
 	"github.com/MadSP-McDaniel/eipsim/policies"
 	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/sweep"
 	"github.com/MadSP-McDaniel/eipsim/types"
 )
 
@@ -21,93 +19,52 @@ var poolMakers = []func() types.PoolPolicy{policies.NewFIFOPool, policies.NewRan
 
 // var poolMakers = []func() types.PoolPolicy{NSP}
 
-func TestBenign(t *testing.T) {
-	simulators := make(chan *simulator.Simulator)
-
-	rp := policies.NewRandomPool()
-	s := simulator.NewSimulator(2000000, rp, 1)
-	s.AllocationSamplingRate = 100
-	s.RegisterStatCollector(func(s types.Simulator, m map[string]interface{}) {
-		log.Println(s.GetTime())
-		// f, err := os.Create("benign.prof")
-		// if err != nil {
-		// 	panic(err)
-		// }
-		// defer f.Close()
-		// err = pprof.WriteHeapProfile(f)
-		// if err != nil {
-		// 	panic(err)
-		// }
-	})
-	s.MaxTime = 10 * types.Day
-	s.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
-	s.StatCollectionInterval = 1 * types.Hour
-	s.LatentConfProbability = LatentConfProbability
-	s.ProcessAll()
-
-	MaxUsedIPsWithTimeout := 2000000 - rp.(*policies.RandomPool).MinAvailable
-
+// policyAxis sweeps over each of the policies in poolMakers
+func policyAxis() sweep.Axis {
+	axis := sweep.Axis{Name: "policy", Path: "Policy"}
 	for _, pool := range poolMakers {
-		for _, allocRatio := range allocRatios {
-			ar := allocRatio
-			p := pool()
-			t.Run(fmt.Sprintf("%s %d", p.GetType(), ar), func(t *testing.T) {
-				s := simulator.NewSimulator(MaxUsedIPsWithTimeout*100/ar, p, 1)
-				s.RegisterStatCollector(func(s types.Simulator, m map[string]interface{}) {
-					// log.Println(s.GetTime())
-					// if isLead {
-					// 	f, err := os.Create("benign.prof")
-					// 	if err != nil {
-					// 		panic(err)
-					// 	}
-					// 	defer f.Close()
-					// 	err = pprof.WriteHeapProfile(f)
-					// 	if err != nil {
-					// 		panic(err)
-					// 	}
-					// }
-				})
-				s.StatCollectionInterval = 1 * types.Hour
-				s.AllocationSamplingRate = 100
-				t.Parallel()
-				s.MaxTime = 180 * types.Day
-				s.LatentConfProbability = LatentConfProbability
-				s.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
-				s.ProcessAll()
-				s.OverallStats["targetAllocRatio"] = ar
-				simulators <- s
-			})
-		}
+		axis.Values = append(axis.Values, pool())
 	}
+	return axis
+}
 
-	done := make(chan struct{})
+func TestBenign(t *testing.T) {
+	c := simulator.NewSimulator(0, NSP(), 1)
+	c.AllocationSamplingRate = 100
+	c.MaxTime = 10 * types.Day
+	c.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
+	c.LatentConfProbability = LatentConfProbability
+	calibration, err := simulator.Calibrate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	t.Cleanup(func() {
-		close(simulators)
-		<-done
+	base := simulator.NewSimulator(0, NSP(), 1)
+	base.StatCollectionInterval = 1 * types.Hour
+	base.AllocationSamplingRate = 100
+	base.MaxTime = 180 * types.Day
+	base.LatentConfProbability = LatentConfProbability
+	base.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
+
+	runSweep(t, "./figs/syn-benign.jsonl", &sweep.Sweep{
+		Base: base,
+		Axes: []sweep.Axis{
+			policyAxis(),
+			{Name: "targetAllocRatio", Values: sweep.Values(allocRatios...)},
+		},
+		AllocRatio:  "targetAllocRatio",
+		Calibration: calibration,
 	})
-	go writeSims("./figs/syn-benign.jsonl", simulators, done)
 }
 
-func writeSims(f string, sims chan *simulator.Simulator, donechan chan struct{}) {
+func runSweep(t *testing.T, f string, sw *sweep.Sweep) {
 	out, err := os.Create(f)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	for sim := range sims {
-		data, err := json.Marshal(sim)
-		if err != nil {
-			panic(err)
-		}
-		_, err = out.Write(data)
-		if err != nil {
-			panic(err)
-		}
-		_, err = out.WriteString("\n")
-		if err != nil {
-			panic(err)
-		}
+	defer out.Close()
+	err = sw.Run(out)
+	if err != nil {
+		t.Fatal(err)
 	}
-	out.Close()
-	close(donechan)
 }
@@ -2,26 +2,19 @@ package eval
 
 import (
 	"fmt"
-	"log"
 	"testing"
 
 	"github.com/MadSP-McDaniel/eipsim/agents"
-	"github.com/MadSP-McDaniel/eipsim/policies"
 	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/sweep"
 	"github.com/MadSP-McDaniel/eipsim/types"
 )
 
 func TestBorgAdversaries(t *testing.T) {
-	simulators := make(chan *simulator.Simulator)
-
-	rp := policies.NewRandomPool()
-	s := simulator.NewSimulator(2000000, rp, 1)
-	s.AllocationSamplingRate = 100
-	s.RegisterStatCollector(func(s types.Simulator, m map[string]interface{}) {
-		log.Println(s.GetTime())
-	})
-	s.AddAgent(&agents.CSVAgent{InputFilename: "./borg_collections_normalized.csv.zst", Zstd: true, BaseAgent: agents.BaseAgent{Type: "csv"}})
-	s.AddAgent(&agents.AdversarialAgent{
+	c := simulator.NewSimulator(0, NSP(), 1)
+	c.AllocationSamplingRate = 100
+	c.AddAgent(&agents.CSVAgent{InputFilename: "./borg_collections_normalized.csv.zst", Zstd: true, BaseAgent: agents.BaseAgent{Type: "csv"}})
+	c.AddAgent(&agents.AdversarialAgent{
 		MaxCreated:           0,
 		MaxIPs:               60,
 		HoldDuration:         10 * types.Minute,
@@ -31,97 +24,70 @@ func TestBorgAdversaries(t *testing.T) {
 		MaxTenants:           1,
 		BaseAgent:            agents.BaseAgent{Type: "adversary"},
 	})
-	s.StatCollectionInterval = 1 * types.Hour
-	s.LatentConfProbability = LatentConfProbability
-	s.ProcessAll()
-	MaxUsedIPsWithTimeout := 2000000 - rp.(*policies.RandomPool).MinAvailable
-
-	fmt.Println(s.MaxUsedIPs, MaxUsedIPsWithTimeout)
+	c.LatentConfProbability = LatentConfProbability
+	calibration, err := simulator.Calibrate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	for _, pool := range poolMakers {
-		for ntIndex := 0; ntIndex < len(numTenants); ntIndex++ {
-			for _, allocRatio := range allocRatios {
-				ar := allocRatio
-				nt := numTenants[ntIndex]
-				if ar != 95 && nt != 10000 && nt != 1 {
-					continue
-				}
-				p := pool()
-				t.Run(fmt.Sprintf("%s %d %d", p.GetType(), ar, nt), func(t *testing.T) {
-					t.Parallel()
-					s := simulator.NewSimulator(MaxUsedIPsWithTimeout*100/ar, p, 1)
-					s.AllocationSamplingRate = 100
-					//s.MaxTime = 2 * types.Day
-					s.AddAgent(&agents.CSVAgent{InputFilename: "./borg_collections_normalized.csv.zst", Zstd: true, BaseAgent: agents.BaseAgent{Type: "csv"}})
-					s.StatCollectionInterval = 1 * types.Hour
-					s.LatentConfProbability = LatentConfProbability
-					s.AddAgent(&agents.AdversarialAgent{
-						MaxCreated:           0,
-						MaxIPs:               60,
-						HoldDuration:         10 * types.Minute,
-						MaxPerCycle:          10,
-						StartTime:            10 * types.Day,
-						AllocationsPerTenant: 60,
-						MaxTenants:           nt,
-						BaseAgent:            agents.BaseAgent{Type: "adversary"},
-					})
-					s.ProcessAll()
-					s.OverallStats["targetAllocRatio"] = ar
-					s.OverallStats["numAdversaryTenants"] = nt
-					simulators <- s
-				})
-			}
-		}
+	fmt.Println(calibration.MaxUsedIPs, calibration.PeakDemand)
 
-	}
-	done := make(chan struct{})
+	base := simulator.NewSimulator(0, NSP(), 1)
+	base.AllocationSamplingRate = 100
+	//base.MaxTime = 2 * types.Day
+	base.AddAgent(&agents.CSVAgent{InputFilename: "./borg_collections_normalized.csv.zst", Zstd: true, BaseAgent: agents.BaseAgent{Type: "csv"}})
+	base.StatCollectionInterval = 1 * types.Hour
+	base.LatentConfProbability = LatentConfProbability
+	base.AddAgent(&agents.AdversarialAgent{
+		MaxCreated:           0,
+		MaxIPs:               60,
+		HoldDuration:         10 * types.Minute,
+		MaxPerCycle:          10,
+		StartTime:            10 * types.Day,
+		AllocationsPerTenant: 60,
+		BaseAgent:            agents.BaseAgent{Type: "adversary"},
+	})
 
-	t.Cleanup(func() {
-		close(simulators)
-		<-done
+	runSweep(t, "./figs/borg-adv.jsonl", &sweep.Sweep{
+		Base: base,
+		Axes: []sweep.Axis{
+			policyAxis(),
+			{Name: "numAdversaryTenants", Path: "Agents.1.MaxTenants", Values: sweep.Values(numTenants...)},
+			{Name: "targetAllocRatio", Values: sweep.Values(allocRatios...)},
+		},
+		Include: []map[string][]interface{}{
+			{"targetAllocRatio": {95}},
+			{"numAdversaryTenants": {1, 10000}},
+		},
+		AllocRatio:  "targetAllocRatio",
+		Calibration: calibration,
 	})
-	go writeSims("./figs/borg-adv.jsonl", simulators, done)
 }
 
 func TestBorg(t *testing.T) {
-	simulators := make(chan *simulator.Simulator)
-
-	rp := policies.NewRandomPool()
-	s := simulator.NewSimulator(2000000, rp, 1)
-	s.AllocationSamplingRate = 100
-	s.RegisterStatCollector(func(s types.Simulator, m map[string]interface{}) {
-		log.Println(s.GetTime())
-	})
-	s.AddAgent(&agents.CSVAgent{InputFilename: "./borg_collections_normalized.csv.zst", Zstd: true, BaseAgent: agents.BaseAgent{Type: "csv"}})
-	s.StatCollectionInterval = 1 * types.Hour
-	s.LatentConfProbability = LatentConfProbability
-	s.ProcessAll()
-	MaxUsedIPsWithTimeout := 2000000 - rp.(*policies.RandomPool).MinAvailable
-
-	for _, pool := range poolMakers {
-		for _, allocRatio := range allocRatios {
-			ar := allocRatio
-			p := pool()
-			t.Run(fmt.Sprintf("%s %d", p.GetType(), ar), func(t *testing.T) {
-				s := simulator.NewSimulator(MaxUsedIPsWithTimeout*100/ar, p, 1)
-				s.AllocationSamplingRate = 100
-				s.StatCollectionInterval = 1 * types.Hour
-				t.Parallel()
-				s.MaxTime = 10 * types.Day
-				s.LatentConfProbability = LatentConfProbability
-				s.AddAgent(&agents.CSVAgent{InputFilename: "./borg_collections_normalized.csv.zst", Zstd: true, BaseAgent: agents.BaseAgent{Type: "csv"}})
-				s.ProcessAll()
-				s.OverallStats["targetAllocRatio"] = ar
-				simulators <- s
-			})
-		}
+	c := simulator.NewSimulator(0, NSP(), 1)
+	c.AllocationSamplingRate = 100
+	c.AddAgent(&agents.CSVAgent{InputFilename: "./borg_collections_normalized.csv.zst", Zstd: true, BaseAgent: agents.BaseAgent{Type: "csv"}})
+	c.LatentConfProbability = LatentConfProbability
+	calibration, err := simulator.Calibrate(c)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	done := make(chan struct{})
+	base := simulator.NewSimulator(0, NSP(), 1)
+	base.AllocationSamplingRate = 100
+	base.StatCollectionInterval = 1 * types.Hour
+	base.MaxTime = 10 * types.Day
+	base.LatentConfProbability = LatentConfProbability
+	base.AddAgent(&agents.CSVAgent{InputFilename: "./borg_collections_normalized.csv.zst", Zstd: true, BaseAgent: agents.BaseAgent{Type: "csv"}})
 
-	t.Cleanup(func() {
-		close(simulators)
-		<-done
+	runSweep(t, "./figs/borg-benign.jsonl", &sweep.Sweep{
+		Base: base,
+		Axes: []sweep.Axis{
+			policyAxis(),
+			{Name: "targetAllocRatio", Values: sweep.Values(allocRatios...)},
+		},
+		AllocRatio:  "targetAllocRatio",
+		Calibration: calibration,
 	})
-	go writeSims("./figs/borg-benign.jsonl", simulators, done)
 }
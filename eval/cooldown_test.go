@@ -0,0 +1,59 @@
+package eval
+
+import (
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/agents"
+	"github.com/MadSP-McDaniel/eipsim/policies"
+	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/sweep"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+var cooldowns = []types.Duration{0, 5 * types.Minute, 15 * types.Minute, 30 * types.Minute, 1 * types.Hour, 2 * types.Hour, 4 * types.Hour, 12 * types.Hour, 1 * types.Day}
+
+// TestCooldownSweep measures the tradeoff between pool headroom (allocation failures) and latent configuration exposure as the cooldown of each policy grows
+func TestCooldownSweep(t *testing.T) {
+	c := simulator.NewSimulator(0, NSP(), 1)
+	c.AllocationSamplingRate = 100
+	c.MaxTime = 10 * types.Day
+	c.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
+	c.LatentConfProbability = LatentConfProbability
+	calibration, err := simulator.Calibrate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := simulator.NewSimulator(0, NSP(), 1)
+	base.StatCollectionInterval = 1 * types.Hour
+	base.AllocationSamplingRate = 100
+	base.MaxTime = 210 * types.Day
+	base.LatentConfProbability = LatentConfProbability
+	base.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
+	base.AddAgent(&agents.AdversarialAgent{
+		MaxCreated:           500000,
+		MaxIPs:               60,
+		HoldDuration:         10 * types.Minute,
+		MaxPerCycle:          10,
+		StartTime:            180 * types.Day,
+		AllocationsPerTenant: 60,
+		MaxTenants:           10000,
+		BaseAgent:            agents.BaseAgent{Type: "adversary"},
+	})
+
+	runSweep(t, "./figs/cooldown.jsonl", &sweep.Sweep{
+		Base: base,
+		Axes: []sweep.Axis{
+			policyAxis(),
+			{Name: "cooldown", Path: "Policy.Cooldown.Duration", Values: sweep.Values(cooldowns...)},
+			{Name: "targetAllocRatio", Values: sweep.Values(85, 90, 95)},
+		},
+		AllocRatio:  "targetAllocRatio",
+		Calibration: calibration,
+		Setup: func(s *simulator.Simulator, p sweep.Point) error {
+			segmented, _ := s.Policy.PoolPolicy.(*policies.SegmentedPool)
+			s.Agents[1].Agent.(*agents.AdversarialAgent).SegmentedPool = segmented
+			return nil
+		},
+	})
+}
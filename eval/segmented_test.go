@@ -1,57 +1,92 @@
 package eval
 
 import (
-	"fmt"
 	"testing"
 
 	"github.com/MadSP-McDaniel/eipsim/agents"
 	"github.com/MadSP-McDaniel/eipsim/policies"
 	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/sweep"
 	"github.com/MadSP-McDaniel/eipsim/types"
 )
 
-func TestSegmentedPoolSize(t *testing.T) {
-	simulators := make(chan *simulator.Simulator)
+// segmentedScenario is a pool sized 5% larger than needed by benign tenants, scanned by an adversary after 180 days
+func segmentedScenario(t *testing.T, policy types.PoolPolicy) *simulator.Simulator {
+	c := simulator.NewSimulator(0, NSP(), 1)
+	c.MaxTime = 10 * types.Day
+	c.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
+	calibration, err := simulator.Calibrate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	s := simulator.NewSimulator(1000000, policies.NewRandomPool(), 1)
-	s.MaxTime = 10 * types.Day
-	s.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
-	s.ProcessAll()
-	MaxUsedIPs := s.MaxUsedIPs
+	base := simulator.NewSimulator(calibration.MaxUsedIPs*100/95, policy, 1)
+	base.StatCollectionInterval = 1 * types.Hour
+	base.AllocationSamplingRate = 100
+	base.MaxTime = 210 * types.Day
+	base.LatentConfProbability = LatentConfProbability
+	base.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
+	base.AddAgent(&agents.AdversarialAgent{
+		MaxCreated:           50000000,
+		MaxIPs:               60,
+		HoldDuration:         10 * types.Minute,
+		MaxPerCycle:          10,
+		StartTime:            180 * types.Day,
+		AllocationsPerTenant: 60,
+		MaxTenants:           10000000,
+		BaseAgent:            agents.BaseAgent{Type: "adversary"},
+	})
+	return base
+}
 
+// linkSegmented gives the adversary access to the simulator's segmented pool, for its timer stats
+func linkSegmented(s *simulator.Simulator, p sweep.Point) error {
+	s.Agents[1].Agent.(*agents.AdversarialAgent).SegmentedPool = s.Policy.PoolPolicy.(interface {
+		Segmented() *policies.SegmentedPool
+	}).Segmented()
+	return nil
+}
+
+func TestSegmentedPoolSize(t *testing.T) {
+	var multipliers []float64
 	for multiplier := 0.0; multiplier <= 5.0; multiplier += 0.05 {
-		m := multiplier
-		t.Run(fmt.Sprintf("%f", m), func(t *testing.T) {
-			pool := policies.SegmentedPool{TimerMultiplier: float64(m)}
-			s := simulator.NewSimulator(MaxUsedIPs*100/95, &pool, 1)
-			s.StatCollectionInterval = 1 * types.Hour
-			s.AllocationSamplingRate = 100
-			t.Parallel()
-			s.MaxTime = 210 * types.Day
-			s.LatentConfProbability = LatentConfProbability
-			s.AddAgent(&agents.AutoscaleAgent{NumTenants: 120000, MaxWait: 600, NMax: 30, NMin: 2, BaseAgent: agents.BaseAgent{Type: "autoscale"}, TenantChurn: 365 * types.Day})
-			s.AddAgent(&agents.AdversarialAgent{
-				MaxCreated:           50000000,
-				MaxIPs:               60,
-				HoldDuration:         10 * types.Minute,
-				MaxPerCycle:          10,
-				StartTime:            180 * types.Day,
-				AllocationsPerTenant: 60,
-				MaxTenants:           10000000,
-				SegmentedPool:        &pool,
-				BaseAgent:            agents.BaseAgent{Type: "adversary"},
-			})
-			s.ProcessAll()
-			s.OverallStats["multiplier"] = m
-			simulators <- s
-		})
+		multipliers = append(multipliers, multiplier)
 	}
 
-	done := make(chan struct{})
+	runSweep(t, "./figs/segmented_multipliers.jsonl", &sweep.Sweep{
+		Base: segmentedScenario(t, NSP()),
+		Axes: []sweep.Axis{
+			{Name: "multiplier", Path: "Policy.TimerMultiplier", Values: sweep.Values(multipliers...)},
+		},
+		Setup: linkSegmented,
+	})
+}
+
+// TestSegmentedSelection runs the scenario of TestSegmentedPoolSize with each selection over a coarser range of multipliers, to separate the benefit of the nearest-timer heuristic from sampling noise
+func TestSegmentedSelection(t *testing.T) {
+	var multipliers []float64
+	for multiplier := 0.5; multiplier <= 5.0; multiplier += 0.5 {
+		multipliers = append(multipliers, multiplier)
+	}
+
+	runSweep(t, "./figs/segmented_selection.jsonl", &sweep.Sweep{
+		Base: segmentedScenario(t, NSP()),
+		Axes: []sweep.Axis{
+			{Name: "selection", Path: "Policy.Selection", Values: sweep.Values(policies.SegmentedNearest, policies.SegmentedNearestUnder, policies.SegmentedSample)},
+			{Name: "multiplier", Path: "Policy.TimerMultiplier", Values: sweep.Values(multipliers...)},
+		},
+		Setup: linkSegmented,
+	})
+}
 
-	t.Cleanup(func() {
-		close(simulators)
-		<-done
+// TestSegmentedAdaptive runs the scenario of TestSegmentedPoolSize with a multiplier tuned online, for comparison with the best fixed multiplier
+func TestSegmentedAdaptive(t *testing.T) {
+	runSweep(t, "./figs/segmented_adaptive.jsonl", &sweep.Sweep{
+		Base: segmentedScenario(t, policies.NewAdaptiveSegmentedPool()),
+		Axes: []sweep.Axis{
+			{Name: "gain", Path: "Policy.Gain", Values: sweep.Values(0.25, 0.5, 1.0)},
+			{Name: "targetOver", Path: "Policy.TargetOver", Values: sweep.Values(0.05, 0.1, 0.2)},
+		},
+		Setup: linkSegmented,
 	})
-	go writeSims("./figs/segmented_multipliers.jsonl", simulators, done)
 }
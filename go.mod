@@ -4,4 +4,4 @@ go 1.21
 
 require github.com/klauspost/compress v1.15.10
 
-require github.com/datadog/hyperloglog v0.0.0-20220804205443-1806d9b66146 // indirect
+require github.com/datadog/hyperloglog v0.0.0-20220804205443-1806d9b66146
@@ -0,0 +1,201 @@
+package policies
+
+import (
+	"sort"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+// affinityHold is an IP held for the tenant that released it
+type affinityHold struct {
+	IP       types.IPAddress
+	Tenant   types.TenantId
+	Released types.Duration
+}
+
+/*
+AffinityPolicy is middleware that lets tenants reuse their own IPs. Each IP a tenant releases is held for that tenant for Hold, and the tenant's requests are served from its held IPs (oldest first) before asking the Inner policy. IPs whose hold ends without being reused are released to the inner policy. A tenant's own latent configurations are harmless to it, so reuse keeps tenants that churn IPs from spreading their configurations across the pool.
+
+Tenants can also recover a specific held IP (see types.IPRecoverer). The "recovery" policy only reuses IPs that way (RecoverOnly), like a cloud that lets customers recover an address within Hold of releasing it.
+*/
+type AffinityPolicy struct {
+	BasePolicy
+	Middleware
+	Hold        types.Duration
+	RecoverOnly bool `json:",omitempty"` // Only give held IPs back to tenants that recover them
+
+	Reuses     int
+	Recoveries int
+
+	held   map[types.TenantId][]types.IPAddress // Each tenant's held IPs, in the order they were released
+	holds  map[types.IPAddress]affinityHold
+	expiry cooldownQueue[affinityHold] // Entries are stale if the IP has since been reused
+}
+
+func NewAffinityPolicy() types.PoolPolicy {
+	return &AffinityPolicy{BasePolicy: BasePolicy{Type: "affinity"}, Middleware: newMiddleware(NewRandomPool()), Hold: 1 * types.Hour}
+}
+
+func NewRecoveryPolicy() types.PoolPolicy {
+	return &AffinityPolicy{BasePolicy: BasePolicy{Type: "recovery"}, Middleware: newMiddleware(NewRandomPool()), Hold: 1 * types.Hour, RecoverOnly: true}
+}
+
+// ReportStats reports the IPs held for their tenants, and how many were reused or recovered, along with the inner policy's metrics
+func (a *AffinityPolicy) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["held"] = len(a.holds)
+	stats["reuses"] = a.Reuses
+	stats["recoveries"] = a.Recoveries
+	a.Middleware.ReportStats(s, stats)
+}
+
+func (a *AffinityPolicy) Init(s types.Simulator) {
+	a.held = make(map[types.TenantId][]types.IPAddress)
+	a.holds = make(map[types.IPAddress]affinityHold)
+	a.Inner.Init(s)
+}
+
+func (a *AffinityPolicy) Seed(s types.Simulator, ip types.IPAddress) {
+	a.Inner.Seed(s, ip)
+}
+
+// unhold stops holding an IP for its tenant
+func (a *AffinityPolicy) unhold(ip types.IPAddress) {
+	h := a.holds[ip]
+	delete(a.holds, ip)
+	ips := a.held[h.Tenant]
+	for i := range ips {
+		if ips[i] == ip {
+			ips = append(ips[:i], ips[i+1:]...)
+			break
+		}
+	}
+	if len(ips) == 0 {
+		delete(a.held, h.Tenant)
+	} else {
+		a.held[h.Tenant] = ips
+	}
+}
+
+// takeExpiring removes the held IP whose hold ends first, if its hold ends by time t
+func (a *AffinityPolicy) takeExpiring(t types.Duration) (affinityHold, bool) {
+	for a.expiry.ready(t) {
+		h := a.expiry.take()
+		if cur, ok := a.holds[h.IP]; ok && cur == h {
+			a.unhold(h.IP)
+			return h, true
+		}
+	}
+	return affinityHold{}, false
+}
+
+// expire releases IPs whose hold has ended by time t to the inner policy
+func (a *AffinityPolicy) expire(s types.Simulator, t types.Duration) {
+	for {
+		h, ok := a.takeExpiring(t)
+		if !ok {
+			return
+		}
+		a.Inner.ReleaseIP(s, h.IP, h.Tenant)
+	}
+}
+
+func (a *AffinityPolicy) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	a.expire(s, s.GetTime())
+	if ips := a.held[id]; len(ips) > 0 && !a.RecoverOnly {
+		ip := ips[0]
+		a.unhold(ip)
+		a.Reuses++
+		return ip, nil
+	}
+	return a.Inner.GetIP(s, id)
+}
+
+// GetCooldownIP takes the held IP whose hold ends first, or else bypasses the inner policy's cooldown
+func (a *AffinityPolicy) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if h, ok := a.takeExpiring(types.Never); ok {
+		return h.IP, nil
+	}
+	return a.innerCooldownIP(s, id)
+}
+
+// RecoverIP gives a tenant back an IP held for it, or else passes on the request to the inner policy
+func (a *AffinityPolicy) RecoverIP(s types.Simulator, ip types.IPAddress, id types.TenantId) bool {
+	a.expire(s, s.GetTime())
+	h, ok := a.holds[ip]
+	if !ok {
+		return a.Middleware.RecoverIP(s, ip, id)
+	}
+	if h.Tenant != id {
+		return false
+	}
+	a.unhold(ip)
+	a.Recoveries++
+	return true
+}
+
+func (a *AffinityPolicy) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		removed.Add(ip)
+		if _, ok := a.holds[ip]; ok {
+			a.unhold(ip)
+		}
+	}
+	a.expiry.filter(func(h affinityHold) bool { return !removed.Contains(h.IP) })
+	a.removeInner(s, ips)
+}
+
+func (a *AffinityPolicy) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	t := s.GetTime()
+	a.expire(s, t)
+	if a.Hold <= 0 {
+		a.Inner.ReleaseIP(s, ip, id)
+		return
+	}
+	h := affinityHold{ip, id, t}
+	a.holds[ip] = h
+	a.held[id] = append(a.held[id], ip)
+	a.expiry.add(t+a.Hold, h)
+}
+
+type affinityPolicyCheckpoint struct {
+	Inner  []byte
+	Held   [][]affinityHold // Each tenant's holds, in release order
+	Expiry cooldownQueueCheckpoint[affinityHold]
+}
+
+func (a *AffinityPolicy) Checkpoint() ([]byte, error) {
+	inner, err := a.checkpointInner()
+	if err != nil {
+		return nil, err
+	}
+	c := affinityPolicyCheckpoint{Inner: inner, Expiry: a.expiry.checkpoint()}
+	for _, ips := range a.held {
+		holds := make([]affinityHold, len(ips))
+		for i, ip := range ips {
+			holds[i] = a.holds[ip]
+		}
+		c.Held = append(c.Held, holds)
+	}
+	sort.Slice(c.Held, func(i, j int) bool { return c.Held[i][0].Tenant < c.Held[j][0].Tenant })
+	return util.EncodeGob(c)
+}
+
+func (a *AffinityPolicy) Restore(s types.Simulator, b []byte) error {
+	var c affinityPolicyCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	a.held = make(map[types.TenantId][]types.IPAddress)
+	a.holds = make(map[types.IPAddress]affinityHold)
+	for _, holds := range c.Held {
+		for _, h := range holds {
+			a.holds[h.IP] = h
+			a.held[h.Tenant] = append(a.held[h.Tenant], h.IP)
+		}
+	}
+	a.expiry.restore(c.Expiry)
+	return a.restoreInner(s, c.Inner)
+}
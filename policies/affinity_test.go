@@ -0,0 +1,63 @@
+package policies
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+func TestAffinityHolds(t *testing.T) {
+	s := newTestSimulator()
+	a := &AffinityPolicy{BasePolicy: BasePolicy{Type: "affinity"}, Middleware: newMiddleware(NewFIFOPool()), Hold: types.Hour}
+	a.Init(s)
+	for ip := types.IPAddress(0); ip < 5; ip++ {
+		a.Seed(s, ip)
+	}
+	get := func(id types.TenantId, want types.IPAddress) {
+		t.Helper()
+		ip, err := a.GetIP(s, id)
+		if err != nil || ip != want {
+			t.Errorf("at %v, tenant %d got IP %d (%v), want %d", s.t, id, ip, err, want)
+		}
+	}
+	for ip := types.IPAddress(0); ip < 3; ip++ {
+		get(1, ip)
+	}
+	// Tenant 1 releases IPs 1, 0, then 2, which are held for it until an hour after each release
+	for i, ip := range []types.IPAddress{1, 0, 2} {
+		s.t = types.Duration(10 * (i + 1))
+		a.ReleaseIP(s, ip, 1)
+	}
+
+	// Other tenants are served by the inner policy, and tenant 1 from its held IPs in the order it released them
+	s.t = 40
+	get(2, 3)
+	get(1, 1)
+	if a.Reuses != 1 {
+		t.Errorf("%d reuses, want 1", a.Reuses)
+	}
+
+	// Holds end in the order they started, releasing each IP to the inner policy after those already there
+	s.t = 20 + types.Hour
+	get(2, 4)
+	get(2, 0)
+	if _, err := a.GetIP(s, 2); !errors.Is(err, types.ErrPoolExhausted) {
+		t.Errorf("tenant 2 got an IP still held for tenant 1 (%v)", err)
+	}
+	s.t = 30 + types.Hour
+	get(2, 2)
+
+	// An IP is held again from its latest release, and is no longer held once its tenant takes it back
+	a.ReleaseIP(s, 3, 2)
+	s.t += 10
+	get(2, 3)
+	if a.expiry.Len() != 1 || len(a.holds) != 0 {
+		t.Errorf("%d holds remain, with %d in the expiry queue, want none with 1 stale entry", len(a.holds), a.expiry.Len())
+	}
+	s.t += types.Hour
+	a.ReleaseIP(s, 3, 2)
+	if _, err := a.GetIP(s, 1); !errors.Is(err, types.ErrPoolExhausted) {
+		t.Errorf("a stale hold released IP 3 to the inner policy (%v)", err)
+	}
+}
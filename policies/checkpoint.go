@@ -0,0 +1,48 @@
+package policies
+
+import "github.com/MadSP-McDaniel/eipsim/types"
+
+// poolEntryCheckpoint is the serialized form of the entries used by TaggedPool and SegmentedPool
+type poolEntryCheckpoint struct {
+	IP    types.IPAddress
+	Owner types.TenantId
+	Valid bool
+	Added types.Duration
+	Ready types.Duration
+}
+
+// entryRefs numbers pool entries as they're checkpointed. Entries are shared between several queues, so queues are saved as indexes into a single list of entries in order to restore the sharing.
+type entryRefs[E any] struct {
+	index   map[*E]int
+	entries []*E
+}
+
+func (r *entryRefs[E]) ref(e *E) int {
+	if r.index == nil {
+		r.index = map[*E]int{}
+	}
+	i, ok := r.index[e]
+	if !ok {
+		i = len(r.entries)
+		r.index[e] = i
+		r.entries = append(r.entries, e)
+	}
+	return i
+}
+
+func (r *entryRefs[E]) refs(es []*E) []int {
+	indexes := make([]int, len(es))
+	for i, e := range es {
+		indexes[i] = r.ref(e)
+	}
+	return indexes
+}
+
+// derefs maps indexes saved by entryRefs back to restored entries
+func derefs[E any](entries []*E, indexes []int) []*E {
+	es := make([]*E, len(indexes))
+	for i, index := range indexes {
+		es[i] = entries[index]
+	}
+	return es
+}
@@ -0,0 +1,193 @@
+package policies
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+// TenantRange is a range of an agent's tenants, given like the simulator's limit overrides.
+type TenantRange struct {
+	// Index of the agent in the simulator
+	Agent int
+	// Range of the agent's tenants, as offsets from its first tenant ID (all of its tenants if both are 0)
+	FirstTenant types.TenantId `json:",omitempty"`
+	LastTenant  types.TenantId `json:",omitempty"`
+}
+
+func (r TenantRange) validate() error {
+	if r.Agent < 0 || r.LastTenant < r.FirstTenant {
+		return fmt.Errorf("invalid range of agent %d's tenants %d-%d", r.Agent, r.FirstTenant, r.LastTenant)
+	}
+	return nil
+}
+
+// contains returns whether a tenant is in the range
+func (r TenantRange) contains(s types.Simulator, id types.TenantId) bool {
+	agent, offset := s.TenantAgent(id)
+	return agent == r.Agent && (r.LastTenant == 0 || offset >= r.FirstTenant && offset <= r.LastTenant)
+}
+
+// TenantCooldown sets the cooldown of IPs released by a range of an agent's tenants.
+type TenantCooldown struct {
+	TenantRange
+	Duration types.Duration
+}
+
+/*
+Cooldown is how long a released IP is held back before a policy hands it out again, giving latent configurations time to expire at the cost of pool headroom.
+
+A "fixed" cooldown (the default) holds back every IP for Duration. A "tenant" cooldown holds back IPs released by the tenants of each range in Tenants for that range's duration, and all other IPs for Duration. A "jitter" cooldown adds a uniformly random time of up to Jitter to Duration, so that an adversary can't time its allocations to the end of the cooldown.
+
+In JSON, a bare number is a fixed cooldown of that many seconds.
+*/
+type Cooldown struct {
+	Type     string `json:",omitempty"`
+	Duration types.Duration
+	Jitter   types.Duration   `json:",omitempty"`
+	Tenants  []TenantCooldown `json:",omitempty"`
+}
+
+func (c *Cooldown) UnmarshalJSON(b []byte) error {
+	var d types.Duration
+	if json.Unmarshal(b, &d) == nil {
+		*c = Cooldown{Duration: d}
+		return c.validate()
+	}
+	type w Cooldown
+	err := json.Unmarshal(b, (*w)(c))
+	if err != nil {
+		return err
+	}
+	return c.validate()
+}
+
+func (c *Cooldown) validate() error {
+	switch c.Type {
+	case "", "fixed", "tenant", "jitter":
+	default:
+		return fmt.Errorf("unknown cooldown type %q", c.Type)
+	}
+	if c.Duration < 0 || c.Jitter < 0 {
+		return errors.New("cooldown durations can't be negative")
+	}
+	for _, r := range c.Tenants {
+		err := r.validate()
+		if err != nil {
+			return err
+		}
+		if r.Duration < 0 {
+			return errors.New("cooldown durations can't be negative")
+		}
+	}
+	return nil
+}
+
+// minimum returns the least cooldown of an IP released by a tenant, before any jitter
+func (c *Cooldown) minimum(s types.Simulator, id types.TenantId) types.Duration {
+	if c.Type == "tenant" {
+		for _, r := range c.Tenants {
+			if r.contains(s, id) {
+				return r.Duration
+			}
+		}
+	}
+	return c.Duration
+}
+
+// duration returns the cooldown of an IP released by a tenant
+func (c *Cooldown) duration(s types.Simulator, id types.TenantId) types.Duration {
+	d := c.minimum(s, id)
+	if c.Type == "jitter" && c.Jitter > 0 {
+		d += types.Duration(s.Rand().Int63n(int64(c.Jitter) + 1))
+	}
+	return d
+}
+
+// readyAt returns when the cooldown of an IP released now by a tenant ends
+func (c *Cooldown) readyAt(s types.Simulator, id types.TenantId) types.Duration {
+	return s.GetTime() + c.duration(s, id)
+}
+
+type cooldownEntry[T any] struct {
+	Ready types.Duration
+	Seq   uint64
+	Value T
+}
+
+// cooldownQueue is a min-heap of released IPs (or the entries holding them), ordered by the end of their cooldown and then by release
+type cooldownQueue[T any] struct {
+	entries []cooldownEntry[T]
+	seq     uint64
+}
+
+func (q *cooldownQueue[T]) Len() int { return len(q.entries) }
+func (q *cooldownQueue[T]) Less(i, j int) bool {
+	a, b := q.entries[i], q.entries[j]
+	if a.Ready != b.Ready {
+		return a.Ready < b.Ready
+	}
+	return a.Seq < b.Seq
+}
+func (q *cooldownQueue[T]) Swap(i, j int)      { q.entries[i], q.entries[j] = q.entries[j], q.entries[i] }
+func (q *cooldownQueue[T]) Push(x interface{}) { q.entries = append(q.entries, x.(cooldownEntry[T])) }
+func (q *cooldownQueue[T]) Pop() interface{} {
+	e := q.entries[len(q.entries)-1]
+	q.entries = q.entries[:len(q.entries)-1]
+	return e
+}
+
+func (q *cooldownQueue[T]) add(ready types.Duration, v T) {
+	heap.Push(q, cooldownEntry[T]{ready, q.seq, v})
+	q.seq++
+}
+
+// ready returns whether the cooldown of the next value has ended by time t
+func (q *cooldownQueue[T]) ready(t types.Duration) bool {
+	return len(q.entries) > 0 && q.entries[0].Ready <= t
+}
+
+// take removes the value whose cooldown ends first
+func (q *cooldownQueue[T]) take() T {
+	return heap.Pop(q).(cooldownEntry[T]).Value
+}
+
+// pending counts the values whose cooldown hasn't ended by time t
+func (q *cooldownQueue[T]) pending(t types.Duration) int {
+	n := 0
+	for _, e := range q.entries {
+		if e.Ready > t {
+			n++
+		}
+	}
+	return n
+}
+
+// filter keeps only the values for which keep returns true
+func (q *cooldownQueue[T]) filter(keep func(T) bool) {
+	kept := q.entries[:0]
+	for _, e := range q.entries {
+		if keep(e.Value) {
+			kept = append(kept, e)
+		}
+	}
+	q.entries = kept
+	heap.Init(q)
+}
+
+type cooldownQueueCheckpoint[T any] struct {
+	Entries []cooldownEntry[T]
+	Seq     uint64
+}
+
+func (q *cooldownQueue[T]) checkpoint() cooldownQueueCheckpoint[T] {
+	return cooldownQueueCheckpoint[T]{q.entries, q.seq}
+}
+
+// restore loads a checkpointed queue, whose entries are already in heap order
+func (q *cooldownQueue[T]) restore(c cooldownQueueCheckpoint[T]) {
+	q.entries, q.seq = c.Entries, c.Seq
+}
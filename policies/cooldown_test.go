@@ -0,0 +1,36 @@
+package policies
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+func TestTenantCooldown(t *testing.T) {
+	var cooldown Cooldown
+	err := json.Unmarshal([]byte(`{"Type": "tenant", "Duration": 1800, "Tenants": [{"Agent": 1, "FirstTenant": 5, "LastTenant": 9, "Duration": 0}, {"Agent": 0, "Duration": 600}]}`), &cooldown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSimulator()
+	// Ranges are offsets from each agent's first tenant, and a range of 0-0 is all of the agent's tenants
+	for _, c := range []struct {
+		id   types.TenantId
+		want types.Duration
+	}{{1, 600}, {1000, 600}, {1001, 1800}, {1006, 0}, {1010, 0}, {1011, 1800}, {2006, 1800}} {
+		if d := cooldown.minimum(s, c.id); d != c.want {
+			t.Errorf("tenant %d has cooldown %v, want %v", c.id, d, c.want)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"Type": "tenant", "Tenants": [{"Agent": -1}]}`,
+		`{"Type": "tenant", "Tenants": [{"Agent": 0, "FirstTenant": 5, "LastTenant": 4}]}`,
+		`{"Type": "tenant", "Tenants": [{"Agent": 0, "Duration": -1}]}`,
+	} {
+		if json.Unmarshal([]byte(bad), &cooldown) == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
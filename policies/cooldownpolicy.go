@@ -0,0 +1,124 @@
+package policies
+
+import (
+	"encoding/json"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+type cooldownRelease struct {
+	IP     types.IPAddress
+	Tenant types.TenantId
+}
+
+/*
+CooldownPolicy is middleware that holds released IPs back from its Inner policy until their cooldown ends, which adds a cooldown to any policy. Mode, Duration, Jitter, and Tenants configure the cooldown like the Type, Duration, Jitter, and Tenants of a Cooldown.
+*/
+type CooldownPolicy struct {
+	BasePolicy
+	Middleware
+	Mode     string `json:",omitempty"`
+	Duration types.Duration
+	Jitter   types.Duration   `json:",omitempty"`
+	Tenants  []TenantCooldown `json:",omitempty"`
+
+	queue cooldownQueue[cooldownRelease]
+}
+
+func NewCooldownPolicy() types.PoolPolicy {
+	return &CooldownPolicy{BasePolicy: BasePolicy{Type: "cooldown"}, Middleware: newMiddleware(NewFIFOPool()), Duration: 30 * types.Minute}
+}
+
+func (c *CooldownPolicy) UnmarshalJSON(b []byte) error {
+	type w CooldownPolicy
+	err := json.Unmarshal(b, (*w)(c))
+	if err != nil {
+		return err
+	}
+	cooldown := c.cooldown()
+	return cooldown.validate()
+}
+
+func (c *CooldownPolicy) cooldown() Cooldown {
+	return Cooldown{c.Mode, c.Duration, c.Jitter, c.Tenants}
+}
+
+// MinCooldown is the policy's own cooldown, followed by that of the inner policy
+func (c *CooldownPolicy) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	cooldown := c.cooldown()
+	return cooldown.minimum(s, id) + c.Middleware.MinCooldown(s, id)
+}
+
+// ReportStats reports the IPs still held back from the inner policy, along with the inner policy's metrics
+func (c *CooldownPolicy) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["cooldownBacklog"] = c.queue.pending(s.GetTime())
+	c.Middleware.ReportStats(s, stats)
+}
+
+func (c *CooldownPolicy) Init(s types.Simulator) {
+	c.Inner.Init(s)
+}
+
+func (c *CooldownPolicy) Seed(s types.Simulator, ip types.IPAddress) {
+	c.Inner.Seed(s, ip)
+}
+
+// drain releases the IPs whose cooldown has ended by time t to the inner policy
+func (c *CooldownPolicy) drain(s types.Simulator, t types.Duration) {
+	for c.queue.ready(t) {
+		r := c.queue.take()
+		c.Inner.ReleaseIP(s, r.IP, r.Tenant)
+	}
+}
+
+func (c *CooldownPolicy) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	c.drain(s, s.GetTime())
+	return c.Inner.GetIP(s, id)
+}
+
+// GetCooldownIP takes the IP whose cooldown ends first, or else bypasses the inner policy's cooldown
+func (c *CooldownPolicy) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if c.queue.Len() == 0 {
+		return c.innerCooldownIP(s, id)
+	}
+	return c.queue.take().IP, nil
+}
+
+func (c *CooldownPolicy) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		removed.Add(ip)
+	}
+	c.queue.filter(func(r cooldownRelease) bool { return !removed.Contains(r.IP) })
+	c.removeInner(s, ips)
+}
+
+func (c *CooldownPolicy) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	cooldown := c.cooldown()
+	c.queue.add(cooldown.readyAt(s, id), cooldownRelease{ip, id})
+	c.drain(s, s.GetTime())
+}
+
+type cooldownPolicyCheckpoint struct {
+	Inner []byte
+	Queue cooldownQueueCheckpoint[cooldownRelease]
+}
+
+func (c *CooldownPolicy) Checkpoint() ([]byte, error) {
+	inner, err := c.checkpointInner()
+	if err != nil {
+		return nil, err
+	}
+	return util.EncodeGob(cooldownPolicyCheckpoint{inner, c.queue.checkpoint()})
+}
+
+func (c *CooldownPolicy) Restore(s types.Simulator, b []byte) error {
+	var cp cooldownPolicyCheckpoint
+	err := util.DecodeGob(b, &cp)
+	if err != nil {
+		return err
+	}
+	c.queue.restore(cp.Queue)
+	return c.restoreInner(s, cp.Inner)
+}
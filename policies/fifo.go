@@ -1,20 +1,46 @@
 package policies
 
-import "github.com/MadSP-McDaniel/eipsim/types"
+import (
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
 
+// FIFOPool hands out free IPs in the order they were released. Released IPs have no Cooldown by default.
 type FIFOPool struct {
-	ips []types.IPAddress
+	ips   []types.IPAddress
+	queue cooldownQueue[types.IPAddress]
 	BasePolicy
+	Cooldown Cooldown
+}
+
+func (f *FIFOPool) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	return f.Cooldown.minimum(s, id)
+}
+
+// ReportStats reports the IPs still in their cooldown
+func (f *FIFOPool) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["cooldownBacklog"] = f.queue.pending(s.GetTime())
 }
 
 func (f *FIFOPool) Init(s types.Simulator) {
 }
 
 func NewFIFOPool() types.PoolPolicy {
-	return &FIFOPool{nil, BasePolicy{Type: "fifo"}}
+	return &FIFOPool{BasePolicy: BasePolicy{Type: "fifo"}}
 }
 
-func (f *FIFOPool) GetIP(s types.Simulator, id types.TenantId) (ip types.IPAddress) {
+// drain frees the IPs whose cooldown has ended by time t
+func (f *FIFOPool) drain(t types.Duration) {
+	for f.queue.ready(t) {
+		f.ips = append(f.ips, f.queue.take())
+	}
+}
+
+func (f *FIFOPool) GetIP(s types.Simulator, id types.TenantId) (ip types.IPAddress, err error) {
+	f.drain(s.GetTime())
+	if len(f.ips) == 0 {
+		return 0, types.ErrPoolExhausted
+	}
 	ip, f.ips = f.ips[0], f.ips[1:]
 	return
 }
@@ -23,6 +49,56 @@ func (f *FIFOPool) Seed(s types.Simulator, ip types.IPAddress) {
 	f.ips = append(f.ips, ip)
 }
 
-func (f *FIFOPool) ReleaseIP(s types.Simulator, ip types.IPAddress, _ types.TenantId) {
+func (f *FIFOPool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		removed.Add(ip)
+	}
+	kept := f.ips[:0]
+	for _, ip := range f.ips {
+		if !removed.Contains(ip) {
+			kept = append(kept, ip)
+		}
+	}
+	f.ips = kept
+	f.queue.filter(func(ip types.IPAddress) bool { return !removed.Contains(ip) })
+}
+
+// GetCooldownIP takes the IP whose cooldown ends first
+func (f *FIFOPool) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if f.queue.Len() == 0 {
+		return 0, types.ErrPoolExhausted
+	}
+	return f.queue.take(), nil
+}
+
+func (f *FIFOPool) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	t := s.GetTime()
+	ready := f.Cooldown.readyAt(s, id)
+	if ready > t {
+		f.queue.add(ready, ip)
+		return
+	}
+	f.drain(t)
 	f.ips = append(f.ips, ip)
 }
+
+type fifoPoolCheckpoint struct {
+	IPs   []types.IPAddress
+	Queue cooldownQueueCheckpoint[types.IPAddress]
+}
+
+func (f *FIFOPool) Checkpoint() ([]byte, error) {
+	return util.EncodeGob(fifoPoolCheckpoint{f.ips, f.queue.checkpoint()})
+}
+
+func (f *FIFOPool) Restore(s types.Simulator, b []byte) error {
+	var c fifoPoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	f.ips = c.IPs
+	f.queue.restore(c.Queue)
+	return nil
+}
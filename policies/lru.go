@@ -0,0 +1,161 @@
+package policies
+
+import (
+	"container/heap"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+// lruEntry is a free IP, keyed on the time it was last released
+type lruEntry struct {
+	Released  types.Duration
+	IPAddress types.IPAddress
+}
+
+// lruHeap is a min-heap of free IPs that tracks the position of each IP, so IPs can be removed from the middle
+type lruHeap struct {
+	entries []lruEntry
+	index   map[types.IPAddress]int
+}
+
+func (h *lruHeap) Len() int { return len(h.entries) }
+func (h *lruHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if a.Released != b.Released {
+		return a.Released < b.Released
+	}
+	return a.IPAddress < b.IPAddress
+}
+func (h *lruHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].IPAddress] = i
+	h.index[h.entries[j].IPAddress] = j
+}
+func (h *lruHeap) Push(x interface{}) {
+	e := x.(lruEntry)
+	h.index[e.IPAddress] = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+func (h *lruHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	delete(h.index, e.IPAddress)
+	return e
+}
+
+/*
+LRUPool always hands out the free IP that was released the longest time ago, which maximizes the expected time for latent configurations to expire.
+
+"lru" orders IPs by their last benign release (IPInfo.ReleasedBenign), so IPs released by an adversary keep their place in line; "lru-any" orders them by their last release of any kind. IPs that were never released come first, in address order, and ties are broken by address. Allocation and release take O(log n) time. Released IPs have no Cooldown by default.
+*/
+type LRUPool struct {
+	BasePolicy
+	AnyRelease bool // Order IPs by their last release, rather than their last benign release
+	Cooldown   Cooldown
+
+	free  lruHeap
+	queue cooldownQueue[types.IPAddress]
+}
+
+func NewLRUPool(anyRelease bool) types.PoolPolicy {
+	typeName := "lru"
+	if anyRelease {
+		typeName = "lru-any"
+	}
+	return &LRUPool{BasePolicy: BasePolicy{Type: typeName}, AnyRelease: anyRelease}
+}
+
+func (p *LRUPool) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	return p.Cooldown.minimum(s, id)
+}
+
+// ReportStats reports the IPs still in their cooldown
+func (p *LRUPool) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["cooldownBacklog"] = p.queue.pending(s.GetTime())
+}
+
+func (p *LRUPool) Init(s types.Simulator) {
+	p.free = lruHeap{index: make(map[types.IPAddress]int)}
+}
+
+func (p *LRUPool) released(s types.Simulator, ip types.IPAddress) types.Duration {
+	info := s.GetInfo(ip)
+	if p.AnyRelease {
+		return info.Released
+	}
+	return info.ReleasedBenign
+}
+
+func (p *LRUPool) Seed(s types.Simulator, ip types.IPAddress) {
+	heap.Push(&p.free, lruEntry{p.released(s, ip), ip})
+}
+
+// drain frees the IPs whose cooldown has ended by time t
+func (p *LRUPool) drain(s types.Simulator, t types.Duration) {
+	for p.queue.ready(t) {
+		ip := p.queue.take()
+		heap.Push(&p.free, lruEntry{p.released(s, ip), ip})
+	}
+}
+
+func (p *LRUPool) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	p.drain(s, s.GetTime())
+	if p.free.Len() == 0 {
+		return 0, types.ErrPoolExhausted
+	}
+	return heap.Pop(&p.free).(lruEntry).IPAddress, nil
+}
+
+func (p *LRUPool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		removed.Add(ip)
+		if i, ok := p.free.index[ip]; ok {
+			heap.Remove(&p.free, i)
+		}
+	}
+	p.queue.filter(func(ip types.IPAddress) bool { return !removed.Contains(ip) })
+}
+
+// GetCooldownIP takes the IP whose cooldown ends first
+func (p *LRUPool) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if p.queue.Len() == 0 {
+		return 0, types.ErrPoolExhausted
+	}
+	return p.queue.take(), nil
+}
+
+func (p *LRUPool) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	ready := p.Cooldown.readyAt(s, id)
+	if ready > s.GetTime() {
+		p.queue.add(ready, ip)
+		return
+	}
+	heap.Push(&p.free, lruEntry{p.released(s, ip), ip})
+}
+
+type lruPoolCheckpoint struct {
+	Free  []lruEntry
+	Queue cooldownQueueCheckpoint[types.IPAddress]
+}
+
+func (p *LRUPool) Checkpoint() ([]byte, error) {
+	return util.EncodeGob(lruPoolCheckpoint{p.free.entries, p.queue.checkpoint()})
+}
+
+func (p *LRUPool) Restore(s types.Simulator, b []byte) error {
+	var c lruPoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	// The entries were saved in heap order, so only the index needs rebuilding
+	p.Init(s)
+	p.free.entries = c.Free
+	for i, e := range c.Free {
+		p.free.index[e.IPAddress] = i
+	}
+	p.queue.restore(c.Queue)
+	return nil
+}
@@ -0,0 +1,107 @@
+package policies
+
+import (
+	"fmt"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+/*
+Middleware is embedded by policies that wrap an Inner policy, adding a behavior such as a cooldown on top of it. Middleware policies can be stacked in JSON, e.g.
+
+	{"Type": "cooldown", "Duration": 1800, "Inner": {"Type": "affinity", "Inner": {"Type": "fifo"}}}
+
+The inner policy only sees the IPs that the middleware passes on to it, so an IP held back by the middleware is released to the inner policy late, and one reused by the middleware is never released to it at all.
+*/
+type Middleware struct {
+	Inner PoolPolicyWrapper
+}
+
+func newMiddleware(inner types.PoolPolicy) Middleware {
+	return Middleware{PoolPolicyWrapper{Type: inner.GetType(), PoolPolicy: inner}}
+}
+
+// Unwrap returns the inner policy.
+func (m *Middleware) Unwrap() types.PoolPolicy {
+	return m.Inner.PoolPolicy
+}
+
+// Innermost returns the policy at the bottom of a stack of middleware.
+func Innermost(p types.PoolPolicy) types.PoolPolicy {
+	for {
+		m, ok := p.(interface{ Unwrap() types.PoolPolicy })
+		if !ok {
+			return p
+		}
+		p = m.Unwrap()
+	}
+}
+
+func (m *Middleware) removeInner(s types.Simulator, ips []types.IPAddress) {
+	r, ok := m.Inner.PoolPolicy.(types.IPRemover)
+	if !ok {
+		panic("policy " + m.Inner.Type + " doesn't support removing IPs")
+	}
+	r.RemoveIPs(s, ips)
+}
+
+// innerCooldownIP bypasses the inner policy's cooldown, if it has one
+func (m *Middleware) innerCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if b, ok := m.Inner.PoolPolicy.(types.CooldownBypasser); ok {
+		return b.GetCooldownIP(s, id)
+	}
+	return 0, types.ErrPoolExhausted
+}
+
+func (m *Middleware) checkpointInner() ([]byte, error) {
+	c, ok := m.Inner.PoolPolicy.(types.Checkpointer)
+	if !ok {
+		return nil, fmt.Errorf("policy %s doesn't support checkpoints", m.Inner.Type)
+	}
+	return c.Checkpoint()
+}
+
+func (m *Middleware) restoreInner(s types.Simulator, b []byte) error {
+	c, ok := m.Inner.PoolPolicy.(types.Checkpointer)
+	if !ok {
+		return fmt.Errorf("policy %s doesn't support checkpoints", m.Inner.Type)
+	}
+	return c.Restore(s, b)
+}
+
+// RecoverIP passes on a recovery request to the inner policy, if it supports them
+func (m *Middleware) RecoverIP(s types.Simulator, ip types.IPAddress, id types.TenantId) bool {
+	if r, ok := m.Inner.PoolPolicy.(types.IPRecoverer); ok {
+		return r.RecoverIP(s, ip, id)
+	}
+	return false
+}
+
+// MinCooldown passes on the cooldown guaranteed by the inner policy, or 0 if it doesn't declare one
+func (m *Middleware) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	if d, ok := m.Inner.PoolPolicy.(types.CooldownDeclarer); ok {
+		return d.MinCooldown(s, id)
+	}
+	return 0
+}
+
+// ReportStats passes on the inner policy's metrics under its type, if it reports any, so that each level of a stack can be told apart
+func (m *Middleware) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	r, ok := m.Inner.PoolPolicy.(types.StatsReporter)
+	if !ok {
+		return
+	}
+	inner := map[string]interface{}{}
+	r.ReportStats(s, inner)
+	if len(inner) > 0 {
+		stats[m.Inner.Type] = inner
+	}
+}
+
+// ClassifiedTenants passes on the classification of the inner policy, or returns nil if it doesn't classify tenants.
+func (m *Middleware) ClassifiedTenants() map[types.TenantId]bool {
+	if c, ok := m.Inner.PoolPolicy.(types.TenantClassifier); ok {
+		return c.ClassifiedTenants()
+	}
+	return nil
+}
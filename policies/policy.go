@@ -2,11 +2,70 @@ package policies
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
 )
 
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]func() types.PoolPolicy{}
+)
+
+// Register makes a policy type available to PoolPolicyWrapper, so that it can be loaded from JSON. The factory should return a new policy with its defaults set; fields present in the JSON are then unmarshalled into it.
+func Register(typeName string, factory func() types.PoolPolicy) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[typeName]; ok {
+		panic("policy type " + typeName + " registered twice")
+	}
+	registry[typeName] = factory
+}
+
+// Registered lists the registered policy types.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a policy of a registered type.
+func New(typeName string) (types.PoolPolicy, error) {
+	registryLock.RLock()
+	factory, ok := registry[typeName]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown policy type %q", typeName)
+	}
+	return factory(), nil
+}
+
+func init() {
+	Register("random", NewRandomPool)
+	Register("fifo", NewFIFOPool)
+	Register("tagged", NewTaggedPool)
+	Register("segmented", func() types.PoolPolicy { return NewSegmentedPool(1, false) })
+	Register("segmented-neg", func() types.PoolPolicy { return NewSegmentedPool(1, true) })
+	Register("segmented-adaptive", NewAdaptiveSegmentedPool)
+	Register("subnet-affinity", NewSubnetAffinityPool)
+	Register("lru", func() types.PoolPolicy { return NewLRUPool(false) })
+	Register("lru-any", func() types.PoolPolicy { return NewLRUPool(true) })
+	Register("quarantine", NewQuarantinePool)
+	Register("reputation", NewReputationPool)
+	Register("cooldown", NewCooldownPolicy)
+	Register("affinity", NewAffinityPolicy)
+	Register("recovery", NewRecoveryPolicy)
+	Register("reserved", NewReservedPolicy)
+}
+
 type PoolPolicyWrapper struct {
 	Type             string
 	types.PoolPolicy `json:"-"`
@@ -20,21 +79,10 @@ func (p *PoolPolicyWrapper) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	p.PoolPolicy, err = New(p.Type)
 	if err != nil {
 		return err
 	}
-	switch p.Type {
-	case "random":
-		p.PoolPolicy = &RandomPool{}
-	case "fifo":
-		p.PoolPolicy = &FIFOPool{}
-	case "tagged":
-		p.PoolPolicy = &TaggedPool{}
-	case "segmented":
-		p.PoolPolicy = &SegmentedPool{}
-	default:
-		return errors.New("unknown agent type")
-	}
 	err = json.Unmarshal(b, p.PoolPolicy)
 	if err != nil {
 		return err
@@ -43,7 +91,11 @@ func (p *PoolPolicyWrapper) UnmarshalJSON(b []byte) error {
 }
 
 func (p *PoolPolicyWrapper) MarshalJSON() ([]byte, error) {
-	return json.Marshal(p.PoolPolicy)
+	b, err := json.Marshal(p.PoolPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return util.WithType(b, p.Type)
 }
 
 type BasePolicy struct {
@@ -0,0 +1,70 @@
+package policies
+
+import (
+	"math/rand"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/datadog/hyperloglog"
+)
+
+// testSimulator is the part of a simulator that policies use, for driving a policy by hand. Its other methods panic.
+type testSimulator struct {
+	types.Simulator
+	t    types.Duration
+	rand *rand.Rand
+	info map[types.IPAddress]*types.IPInfo
+}
+
+func newTestSimulator() *testSimulator {
+	return &testSimulator{rand: rand.New(rand.NewSource(1)), info: map[types.IPAddress]*types.IPInfo{}}
+}
+
+func (s *testSimulator) GetTime() types.Duration { return s.t }
+
+func (s *testSimulator) Rand() *rand.Rand { return s.rand }
+
+// TenantAgent numbers each agent's tenants from 1000 times its index, plus one
+func (s *testSimulator) TenantAgent(id types.TenantId) (int, types.TenantId) {
+	if id == types.NilTenant {
+		return -1, 0
+	}
+	return int((id - 1) / 1000), (id - 1) % 1000
+}
+
+func (s *testSimulator) GetInfo(ip types.IPAddress) *types.IPInfo {
+	info, ok := s.info[ip]
+	if !ok {
+		hll, err := hyperloglog.New(16)
+		if err != nil {
+			panic(err)
+		}
+		info = &types.IPInfo{Address: ip, Owners: hll, Configurations: map[types.TenantId]types.Duration{}, Owner: types.NilTenant}
+		s.info[ip] = info
+	}
+	return info
+}
+
+// allocate gives a tenant an IP from a policy, recording it as the simulator would
+func (s *testSimulator) allocate(p types.PoolPolicy, id types.TenantId) (types.IPAddress, error) {
+	ip, err := p.GetIP(s, id)
+	if err != nil {
+		return ip, err
+	}
+	info := s.GetInfo(ip)
+	info.Owner = id
+	info.AllocatedAt = s.t
+	return ip, nil
+}
+
+// release returns a tenant's IP to a policy, recording it as the simulator would
+func (s *testSimulator) release(p types.PoolPolicy, ip types.IPAddress, benign bool) {
+	info := s.GetInfo(ip)
+	id := info.Owner
+	info.Released = s.t
+	if benign {
+		info.ReleasedBenign = s.t
+		info.Owners.Add(uint32(id))
+	}
+	info.Owner = types.NilTenant
+	p.ReleaseIP(s, ip, id)
+}
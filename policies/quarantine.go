@@ -0,0 +1,316 @@
+package policies
+
+import (
+	"math"
+	"sort"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+// Number of free IPs sampled when a flagged tenant can't be served from the quarantine
+const quarantineSampleSize = 50
+
+// quarantineTenant holds the online behavioral features of a tenant
+type quarantineTenant struct {
+	First       types.Duration // When the tenant was first seen
+	Allocations int
+	Releases    int
+	Quick       int     // Releases of IPs held for less than QuickRelease
+	HoldMean    float64 // Running mean and sum of squared deviations of hold times, in seconds
+	HoldM2      float64
+	Flagged     bool
+}
+
+// rate returns events per hour since the tenant was first seen, over at least an hour
+func (q *quarantineTenant) rate(events int, now types.Duration) float64 {
+	span := max(now-q.First, types.Hour)
+	return float64(events) * float64(types.Hour) / float64(span)
+}
+
+func (q *quarantineTenant) addHold(held types.Duration) {
+	q.Releases++
+	delta := float64(held) - q.HoldMean
+	q.HoldMean += delta / float64(q.Releases)
+	q.HoldM2 += delta * (float64(held) - q.HoldMean)
+}
+
+// holdCV returns the coefficient of variation of the tenant's hold times
+func (q *quarantineTenant) holdCV() float64 {
+	if q.HoldMean == 0 {
+		return 0
+	}
+	return math.Sqrt(q.HoldM2/float64(q.Releases)) / q.HoldMean
+}
+
+/*
+QuarantinePool detects tenants that behave like scanners and isolates them from IPs that benign tenants have used recently.
+
+It keeps online features of each tenant: its allocation and release rates, the variance of its hold times, and the fraction of IPs it releases quickly. Once a tenant has released MinReleases IPs, it is flagged (for good) if its allocation and release rates are at least AllocationRate and ReleaseRate per hour, at least QuickFraction of its releases held the IP for less than QuickRelease, and the coefficient of variation of its hold times is at most MaxHoldCV. A zero threshold disables that check.
+
+Free IPs that haven't been released by an unflagged tenant for QuarantineAge (or ever) form a quarantine sub-pool. Flagged tenants are served from the quarantine, falling back to the sampled free IP with the oldest unflagged release, while other tenants are served from the rest of the pool first so that the quarantine stays stocked. Released IPs go through a Cooldown, 30 minutes by default.
+
+The simulator reports the policy's false positives and false negatives against which agents are really adversarial.
+*/
+type QuarantinePool struct {
+	BasePolicy
+	Cooldown      Cooldown
+	QuarantineAge types.Duration
+
+	MinReleases    int
+	AllocationRate float64
+	ReleaseRate    float64
+	QuickRelease   types.Duration
+	QuickFraction  float64
+	MaxHoldCV      float64
+
+	QuarantineHits   int // Allocations to flagged tenants served from the quarantine
+	QuarantineMisses int // Allocations to flagged tenants served from the rest of the pool
+
+	fresh      *util.IPSet // Free IPs outside the quarantine
+	quarantine *util.IPSet
+	queue      cooldownQueue[types.IPAddress]
+	aging      cooldownQueue[types.IPAddress] // Fresh IPs, keyed on when they can join the quarantine. Entries are stale if the IP has since been taken.
+	lastClean  map[types.IPAddress]types.Duration
+	tenants    map[types.TenantId]*quarantineTenant
+}
+
+func NewQuarantinePool() types.PoolPolicy {
+	return &QuarantinePool{
+		BasePolicy:     BasePolicy{Type: "quarantine"},
+		Cooldown:       Cooldown{Duration: 30 * types.Minute},
+		QuarantineAge:  1 * types.Day,
+		MinReleases:    20,
+		AllocationRate: 2,
+		ReleaseRate:    2,
+		QuickRelease:   1 * types.Hour,
+		QuickFraction:  0.9,
+		MaxHoldCV:      0.25,
+	}
+}
+
+func (p *QuarantinePool) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	return p.Cooldown.minimum(s, id)
+}
+
+// ReportStats reports the IPs still in their cooldown, the size of the quarantine, and where flagged tenants' allocations were served from
+func (p *QuarantinePool) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["cooldownBacklog"] = p.queue.pending(s.GetTime())
+	stats["quarantined"] = p.quarantine.Len()
+	stats["quarantineHits"] = p.QuarantineHits
+	stats["quarantineMisses"] = p.QuarantineMisses
+}
+
+func (p *QuarantinePool) Init(s types.Simulator) {
+	p.fresh = util.NewIPSet()
+	p.quarantine = util.NewIPSet()
+	p.lastClean = make(map[types.IPAddress]types.Duration)
+	p.tenants = make(map[types.TenantId]*quarantineTenant)
+}
+
+func (p *QuarantinePool) Seed(s types.Simulator, ip types.IPAddress) {
+	p.free(s, ip)
+}
+
+// free adds an IP to the quarantine if it has been long enough since an unflagged tenant released it, or else to the rest of the pool
+func (p *QuarantinePool) free(s types.Simulator, ip types.IPAddress) {
+	clean, ok := p.lastClean[ip]
+	if !ok || clean+p.QuarantineAge <= s.GetTime() {
+		p.quarantine.Add(ip)
+		return
+	}
+	p.fresh.Add(ip)
+	p.aging.add(clean+p.QuarantineAge, ip)
+}
+
+func (p *QuarantinePool) getTenant(s types.Simulator, id types.TenantId) *quarantineTenant {
+	tenant, ok := p.tenants[id]
+	if !ok {
+		tenant = &quarantineTenant{First: s.GetTime()}
+		p.tenants[id] = tenant
+	}
+	return tenant
+}
+
+func (p *QuarantinePool) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	t := s.GetTime()
+	for p.queue.ready(t) {
+		p.free(s, p.queue.take())
+	}
+	for p.aging.ready(t) {
+		ip := p.aging.take()
+		if p.fresh.Contains(ip) && p.lastClean[ip]+p.QuarantineAge <= t {
+			p.fresh.Remove(ip)
+			p.quarantine.Add(ip)
+		}
+	}
+	if p.fresh.Len()+p.quarantine.Len() == 0 {
+		return 0, types.ErrPoolExhausted
+	}
+
+	tenant := p.getTenant(s, id)
+	tenant.Allocations++
+	var ip types.IPAddress
+	switch {
+	case tenant.Flagged && p.quarantine.Len() > 0:
+		p.QuarantineHits++
+		ip = p.quarantine.Random(s.Rand())
+	case tenant.Flagged:
+		p.QuarantineMisses++
+		ip = p.oldestFresh(s)
+	case p.fresh.Len() > 0:
+		ip = p.fresh.Random(s.Rand())
+	default:
+		ip = p.quarantine.Random(s.Rand())
+	}
+	p.fresh.Remove(ip)
+	p.quarantine.Remove(ip)
+	return ip, nil
+}
+
+// oldestFresh samples free IPs outside the quarantine, and returns the one released by an unflagged tenant the longest ago
+func (p *QuarantinePool) oldestFresh(s types.Simulator) types.IPAddress {
+	sampleAll := p.fresh.Len() <= quarantineSampleSize
+	var best types.IPAddress
+	for i := 0; i < quarantineSampleSize && i < p.fresh.Len(); i++ {
+		var ip types.IPAddress
+		if sampleAll {
+			ip = p.fresh.At(i)
+		} else {
+			ip = p.fresh.Random(s.Rand())
+		}
+		if i == 0 || p.lastClean[ip] < p.lastClean[best] {
+			best = ip
+		}
+	}
+	return best
+}
+
+// GetCooldownIP takes the IP whose cooldown ends first
+func (p *QuarantinePool) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if p.queue.Len() == 0 {
+		return 0, types.ErrPoolExhausted
+	}
+	p.getTenant(s, id).Allocations++
+	return p.queue.take(), nil
+}
+
+func (p *QuarantinePool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		removed.Add(ip)
+		p.fresh.Remove(ip)
+		p.quarantine.Remove(ip)
+		delete(p.lastClean, ip)
+	}
+	keep := func(ip types.IPAddress) bool { return !removed.Contains(ip) }
+	p.queue.filter(keep)
+	p.aging.filter(keep)
+}
+
+func (p *QuarantinePool) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	t := s.GetTime()
+	held := t - s.GetInfo(ip).AllocatedAt
+	tenant := p.getTenant(s, id)
+	tenant.addHold(held)
+	if held < p.QuickRelease {
+		tenant.Quick++
+	}
+	if !tenant.Flagged {
+		tenant.Flagged = p.suspicious(tenant, t)
+	}
+	if !tenant.Flagged {
+		p.lastClean[ip] = t
+	}
+	p.queue.add(p.Cooldown.readyAt(s, id), ip)
+}
+
+// suspicious returns whether a tenant's features match those of a scanner
+func (p *QuarantinePool) suspicious(tenant *quarantineTenant, t types.Duration) bool {
+	if tenant.Releases < p.MinReleases {
+		return false
+	}
+	if p.AllocationRate > 0 && tenant.rate(tenant.Allocations, t) < p.AllocationRate {
+		return false
+	}
+	if p.ReleaseRate > 0 && tenant.rate(tenant.Releases, t) < p.ReleaseRate {
+		return false
+	}
+	if p.QuickFraction > 0 && float64(tenant.Quick) < p.QuickFraction*float64(tenant.Releases) {
+		return false
+	}
+	if p.MaxHoldCV > 0 && tenant.holdCV() > p.MaxHoldCV {
+		return false
+	}
+	return true
+}
+
+func (p *QuarantinePool) ClassifiedTenants() map[types.TenantId]bool {
+	classified := make(map[types.TenantId]bool, len(p.tenants))
+	for id, tenant := range p.tenants {
+		classified[id] = tenant.Flagged
+	}
+	return classified
+}
+
+type quarantineCleanCheckpoint struct {
+	IP    types.IPAddress
+	Clean types.Duration
+}
+
+type quarantineTenantCheckpoint struct {
+	ID     types.TenantId
+	Tenant quarantineTenant
+}
+
+type quarantinePoolCheckpoint struct {
+	Fresh      []types.IPAddress
+	Quarantine []types.IPAddress
+	Queue      cooldownQueueCheckpoint[types.IPAddress]
+	Aging      cooldownQueueCheckpoint[types.IPAddress]
+	LastClean  []quarantineCleanCheckpoint
+	Tenants    []quarantineTenantCheckpoint
+}
+
+func (p *QuarantinePool) Checkpoint() ([]byte, error) {
+	c := quarantinePoolCheckpoint{
+		Fresh:      p.fresh.Slice(),
+		Quarantine: p.quarantine.Slice(),
+		Queue:      p.queue.checkpoint(),
+		Aging:      p.aging.checkpoint(),
+	}
+	for ip, clean := range p.lastClean {
+		c.LastClean = append(c.LastClean, quarantineCleanCheckpoint{ip, clean})
+	}
+	sort.Slice(c.LastClean, func(i, j int) bool { return c.LastClean[i].IP < c.LastClean[j].IP })
+	for id, tenant := range p.tenants {
+		c.Tenants = append(c.Tenants, quarantineTenantCheckpoint{id, *tenant})
+	}
+	sort.Slice(c.Tenants, func(i, j int) bool { return c.Tenants[i].ID < c.Tenants[j].ID })
+	return util.EncodeGob(c)
+}
+
+func (p *QuarantinePool) Restore(s types.Simulator, b []byte) error {
+	var c quarantinePoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	p.Init(s)
+	for _, ip := range c.Fresh {
+		p.fresh.Add(ip)
+	}
+	for _, ip := range c.Quarantine {
+		p.quarantine.Add(ip)
+	}
+	p.queue.restore(c.Queue)
+	p.aging.restore(c.Aging)
+	for _, lc := range c.LastClean {
+		p.lastClean[lc.IP] = lc.Clean
+	}
+	for _, tc := range c.Tenants {
+		tenant := tc.Tenant
+		p.tenants[tc.ID] = &tenant
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package policies
+
+import (
+	"math"
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+// scanner returns a tenant first seen at time 0 that has allocated and released n IPs, holding the i-th for hold(i)
+func scanner(n int, hold func(i int) types.Duration) *quarantineTenant {
+	tenant := &quarantineTenant{Allocations: n}
+	for i := 0; i < n; i++ {
+		held := hold(i)
+		tenant.addHold(held)
+		if held < types.Hour {
+			tenant.Quick++
+		}
+	}
+	return tenant
+}
+
+func TestQuarantineHoldCV(t *testing.T) {
+	// Holds of 1 and 3 seconds have a mean of 2 and a standard deviation of 1
+	tenant := scanner(2, func(i int) types.Duration { return types.Duration(1 + 2*i) })
+	if cv := tenant.holdCV(); math.Abs(cv-0.5) > 1e-12 {
+		t.Errorf("coefficient of variation %v, want 0.5", cv)
+	}
+	if cv := (&quarantineTenant{}).holdCV(); cv != 0 {
+		t.Errorf("coefficient of variation with no releases %v, want 0", cv)
+	}
+}
+
+func TestQuarantineThresholds(t *testing.T) {
+	steady := func(i int) types.Duration { return 10 * types.Minute }
+	// The defaults flag tenants that, after at least 20 releases, allocate and release at least 2 IPs an hour, release at least 90% within an hour, and hold IPs with a coefficient of variation of at most 0.25
+	for _, c := range []struct {
+		name   string
+		tenant *quarantineTenant
+		at     types.Duration
+		want   bool
+	}{
+		{"scanner", scanner(40, steady), 10 * types.Hour, true},
+		{"too few releases", scanner(19, steady), 1 * types.Hour, false},
+		{"slow allocations", &quarantineTenant{Allocations: 10, Releases: 40, Quick: 40, HoldMean: 600}, 10 * types.Hour, false},
+		{"slow releases", func() *quarantineTenant { q := scanner(40, steady); q.Allocations = 400; return q }(), 100 * types.Hour, false},
+		{"long holds", scanner(40, func(i int) types.Duration { return types.Duration(i%8+1) * 10 * types.Minute }), 10 * types.Hour, false},
+		{"variable holds", scanner(40, func(i int) types.Duration { return types.Duration(i%2*50+5) * types.Minute }), 10 * types.Hour, false},
+		// A tenant's rates are measured over at least an hour
+		{"burst", scanner(40, steady), 10 * types.Minute, true},
+	} {
+		p := NewQuarantinePool().(*QuarantinePool)
+		if got := p.suspicious(c.tenant, c.at); got != c.want {
+			t.Errorf("%s: flagged %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// A zero threshold disables its check
+	slow := &quarantineTenant{Allocations: 10, Releases: 40, Quick: 40, HoldMean: 600}
+	p := NewQuarantinePool().(*QuarantinePool)
+	p.AllocationRate = 0
+	if !p.suspicious(slow, 10*types.Hour) {
+		t.Error("tenant with slow allocations not flagged with AllocationRate disabled")
+	}
+}
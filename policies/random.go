@@ -2,49 +2,96 @@ package policies
 
 import (
 	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
 )
 
-type randomPoolQueueEntry struct {
-	types.IPAddress
-	types.Duration
-}
-
 type RandomPool struct {
-	ips   map[types.IPAddress]struct{}
-	queue []randomPoolQueueEntry
+	ips   *util.IPSet
+	queue cooldownQueue[types.IPAddress]
 	BasePolicy
+	Cooldown     Cooldown
 	MinAvailable int
 }
 
 func NewRandomPool() types.PoolPolicy {
-	return &RandomPool{BasePolicy: BasePolicy{Type: "random"}}
+	return &RandomPool{BasePolicy: BasePolicy{Type: "random"}, Cooldown: Cooldown{Duration: 30 * types.Minute}}
+}
+
+func (r *RandomPool) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	return r.Cooldown.minimum(s, id)
+}
+
+// ReportStats reports the IPs still in their cooldown, and the fewest free IPs the pool has had
+func (r *RandomPool) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["cooldownBacklog"] = r.queue.pending(s.GetTime())
+	stats["minAvailable"] = r.MinAvailable
 }
 
 func (r *RandomPool) Init(s types.Simulator) {
-	r.ips = map[types.IPAddress]struct{}{}
+	r.ips = util.NewIPSet()
 }
 
 func (r *RandomPool) Seed(s types.Simulator, ip types.IPAddress) {
-	r.ips[ip] = struct{}{}
-	r.MinAvailable = len(r.ips)
+	r.ips.Add(ip)
+	r.MinAvailable = r.ips.Len()
 }
 
-func (r *RandomPool) GetIP(s types.Simulator, id types.TenantId) types.IPAddress {
+func (r *RandomPool) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
 	t := s.GetTime()
-	for len(r.queue) > 0 && r.queue[0].Duration+(30*types.Minute) <= t {
-		r.ips[r.queue[0].IPAddress] = struct{}{}
-		r.queue = r.queue[1:]
+	for r.queue.ready(t) {
+		r.ips.Add(r.queue.take())
+	}
+	if r.ips.Len() < int(r.MinAvailable) {
+		r.MinAvailable = r.ips.Len()
+	}
+	if r.ips.Len() == 0 {
+		return 0, types.ErrPoolExhausted
 	}
-	if len(r.ips) < int(r.MinAvailable) {
-		r.MinAvailable = len(r.ips)
+	ip := r.ips.Random(s.Rand())
+	r.ips.Remove(ip)
+	return ip, nil
+}
+
+// GetCooldownIP takes the IP whose cooldown ends first
+func (r *RandomPool) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if r.queue.Len() == 0 {
+		return 0, types.ErrPoolExhausted
 	}
-	for k, _ := range r.ips {
-		delete(r.ips, k)
-		return k
+	return r.queue.take(), nil
+}
+
+func (r *RandomPool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		r.ips.Remove(ip)
+		removed.Add(ip)
 	}
-	panic("IP pool ran out of addresses")
+	r.queue.filter(func(ip types.IPAddress) bool { return !removed.Contains(ip) })
+}
+
+func (r *RandomPool) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	r.queue.add(r.Cooldown.readyAt(s, id), ip)
+}
+
+type randomPoolCheckpoint struct {
+	IPs   []types.IPAddress
+	Queue cooldownQueueCheckpoint[types.IPAddress]
+}
+
+func (r *RandomPool) Checkpoint() ([]byte, error) {
+	return util.EncodeGob(randomPoolCheckpoint{r.ips.Slice(), r.queue.checkpoint()})
 }
 
-func (r *RandomPool) ReleaseIP(s types.Simulator, ip types.IPAddress, _ types.TenantId) {
-	r.queue = append(r.queue, randomPoolQueueEntry{ip, s.GetTime()})
+func (r *RandomPool) Restore(s types.Simulator, b []byte) error {
+	var c randomPoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	r.ips = util.NewIPSet()
+	for _, ip := range c.IPs {
+		r.ips.Add(ip)
+	}
+	r.queue.restore(c.Queue)
+	return nil
 }
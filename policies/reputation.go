@@ -0,0 +1,249 @@
+package policies
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+/*
+ReputationScore is the risk that an IP carries latent configuration from benign tenants:
+
+	(Base + OwnerWeight * unique benign owners + HoldWeight * hours the last benign owner held it) * 2^(-time since benign release / HalfLife)
+
+An IP that no benign tenant has released carries no risk.
+*/
+type ReputationScore struct {
+	Base        float64
+	OwnerWeight float64
+	HoldWeight  float64
+	HalfLife    types.Duration
+}
+
+// riskTime folds an IP's risk into the time at which it decays to 1, so that free IPs can be ordered by risk once rather than rescored as time passes. IPs with no risk are ordered first.
+func (r ReputationScore) riskTime(owners int, hold types.Duration, releasedBenign types.Duration) types.Duration {
+	initial := r.Base + r.OwnerWeight*float64(owners) + r.HoldWeight*float64(hold)/float64(types.Hour)
+	if initial <= 0 {
+		return math.MinInt64
+	}
+	offset := float64(r.HalfLife) * math.Log2(initial)
+	return releasedBenign + types.Duration(min(max(offset, -1<<53), 1<<53))
+}
+
+// risk returns the risk at time t of an IP with the given riskTime
+func (r ReputationScore) risk(riskTime, t types.Duration) float64 {
+	if riskTime == math.MinInt64 {
+		return 0
+	}
+	return math.Exp2(float64(riskTime-t) / float64(r.HalfLife))
+}
+
+// reputationEntry is what the pool remembers about an IP
+type reputationEntry struct {
+	IP       types.IPAddress
+	Owner    types.TenantId // The last tenant to release the IP
+	Hold     types.Duration // How long the last benign owner held the IP
+	RiskTime types.Duration
+	Free     bool // Whether the IP is in the indexes, rather than allocated or cooling down
+}
+
+/*
+ReputationPool ranks free IPs by the risk that they carry benign tenants' latent configurations, as scored by Score from each IP's unique benign owners, the hold time of its last benign owner, and the time since its last benign release.
+
+A tenant is given back the riskiest free IP that it released last, since its own configurations are harmless to it. Other tenants are given the free IP with the lowest risk. Released IPs go through a Cooldown, 30 minutes by default.
+
+Tiers are the ascending risk thresholds between tiers, and Served counts the allocations served from each tier, along with OwnerReuses for those given back to their last owner.
+*/
+type ReputationPool struct {
+	BasePolicy
+	Cooldown Cooldown
+	Score    ReputationScore
+	Tiers    []float64
+
+	Served      []int
+	OwnerReuses int
+
+	entries map[types.IPAddress]*reputationEntry
+	index   *util.TimerIndex                    // Free IPs by risk time
+	owned   map[types.TenantId]*util.TimerIndex // Free IPs by risk time, by the tenant that released them last
+	queue   cooldownQueue[types.IPAddress]
+}
+
+func NewReputationPool() types.PoolPolicy {
+	return &ReputationPool{
+		BasePolicy: BasePolicy{Type: "reputation"},
+		Cooldown:   Cooldown{Duration: 30 * types.Minute},
+		Score:      ReputationScore{Base: 0.5, OwnerWeight: 0.1, HoldWeight: 1, HalfLife: 6 * types.Hour},
+		Tiers:      []float64{0.1, 1},
+	}
+}
+
+func (p *ReputationPool) UnmarshalJSON(b []byte) error {
+	type w ReputationPool
+	err := json.Unmarshal(b, (*w)(p))
+	if err != nil {
+		return err
+	}
+	if p.Score.HalfLife <= 0 {
+		return errors.New("reputation HalfLife must be positive")
+	}
+	if !sort.Float64sAreSorted(p.Tiers) {
+		return errors.New("reputation Tiers must be ascending")
+	}
+	return nil
+}
+
+func (p *ReputationPool) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	return p.Cooldown.minimum(s, id)
+}
+
+// ReportStats reports the IPs still in their cooldown, the allocations served from each risk tier and given back to their last owner, and the tenants with free IPs of their own
+func (p *ReputationPool) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["cooldownBacklog"] = p.queue.pending(s.GetTime())
+	stats["served"] = append([]int(nil), p.Served...)
+	stats["ownerReuses"] = p.OwnerReuses
+	stats["owners"] = len(p.owned)
+}
+
+func (p *ReputationPool) Init(s types.Simulator) {
+	p.entries = make(map[types.IPAddress]*reputationEntry)
+	p.index = util.NewTimerIndex()
+	p.owned = make(map[types.TenantId]*util.TimerIndex)
+	if len(p.Served) != len(p.Tiers)+1 {
+		p.Served = make([]int, len(p.Tiers)+1)
+	}
+}
+
+func (p *ReputationPool) Seed(s types.Simulator, ip types.IPAddress) {
+	e := &reputationEntry{IP: ip, Owner: types.NilTenant, RiskTime: math.MinInt64}
+	p.entries[ip] = e
+	p.free(e)
+}
+
+// free adds an IP to the indexes
+func (p *ReputationPool) free(e *reputationEntry) {
+	e.Free = true
+	p.index.Insert(e.IP, e.RiskTime)
+	if e.Owner == types.NilTenant {
+		return
+	}
+	owned, ok := p.owned[e.Owner]
+	if !ok {
+		owned = util.NewTimerIndex()
+		p.owned[e.Owner] = owned
+	}
+	owned.Insert(e.IP, e.RiskTime)
+}
+
+// take removes a free IP from the indexes
+func (p *ReputationPool) take(e *reputationEntry) {
+	e.Free = false
+	p.index.Remove(e.IP, e.RiskTime)
+	if owned, ok := p.owned[e.Owner]; ok {
+		owned.Remove(e.IP, e.RiskTime)
+		if owned.Len() == 0 {
+			delete(p.owned, e.Owner)
+		}
+	}
+}
+
+// tier returns the risk tier of an IP at time t
+func (p *ReputationPool) tier(e *reputationEntry, t types.Duration) int {
+	risk := p.Score.risk(e.RiskTime, t)
+	return sort.Search(len(p.Tiers), func(i int) bool { return risk < p.Tiers[i] })
+}
+
+func (p *ReputationPool) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	t := s.GetTime()
+	for p.queue.ready(t) {
+		p.free(p.entries[p.queue.take()])
+	}
+	var ip types.IPAddress
+	if owned, ok := p.owned[id]; ok {
+		ip, _, _ = owned.Floor(math.MaxInt64)
+		p.OwnerReuses++
+	} else if p.index.Len() > 0 {
+		ip, _, _ = p.index.Ceil(math.MinInt64)
+	} else {
+		return 0, types.ErrPoolExhausted
+	}
+	e := p.entries[ip]
+	p.Served[p.tier(e, t)]++
+	p.take(e)
+	return ip, nil
+}
+
+// GetCooldownIP takes the IP whose cooldown ends first
+func (p *ReputationPool) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if p.queue.Len() == 0 {
+		return 0, types.ErrPoolExhausted
+	}
+	ip := p.queue.take()
+	p.Served[p.tier(p.entries[ip], s.GetTime())]++
+	return ip, nil
+}
+
+func (p *ReputationPool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		removed.Add(ip)
+		if e, ok := p.entries[ip]; ok {
+			if e.Free {
+				p.take(e)
+			}
+			delete(p.entries, ip)
+		}
+	}
+	p.queue.filter(func(ip types.IPAddress) bool { return !removed.Contains(ip) })
+}
+
+func (p *ReputationPool) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	t := s.GetTime()
+	info := s.GetInfo(ip)
+	e := p.entries[ip]
+	e.Owner = id
+	// Only benign releases add owners, so an IP with none has never been released benignly, even if ReleasedBenign is 0 from a release at time 0
+	if owners := info.UniqueOwners(); owners > 0 {
+		if info.ReleasedBenign == t {
+			e.Hold = t - info.AllocatedAt
+		}
+		e.RiskTime = p.Score.riskTime(owners, e.Hold, info.ReleasedBenign)
+	}
+	p.queue.add(p.Cooldown.readyAt(s, id), ip)
+}
+
+type reputationPoolCheckpoint struct {
+	Entries []reputationEntry
+	Queue   cooldownQueueCheckpoint[types.IPAddress]
+}
+
+func (p *ReputationPool) Checkpoint() ([]byte, error) {
+	c := reputationPoolCheckpoint{Queue: p.queue.checkpoint()}
+	for _, e := range p.entries {
+		c.Entries = append(c.Entries, *e)
+	}
+	sort.Slice(c.Entries, func(i, j int) bool { return c.Entries[i].IP < c.Entries[j].IP })
+	return util.EncodeGob(c)
+}
+
+func (p *ReputationPool) Restore(s types.Simulator, b []byte) error {
+	var c reputationPoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	p.Init(s)
+	for _, e := range c.Entries {
+		e := e
+		p.entries[e.IP] = &e
+		if e.Free {
+			p.free(&e)
+		}
+	}
+	p.queue.restore(c.Queue)
+	return nil
+}
@@ -0,0 +1,84 @@
+package policies
+
+import (
+	"math"
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+func TestReputationRisk(t *testing.T) {
+	score := ReputationScore{Base: 0.5, OwnerWeight: 0.25, HoldWeight: 1, HalfLife: types.Hour}
+	// Risk times are whole seconds, so risks are slightly rounded
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-3 }
+
+	// 2 owners and a 30 minute hold score 0.5 + 0.5 + 0.5 at release, and decay by half each HalfLife
+	at := score.riskTime(2, 30*types.Minute, 100)
+	for _, c := range []struct {
+		t    types.Duration
+		want float64
+	}{{100, 1.5}, {100 + types.Hour, 0.75}, {100 + 3*types.Hour, 0.1875}} {
+		if r := score.risk(at, c.t); !near(r, c.want) {
+			t.Errorf("risk at %v: %v, want %v", c.t, r, c.want)
+		}
+	}
+	// An IP released an hour later with risk 1 is riskier than one that has decayed to 0.75, despite its lower initial risk
+	if later := score.riskTime(2, 0, 100+types.Hour); later <= at {
+		t.Errorf("risk time %v of an IP released an hour later with risk 1, want more than %v", later, at)
+	}
+
+	// IPs with no initial risk never carry any, and are ordered before all others
+	none := ReputationScore{HalfLife: types.Hour}.riskTime(3, types.Hour, 100)
+	if none != math.MinInt64 || score.risk(none, 100) != 0 {
+		t.Errorf("risk time %v with no initial risk, want the minimum", none)
+	}
+}
+
+func TestReputationTier(t *testing.T) {
+	p := NewReputationPool().(*ReputationPool)
+	p.Score.HalfLife = types.Hour
+	// Tiers 0.1 and 1 split risks into [0, 0.1), [0.1, 1) and [1, ∞)
+	for _, c := range []struct {
+		risk float64
+		want int
+	}{{0, 0}, {0.05, 0}, {0.1, 1}, {0.5, 1}, {1, 2}, {4, 2}} {
+		e := &reputationEntry{RiskTime: math.MinInt64}
+		if c.risk > 0 {
+			e.RiskTime = types.Duration(math.Log2(c.risk) * float64(types.Hour))
+		}
+		if tier := p.tier(e, 0); tier != c.want {
+			t.Errorf("risk %v in tier %d, want %d", c.risk, tier, c.want)
+		}
+	}
+}
+
+// An IP released benignly at time 0 carries risk like one released at any other time
+func TestReputationReleaseAtZero(t *testing.T) {
+	s := newTestSimulator()
+	p := NewReputationPool().(*ReputationPool)
+	p.Cooldown = Cooldown{}
+	p.Init(s)
+	for ip := types.IPAddress(0); ip < 2; ip++ {
+		p.Seed(s, ip)
+	}
+	ip, err := s.allocate(p, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.release(p, ip, true)
+	if tier := p.tier(p.entries[ip], 0); tier != 1 {
+		t.Errorf("IP released at time 0 in tier %d, want 1", tier)
+	}
+
+	// Other tenants get the IP no benign tenant has released, and the owner gets its own back
+	s.t = 1
+	if other, err := s.allocate(p, 2); err != nil || other == ip {
+		t.Errorf("tenant 2 got IP %d (%v), want the unused IP", other, err)
+	}
+	if own, err := s.allocate(p, 1); err != nil || own != ip {
+		t.Errorf("tenant 1 got IP %d (%v), want its own IP %d", own, err, ip)
+	}
+	if p.Served[0] != 2 || p.Served[1] != 1 || p.OwnerReuses != 1 {
+		t.Errorf("served %v with %d owner reuses, want [2 1 0] with 1", p.Served, p.OwnerReuses)
+	}
+}
@@ -0,0 +1,140 @@
+package policies
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+/*
+ReservedPolicy is middleware that sets aside the NumIPs consecutive IPs starting at FirstIP for a range of an agent's tenants, given by Agent, FirstTenant, and LastTenant like the simulator's limit overrides. Those tenants are given a random free reserved IP before asking the Inner policy, or only reserved IPs if Exclusive. Other tenants never get a reserved IP, and the inner policy never sees them.
+*/
+type ReservedPolicy struct {
+	BasePolicy
+	Middleware
+	FirstIP types.IPAddress
+	NumIPs  int
+	TenantRange
+	Exclusive bool `json:",omitempty"`
+
+	free *util.IPSet
+}
+
+func NewReservedPolicy() types.PoolPolicy {
+	return &ReservedPolicy{BasePolicy: BasePolicy{Type: "reserved"}, Middleware: newMiddleware(NewRandomPool())}
+}
+
+func (r *ReservedPolicy) UnmarshalJSON(b []byte) error {
+	type w ReservedPolicy
+	err := json.Unmarshal(b, (*w)(r))
+	if err != nil {
+		return err
+	}
+	if r.NumIPs < 0 {
+		return errors.New("reserved NumIPs can't be negative")
+	}
+	return r.TenantRange.validate()
+}
+
+func (r *ReservedPolicy) reservedIP(ip types.IPAddress) bool {
+	return ip >= r.FirstIP && uint64(ip) < uint64(r.FirstIP)+uint64(r.NumIPs)
+}
+
+func (r *ReservedPolicy) reservedTenant(s types.Simulator, id types.TenantId) bool {
+	return r.contains(s, id)
+}
+
+// MinCooldown is 0, as reserved IPs are given out again without a cooldown
+func (r *ReservedPolicy) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	return 0
+}
+
+// ReportStats reports the free reserved IPs, along with the inner policy's metrics
+func (r *ReservedPolicy) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["freeReserved"] = r.free.Len()
+	r.Middleware.ReportStats(s, stats)
+}
+
+func (r *ReservedPolicy) Init(s types.Simulator) {
+	r.free = util.NewIPSet()
+	r.Inner.Init(s)
+}
+
+func (r *ReservedPolicy) Seed(s types.Simulator, ip types.IPAddress) {
+	if r.reservedIP(ip) {
+		r.free.Add(ip)
+		return
+	}
+	r.Inner.Seed(s, ip)
+}
+
+func (r *ReservedPolicy) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if !r.reservedTenant(s, id) {
+		return r.Inner.GetIP(s, id)
+	}
+	if r.free.Len() > 0 {
+		ip := r.free.Random(s.Rand())
+		r.free.Remove(ip)
+		return ip, nil
+	}
+	if r.Exclusive {
+		return 0, types.ErrPoolExhausted
+	}
+	return r.Inner.GetIP(s, id)
+}
+
+// GetCooldownIP bypasses the inner policy's cooldown, unless the tenant is limited to reserved IPs
+func (r *ReservedPolicy) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if r.Exclusive && r.reservedTenant(s, id) {
+		return 0, types.ErrPoolExhausted
+	}
+	return r.innerCooldownIP(s, id)
+}
+
+func (r *ReservedPolicy) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	var inner []types.IPAddress
+	for _, ip := range ips {
+		if r.reservedIP(ip) {
+			r.free.Remove(ip)
+		} else {
+			inner = append(inner, ip)
+		}
+	}
+	r.removeInner(s, inner)
+}
+
+func (r *ReservedPolicy) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	if r.reservedIP(ip) {
+		r.free.Add(ip)
+		return
+	}
+	r.Inner.ReleaseIP(s, ip, id)
+}
+
+type reservedPolicyCheckpoint struct {
+	Inner []byte
+	Free  []types.IPAddress
+}
+
+func (r *ReservedPolicy) Checkpoint() ([]byte, error) {
+	inner, err := r.checkpointInner()
+	if err != nil {
+		return nil, err
+	}
+	return util.EncodeGob(reservedPolicyCheckpoint{inner, r.free.Slice()})
+}
+
+func (r *ReservedPolicy) Restore(s types.Simulator, b []byte) error {
+	var c reservedPolicyCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	r.free = util.NewIPSet()
+	for _, ip := range c.Free {
+		r.free.Add(ip)
+	}
+	return r.restoreInner(s, c.Inner)
+}
@@ -1,9 +1,13 @@
 package policies
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
+	"sort"
 
 	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
 )
 
 type segmentedPoolEntry struct {
@@ -11,6 +15,7 @@ type segmentedPoolEntry struct {
 	owner types.TenantId
 	valid bool
 	added types.Duration
+	ready types.Duration // End of the IP's cooldown
 }
 
 type segmentedPoolTenantMeta struct {
@@ -19,7 +24,18 @@ type segmentedPoolTenantMeta struct {
 	ownerPool   []*segmentedPoolEntry
 }
 
-const segmentedCooldownTime = 30 * types.Minute
+// Number of free IPs sampled when choosing an IP for a tenant with SegmentedSample
+const segmentedSampleSize = 50
+
+// Ways that SegmentedPool can choose the IP whose timer best matches a tenant
+const (
+	// The free IP whose timer is nearest the tenant's target
+	SegmentedNearest = "nearest"
+	// The free IP with the latest timer not exceeding the target, or the nearest if every timer exceeds it
+	SegmentedNearestUnder = "nearest-under"
+	// The nearest of a random sample of free IPs
+	SegmentedSample = "sample"
+)
 
 /*
 	SegmentedPool aims to heuristically separate tenants with long-running and short-running workloads.
@@ -30,31 +46,103 @@ IPs also keep track of how long they've recently been used for. Each IP has a ti
 
 The timer counts down slower than realtime, by a factor of TimerMultiplier.
 
-When allocating IP addresses, tenants will preference IPs that have a current timer value similar to that of their average IP holding time.
+Tenants are first given back their own released IPs once their Cooldown has passed; OwnerReuses counts those allocations, and OwnerMisses the requests from tenants with released IPs of their own that none of those could serve.
+
+When allocating IP addresses, tenants will preference IPs that have a current timer value similar to that of their average IP holding time. By default the nearest timer is found exactly with an ordered index of free IPs' timers; the Selection can instead look for the nearest timer that doesn't go over, or keep the original bounded sampling of 50 free IPs for comparison.
 */
 type SegmentedPool struct {
 	allIPs        map[types.IPAddress]*segmentedPoolEntry
+	freeIPs       *util.IPSet      // Keys of allIPs, for sampling
+	timerIndex    *util.TimerIndex // Keys of allIPs ordered by timer, unless sampling
 	ipTimers      map[types.IPAddress]types.Duration
 	ownerPools    map[types.TenantId]*segmentedPoolTenantMeta
-	cooldownQueue []*segmentedPoolEntry
+	cooldownQueue cooldownQueue[*segmentedPoolEntry]
 
 	TimerMultiplier float64
 	NegativeTimers  bool // Allow timers to go negative
+	Cooldown        Cooldown
+	Selection       string
+
+	OwnerReuses int
+	OwnerMisses int
 
 	BasePolicy
 }
 
 func NewSegmentedPool(TimerMultiplier float64, allowNegative bool) types.PoolPolicy {
-	p := &SegmentedPool{TimerMultiplier: TimerMultiplier, BasePolicy: BasePolicy{Type: "segmented"}, NegativeTimers: allowNegative}
+	p := &SegmentedPool{TimerMultiplier: TimerMultiplier, BasePolicy: BasePolicy{Type: "segmented"}, NegativeTimers: allowNegative, Cooldown: Cooldown{Duration: 30 * types.Minute}, Selection: SegmentedNearest}
 	if allowNegative {
 		p.BasePolicy.Type = "segmented-neg"
 	}
 	return p
 }
 
+func (t *SegmentedPool) UnmarshalJSON(b []byte) error {
+	type w SegmentedPool
+	err := json.Unmarshal(b, (*w)(t))
+	if err != nil {
+		return err
+	}
+	switch t.Selection {
+	case SegmentedNearest, SegmentedNearestUnder, SegmentedSample:
+		return nil
+	}
+	return fmt.Errorf("unknown segmented IP selection %q", t.Selection)
+}
+
+func (t *SegmentedPool) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	return t.Cooldown.minimum(s, id)
+}
+
+// ReportStats reports the IPs still in their cooldown, how many allocations reused the tenant's own IPs, the tenants with released IPs of their own, the TimerMultiplier, and the deciles of the time left on free IPs' timers
+func (t *SegmentedPool) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	now := s.GetTime()
+	backlog := 0
+	for _, e := range t.cooldownQueue.entries {
+		if e.Value.valid && e.Ready > now {
+			backlog++
+		}
+	}
+	stats["cooldownBacklog"] = backlog
+	stats["ownerReuses"] = t.OwnerReuses
+	stats["ownerMisses"] = t.OwnerMisses
+	owners := 0
+	for _, meta := range t.ownerPools {
+		for _, e := range meta.ownerPool {
+			if e.valid {
+				owners++
+				break
+			}
+		}
+	}
+	stats["owners"] = owners
+	stats["timerMultiplier"] = t.TimerMultiplier
+	if t.freeIPs.Len() == 0 {
+		return
+	}
+	timers := make([]types.Duration, t.freeIPs.Len())
+	for i := range timers {
+		timers[i] = t.GetIPTimer(s, t.freeIPs.At(i))
+		if !t.NegativeTimers {
+			timers[i] = max(timers[i], 0)
+		}
+	}
+	sort.Slice(timers, func(i, j int) bool { return timers[i] < timers[j] })
+	deciles := make([]types.Duration, 11)
+	for i := range deciles {
+		deciles[i] = timers[i*(len(timers)-1)/10]
+	}
+	stats["freeTimerDeciles"] = deciles
+}
+
 func (t *SegmentedPool) Init(s types.Simulator) {
 	t.ownerPools = map[types.TenantId]*segmentedPoolTenantMeta{}
 	t.allIPs = map[types.IPAddress]*segmentedPoolEntry{}
+	t.freeIPs = util.NewIPSet()
+	t.timerIndex = nil
+	if t.Selection != SegmentedSample {
+		t.timerIndex = util.NewTimerIndex()
+	}
 	t.ipTimers = map[types.IPAddress]types.Duration{}
 	if t.TimerMultiplier == 0 {
 		t.TimerMultiplier = 1
@@ -62,8 +150,23 @@ func (t *SegmentedPool) Init(s types.Simulator) {
 }
 
 func (t *SegmentedPool) Seed(s types.Simulator, ip types.IPAddress) {
-	entry := &segmentedPoolEntry{ip, types.NilTenant, true, math.MinInt64}
-	t.allIPs[ip] = entry
+	entry := &segmentedPoolEntry{ip, types.NilTenant, true, math.MinInt64, math.MinInt64}
+	t.addFree(entry)
+}
+
+func (t *SegmentedPool) addFree(entry *segmentedPoolEntry) {
+	t.allIPs[entry.ip] = entry
+	t.freeIPs.Add(entry.ip)
+	if t.timerIndex != nil {
+		t.timerIndex.Insert(entry.ip, t.ipTimers[entry.ip])
+	}
+}
+
+func (t *SegmentedPool) removeFree(ip types.IPAddress) {
+	delete(t.allIPs, ip)
+	if t.freeIPs.Remove(ip) && t.timerIndex != nil {
+		t.timerIndex.Remove(ip, t.ipTimers[ip])
+	}
 }
 
 func (t *SegmentedPool) getMeta(id types.TenantId) *segmentedPoolTenantMeta {
@@ -75,6 +178,11 @@ func (t *SegmentedPool) getMeta(id types.TenantId) *segmentedPoolTenantMeta {
 	return tenantMeta
 }
 
+// Segmented returns the pool itself, or the SegmentedPool embedded in a policy built on it
+func (t *SegmentedPool) Segmented() *SegmentedPool {
+	return t
+}
+
 func (t *SegmentedPool) GetIPTimer(s types.Simulator, ip types.IPAddress) types.Duration {
 	timer := types.Duration(float64(t.ipTimers[ip]-s.GetTime()) / t.TimerMultiplier)
 	return timer
@@ -85,51 +193,74 @@ func (t *SegmentedPool) GetTenantIPTimer(s types.Simulator, id types.TenantId) t
 	return types.Duration(float64(tenantMeta.billedTime) / float64(tenantMeta.allocations))
 }
 
-func (t *SegmentedPool) GetIP(s types.Simulator, tenantID types.TenantId) (ip types.IPAddress) {
+func (t *SegmentedPool) GetIP(s types.Simulator, tenantID types.TenantId) (types.IPAddress, error) {
 	now := s.GetTime()
 	// Moe timers out of the cooldown queue if they're old enough
-	for len(t.cooldownQueue) > 0 && t.cooldownQueue[0].added+(segmentedCooldownTime) <= now {
-		if t.cooldownQueue[0].valid {
-			t.allIPs[t.cooldownQueue[0].ip] = t.cooldownQueue[0]
+	for t.cooldownQueue.ready(now) {
+		entry := t.cooldownQueue.take()
+		if entry.valid {
+			t.addFree(entry)
 		}
-		t.cooldownQueue = t.cooldownQueue[1:]
 	}
 	tenantMeta := t.getMeta(tenantID)
 	tenantMeta.allocations++
+	owned := len(tenantMeta.ownerPool) > 0
 	// This tenant has IPs tagged to them, we can take one of those
 	for len(tenantMeta.ownerPool) > 0 {
 		entry := tenantMeta.ownerPool[0]
-		if entry.added+(segmentedCooldownTime) > s.GetTime() {
+		if entry.ready > s.GetTime() {
 			// IPs are all too new, take from the main pool
 			break
 		}
 		tenantMeta.ownerPool = tenantMeta.ownerPool[1:]
 		if entry.valid {
 			entry.valid = false
-			delete(t.allIPs, entry.ip)
-			return entry.ip
+			t.removeFree(entry.ip)
+			t.OwnerReuses++
+			return entry.ip, nil
 		}
 	}
-	// Take the oldest IP from someone else.
-	var bestIP *segmentedPoolEntry
+	if owned {
+		t.OwnerMisses++
+	}
 	// targetIPTimer is the time value of the IP timer which will lead to its duration being closest to tenant's billable time
 	var targetIPTimer = s.GetTime() + types.Duration(float64(tenantMeta.billedTime)/float64(tenantMeta.allocations)*t.TimerMultiplier)
-	tries := 0
-	for _, meta := range t.allIPs {
+	if t.timerIndex != nil {
+		ip, ok := t.nearestIP(now, targetIPTimer)
+		if !ok {
+			tenantMeta.allocations--
+			return 0, types.ErrPoolExhausted
+		}
+		t.allIPs[ip].valid = false
+		t.removeFree(ip)
+		// Don't let timers go negative.
+		if !t.NegativeTimers && t.ipTimers[ip] < now {
+			t.ipTimers[ip] = now
+		}
+		return ip, nil
+	}
+
+	// Take the oldest IP from someone else.
+	var bestIP *segmentedPoolEntry
+	// Consider every free IP in small pools, otherwise a random sample
+	sampleAll := t.freeIPs.Len() <= segmentedSampleSize
+	for i := 0; i < segmentedSampleSize && i < t.freeIPs.Len(); i++ {
+		var meta *segmentedPoolEntry
+		if sampleAll {
+			meta = t.allIPs[t.freeIPs.At(i)]
+		} else {
+			meta = t.allIPs[t.freeIPs.Random(s.Rand())]
+		}
 		if !meta.valid {
 			panic("Invalid meta in segmented ip pool")
 		}
-		tries++
-		if tries > 50 {
-			break
-		}
 
 		// Don't let timers go negative.
 		if !t.NegativeTimers && t.ipTimers[meta.ip] < now {
 			t.ipTimers[meta.ip] = now
 		}
 
-		// We want the IP timer to be as close as possible (TODO: without going over)
+		// We want the IP timer to be as close as possible
 		if bestIP == nil {
 			bestIP = meta
 			continue
@@ -140,12 +271,65 @@ func (t *SegmentedPool) GetIP(s types.Simulator, tenantID types.TenantId) (ip ty
 
 	}
 	if bestIP == nil {
-		panic("No IPs available")
+		tenantMeta.allocations--
+		return 0, types.ErrPoolExhausted
 	}
 
 	bestIP.valid = false
-	delete(t.allIPs, bestIP.ip)
-	return bestIP.ip
+	t.removeFree(bestIP.ip)
+	return bestIP.ip, nil
+}
+
+// nearestIP looks up the free IP whose timer best matches the target in the timer index. Timers in the past count as the current time, unless timers can go negative.
+func (t *SegmentedPool) nearestIP(now, target types.Duration) (types.IPAddress, bool) {
+	under, underTimer, hasUnder := t.timerIndex.Floor(target)
+	if hasUnder && !t.NegativeTimers && underTimer < now {
+		// Every expired timer counts as now, so take the one that expired longest ago
+		under, _, _ = t.timerIndex.Ceil(math.MinInt64)
+		underTimer = now
+	}
+	over, overTimer, hasOver := t.timerIndex.Ceil(target)
+	switch {
+	case !hasUnder:
+		return over, hasOver
+	case !hasOver || t.Selection == SegmentedNearestUnder:
+		return under, true
+	case target-underTimer <= overTimer-target:
+		return under, true
+	default:
+		return over, true
+	}
+}
+
+// GetCooldownIP takes the IP whose cooldown ends first
+func (t *SegmentedPool) GetCooldownIP(s types.Simulator, tenantID types.TenantId) (types.IPAddress, error) {
+	for t.cooldownQueue.Len() > 0 {
+		entry := t.cooldownQueue.take()
+		if entry.valid {
+			entry.valid = false
+			t.getMeta(tenantID).allocations++
+			return entry.ip, nil
+		}
+	}
+	return 0, types.ErrPoolExhausted
+}
+
+func (t *SegmentedPool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		removed.Add(ip)
+		if entry, ok := t.allIPs[ip]; ok {
+			entry.valid = false
+			t.removeFree(ip)
+		}
+		delete(t.ipTimers, ip)
+	}
+	// IPs in cooldown are shared with their owner's pool
+	for _, e := range t.cooldownQueue.entries {
+		if e.Value.valid && removed.Contains(e.Value.ip) {
+			e.Value.valid = false
+		}
+	}
 }
 
 func (t *SegmentedPool) ReleaseIP(s types.Simulator, ip types.IPAddress, tenantID types.TenantId) {
@@ -157,6 +341,7 @@ func (t *SegmentedPool) ReleaseIP(s types.Simulator, ip types.IPAddress, tenantI
 		tenantID,
 		true,
 		s.GetTime(),
+		t.Cooldown.readyAt(s, tenantID),
 	}
 	timer := s.GetTime() + types.Duration(float64(ownedDuration)*t.TimerMultiplier)
 	if timer > t.ipTimers[ip] {
@@ -164,5 +349,80 @@ func (t *SegmentedPool) ReleaseIP(s types.Simulator, ip types.IPAddress, tenantI
 	}
 	tenantMeta.billedTime += ownedDuration
 	tenantMeta.ownerPool = append(tenantMeta.ownerPool, entry)
-	t.cooldownQueue = append(t.cooldownQueue, entry)
+	t.cooldownQueue.add(entry.ready, entry)
+}
+
+type segmentedPoolTenantCheckpoint struct {
+	Allocations uint64
+	BilledTime  types.Duration
+	OwnerPool   []int
+}
+
+type segmentedPoolCheckpoint struct {
+	Entries       []poolEntryCheckpoint
+	AllIPs        map[types.IPAddress]int
+	FreeIPs       []types.IPAddress
+	IPTimers      map[types.IPAddress]types.Duration
+	Tenants       map[types.TenantId]segmentedPoolTenantCheckpoint
+	CooldownQueue cooldownQueueCheckpoint[int]
+}
+
+func (t *SegmentedPool) Checkpoint() ([]byte, error) {
+	var refs entryRefs[segmentedPoolEntry]
+	c := segmentedPoolCheckpoint{
+		AllIPs:   map[types.IPAddress]int{},
+		FreeIPs:  t.freeIPs.Slice(),
+		IPTimers: t.ipTimers,
+		Tenants:  map[types.TenantId]segmentedPoolTenantCheckpoint{},
+	}
+	c.CooldownQueue.Seq = t.cooldownQueue.seq
+	for _, e := range t.cooldownQueue.entries {
+		c.CooldownQueue.Entries = append(c.CooldownQueue.Entries, cooldownEntry[int]{e.Ready, e.Seq, refs.ref(e.Value)})
+	}
+	for ip, e := range t.allIPs {
+		c.AllIPs[ip] = refs.ref(e)
+	}
+	for id, meta := range t.ownerPools {
+		c.Tenants[id] = segmentedPoolTenantCheckpoint{meta.allocations, meta.billedTime, refs.refs(meta.ownerPool)}
+	}
+	for _, e := range refs.entries {
+		c.Entries = append(c.Entries, poolEntryCheckpoint{e.ip, e.owner, e.valid, e.added, e.ready})
+	}
+	return util.EncodeGob(c)
+}
+
+func (t *SegmentedPool) Restore(s types.Simulator, b []byte) error {
+	var c segmentedPoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	t.Init(s)
+	entries := make([]*segmentedPoolEntry, len(c.Entries))
+	for i, e := range c.Entries {
+		entries[i] = &segmentedPoolEntry{e.IP, e.Owner, e.Valid, e.Added, e.Ready}
+	}
+	for ip, i := range c.AllIPs {
+		t.allIPs[ip] = entries[i]
+	}
+	for _, ip := range c.FreeIPs {
+		t.freeIPs.Add(ip)
+	}
+	for ip, timer := range c.IPTimers {
+		t.ipTimers[ip] = timer
+	}
+	if t.timerIndex != nil {
+		for _, ip := range c.FreeIPs {
+			t.timerIndex.Insert(ip, t.ipTimers[ip])
+		}
+	}
+	for id, meta := range c.Tenants {
+		t.ownerPools[id] = &segmentedPoolTenantMeta{meta.Allocations, meta.BilledTime, derefs(entries, meta.OwnerPool)}
+	}
+	q := cooldownQueueCheckpoint[*segmentedPoolEntry]{Seq: c.CooldownQueue.Seq}
+	for _, e := range c.CooldownQueue.Entries {
+		q.Entries = append(q.Entries, cooldownEntry[*segmentedPoolEntry]{e.Ready, e.Seq, entries[e.Value]})
+	}
+	t.cooldownQueue.restore(q)
+	return nil
 }
@@ -0,0 +1,170 @@
+package policies
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+// SegmentedController holds the settings of AdaptiveSegmentedPool's feedback loop
+type SegmentedController struct {
+	ControlInterval types.Duration // How often the multiplier is adjusted
+	Gain            float64        // How strongly the multiplier responds to its error
+	TargetOver      float64        // Fraction of allocations that may get an IP whose timer outlasts the tenant's target
+	Tolerance       float64        // How far, relative to the tenant's target, an IP's timer can go over without counting
+	MinHeadroom     float64        // Fraction of the pool that should be free; the multiplier shrinks while it isn't
+	MinMultiplier   float64
+	MaxMultiplier   float64
+}
+
+/*
+AdaptiveSegmentedPool is a SegmentedPool that tunes its TimerMultiplier online instead of relying on an offline sweep.
+
+Every ControlInterval it compares the IP timers tenants were given (GetIPTimer at allocation) with their targets (GetTenantIPTimer). A large multiplier keeps IPs' timers running long after they're released, so when too many allocations (more than TargetOver) are given an IP whose timer outlasts the tenant's target, the pool can't honor its timers and the multiplier shrinks. When fewer are, there's room to keep IPs apart for longer and it grows. It also shrinks while less than MinHeadroom of the pool is free. Updates are multiplicative, by exp(Gain * error), and clamped to [MinMultiplier, MaxMultiplier].
+
+The multiplier is reported with the SegmentedPool's other metrics, as timerMultiplier.
+*/
+type AdaptiveSegmentedPool struct {
+	SegmentedPool
+	SegmentedController
+
+	size        int            // IPs seeded into the pool and not removed
+	nextControl types.Duration // Time of the next adjustment
+	allocations int            // Allocations since the last adjustment
+	over        int            // Allocations since the last adjustment given an IP whose timer outlasted the target
+}
+
+func NewAdaptiveSegmentedPool() types.PoolPolicy {
+	p := &AdaptiveSegmentedPool{
+		SegmentedPool: *NewSegmentedPool(1, false).(*SegmentedPool),
+		SegmentedController: SegmentedController{
+			ControlInterval: 1 * types.Hour,
+			Gain:            0.5,
+			TargetOver:      0.1,
+			Tolerance:       0.5,
+			MinHeadroom:     0.05,
+			MinMultiplier:   0.05,
+			MaxMultiplier:   5,
+		},
+	}
+	p.BasePolicy.Type = "segmented-adaptive"
+	return p
+}
+
+// UnmarshalJSON unmarshals the controller settings alongside the SegmentedPool's own, which would otherwise be the only ones unmarshalled
+func (t *AdaptiveSegmentedPool) UnmarshalJSON(b []byte) error {
+	err := t.SegmentedPool.UnmarshalJSON(b)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, &t.SegmentedController)
+	if err != nil {
+		return err
+	}
+	if t.ControlInterval <= 0 {
+		return errors.New("segmented-adaptive ControlInterval must be positive")
+	}
+	if t.MinMultiplier <= 0 || t.MaxMultiplier < t.MinMultiplier {
+		return errors.New("segmented-adaptive multipliers must satisfy 0 < MinMultiplier <= MaxMultiplier")
+	}
+	return nil
+}
+
+func (t *AdaptiveSegmentedPool) Init(s types.Simulator) {
+	t.SegmentedPool.Init(s)
+	t.size = 0
+	t.nextControl = s.GetTime() + t.ControlInterval
+	t.allocations, t.over = 0, 0
+}
+
+func (t *AdaptiveSegmentedPool) Seed(s types.Simulator, ip types.IPAddress) {
+	t.size++
+	t.SegmentedPool.Seed(s, ip)
+}
+
+func (t *AdaptiveSegmentedPool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	t.size -= len(ips)
+	t.SegmentedPool.RemoveIPs(s, ips)
+}
+
+// control adjusts the multiplier for every control interval that has ended
+func (t *AdaptiveSegmentedPool) control(s types.Simulator) {
+	for s.GetTime() >= t.nextControl {
+		var err float64
+		if t.allocations > 0 {
+			err = t.TargetOver - float64(t.over)/float64(t.allocations)
+		}
+		if t.size > 0 && float64(t.freeIPs.Len()) < t.MinHeadroom*float64(t.size) {
+			err = min(err, -t.TargetOver)
+		}
+		t.TimerMultiplier = min(max(t.TimerMultiplier*math.Exp(t.Gain*err), t.MinMultiplier), t.MaxMultiplier)
+		t.allocations, t.over = 0, 0
+		t.nextControl += t.ControlInterval
+	}
+}
+
+// observe records how well an allocated IP's timer matched the tenant's target
+func (t *AdaptiveSegmentedPool) observe(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	target := t.GetTenantIPTimer(s, id)
+	t.allocations++
+	if float64(t.GetIPTimer(s, ip)) > float64(target)*(1+t.Tolerance) {
+		t.over++
+	}
+}
+
+func (t *AdaptiveSegmentedPool) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	t.control(s)
+	ip, err := t.SegmentedPool.GetIP(s, id)
+	if err == nil {
+		t.observe(s, ip, id)
+	}
+	return ip, err
+}
+
+func (t *AdaptiveSegmentedPool) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	t.control(s)
+	ip, err := t.SegmentedPool.GetCooldownIP(s, id)
+	if err == nil {
+		t.observe(s, ip, id)
+	}
+	return ip, err
+}
+
+func (t *AdaptiveSegmentedPool) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	t.control(s)
+	t.SegmentedPool.ReleaseIP(s, ip, id)
+}
+
+type adaptiveSegmentedPoolCheckpoint struct {
+	Segmented   []byte
+	Size        int
+	NextControl types.Duration
+	Allocations int
+	Over        int
+}
+
+func (t *AdaptiveSegmentedPool) Checkpoint() ([]byte, error) {
+	segmented, err := t.SegmentedPool.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	return util.EncodeGob(adaptiveSegmentedPoolCheckpoint{segmented, t.size, t.nextControl, t.allocations, t.over})
+}
+
+// Restore resumes the pool from a checkpoint. The multiplier itself is restored from the simulator's config.
+func (t *AdaptiveSegmentedPool) Restore(s types.Simulator, b []byte) error {
+	var c adaptiveSegmentedPoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	err = t.SegmentedPool.Restore(s, c.Segmented)
+	if err != nil {
+		return err
+	}
+	t.size, t.nextControl, t.allocations, t.over = c.Size, c.NextControl, c.Allocations, c.Over
+	return nil
+}
@@ -0,0 +1,239 @@
+package policies
+
+import (
+	"sort"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+// subnetHold counts the IPs a tenant holds in a subnet
+type subnetHold struct {
+	Subnet types.Subnet
+	Count  int
+}
+
+type subnetTenant struct {
+	held    []subnetHold // Subnets the tenant holds IPs in, in the order it first used them
+	last    types.Subnet // The subnet of the tenant's most recent release, once it holds no IPs
+	hasLast bool
+}
+
+/*
+SubnetAffinityPool keeps each tenant's IPs clustered in as few subnets as possible, like a provider that hands out addresses from a tenant's existing ranges so that allow-lists and reputation work at /24 granularity.
+
+A tenant is given a random free IP from a subnet it already holds IPs in (in the order it first used them), or else from the subnet it last released an IP in. Tenants without a usable subnet get a uniformly random free IP. Released IPs go through a Cooldown, 30 minutes by default.
+*/
+type SubnetAffinityPool struct {
+	BasePolicy
+
+	all     *util.IPSet
+	subnets map[types.Subnet]*util.IPSet // Free IPs of each subnet
+	queue   cooldownQueue[types.IPAddress]
+	tenants map[types.TenantId]*subnetTenant
+
+	Cooldown     Cooldown
+	AffinityHits int
+}
+
+func NewSubnetAffinityPool() types.PoolPolicy {
+	return &SubnetAffinityPool{BasePolicy: BasePolicy{Type: "subnet-affinity"}, Cooldown: Cooldown{Duration: 30 * types.Minute}}
+}
+
+// ReportStats reports the IPs still in their cooldown, and the allocations served from a tenant's own subnets
+func (p *SubnetAffinityPool) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["cooldownBacklog"] = p.queue.pending(s.GetTime())
+	stats["affinityHits"] = p.AffinityHits
+}
+
+func (p *SubnetAffinityPool) MinCooldown(s types.Simulator, id types.TenantId) types.Duration {
+	return p.Cooldown.minimum(s, id)
+}
+
+func (p *SubnetAffinityPool) Init(s types.Simulator) {
+	p.all = util.NewIPSet()
+	p.subnets = make(map[types.Subnet]*util.IPSet)
+	p.tenants = make(map[types.TenantId]*subnetTenant)
+}
+
+func (p *SubnetAffinityPool) Seed(s types.Simulator, ip types.IPAddress) {
+	p.add(s, ip)
+}
+
+func (p *SubnetAffinityPool) add(s types.Simulator, ip types.IPAddress) {
+	subnet := s.GetInfo(ip).Subnet
+	free, ok := p.subnets[subnet]
+	if !ok {
+		free = util.NewIPSet()
+		p.subnets[subnet] = free
+	}
+	free.Add(ip)
+	p.all.Add(ip)
+}
+
+func (p *SubnetAffinityPool) remove(s types.Simulator, ip types.IPAddress) {
+	if !p.all.Remove(ip) {
+		return
+	}
+	subnet := s.GetInfo(ip).Subnet
+	free := p.subnets[subnet]
+	free.Remove(ip)
+	if free.Len() == 0 {
+		delete(p.subnets, subnet)
+	}
+}
+
+func (p *SubnetAffinityPool) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	t := s.GetTime()
+	for p.queue.ready(t) {
+		p.add(s, p.queue.take())
+	}
+	if p.all.Len() == 0 {
+		return 0, types.ErrPoolExhausted
+	}
+
+	ip, ok := p.affineIP(s, id)
+	if ok {
+		p.AffinityHits++
+	} else {
+		ip = p.all.Random(s.Rand())
+	}
+	p.remove(s, ip)
+	p.hold(s.GetInfo(ip).Subnet, id)
+	return ip, nil
+}
+
+// affineIP picks a free IP from one of the tenant's subnets
+func (p *SubnetAffinityPool) affineIP(s types.Simulator, id types.TenantId) (types.IPAddress, bool) {
+	tenant, ok := p.tenants[id]
+	if !ok {
+		return 0, false
+	}
+	for _, h := range tenant.held {
+		if free, ok := p.subnets[h.Subnet]; ok {
+			return free.Random(s.Rand()), true
+		}
+	}
+	if tenant.hasLast {
+		if free, ok := p.subnets[tenant.last]; ok {
+			return free.Random(s.Rand()), true
+		}
+	}
+	return 0, false
+}
+
+func (p *SubnetAffinityPool) hold(subnet types.Subnet, id types.TenantId) {
+	tenant, ok := p.tenants[id]
+	if !ok {
+		tenant = &subnetTenant{}
+		p.tenants[id] = tenant
+	}
+	for i := range tenant.held {
+		if tenant.held[i].Subnet == subnet {
+			tenant.held[i].Count++
+			return
+		}
+	}
+	tenant.held = append(tenant.held, subnetHold{subnet, 1})
+}
+
+func (p *SubnetAffinityPool) unhold(subnet types.Subnet, id types.TenantId) {
+	tenant, ok := p.tenants[id]
+	if !ok {
+		return
+	}
+	for i := range tenant.held {
+		if tenant.held[i].Subnet != subnet {
+			continue
+		}
+		tenant.held[i].Count--
+		if tenant.held[i].Count == 0 {
+			tenant.held = append(tenant.held[:i], tenant.held[i+1:]...)
+		}
+		break
+	}
+	if len(tenant.held) == 0 {
+		tenant.last = subnet
+		tenant.hasLast = true
+	}
+}
+
+// GetCooldownIP takes the IP whose cooldown ends first
+func (p *SubnetAffinityPool) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	if p.queue.Len() == 0 {
+		return 0, types.ErrPoolExhausted
+	}
+	ip := p.queue.take()
+	p.hold(s.GetInfo(ip).Subnet, id)
+	return ip, nil
+}
+
+func (p *SubnetAffinityPool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		p.remove(s, ip)
+		removed.Add(ip)
+	}
+	p.queue.filter(func(ip types.IPAddress) bool { return !removed.Contains(ip) })
+}
+
+func (p *SubnetAffinityPool) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	p.unhold(s.GetInfo(ip).Subnet, id)
+	p.queue.add(p.Cooldown.readyAt(s, id), ip)
+}
+
+type subnetFreeCheckpoint struct {
+	Subnet types.Subnet
+	IPs    []types.IPAddress
+}
+
+type subnetTenantCheckpoint struct {
+	ID      types.TenantId
+	Held    []subnetHold
+	Last    types.Subnet
+	HasLast bool
+}
+
+type subnetAffinityPoolCheckpoint struct {
+	All     []types.IPAddress
+	Subnets []subnetFreeCheckpoint
+	Queue   cooldownQueueCheckpoint[types.IPAddress]
+	Tenants []subnetTenantCheckpoint
+}
+
+func (p *SubnetAffinityPool) Checkpoint() ([]byte, error) {
+	c := subnetAffinityPoolCheckpoint{All: p.all.Slice(), Queue: p.queue.checkpoint()}
+	for subnet, free := range p.subnets {
+		c.Subnets = append(c.Subnets, subnetFreeCheckpoint{subnet, free.Slice()})
+	}
+	sort.Slice(c.Subnets, func(i, j int) bool { return c.Subnets[i].Subnet < c.Subnets[j].Subnet })
+	for id, tenant := range p.tenants {
+		c.Tenants = append(c.Tenants, subnetTenantCheckpoint{id, tenant.held, tenant.last, tenant.hasLast})
+	}
+	sort.Slice(c.Tenants, func(i, j int) bool { return c.Tenants[i].ID < c.Tenants[j].ID })
+	return util.EncodeGob(c)
+}
+
+func (p *SubnetAffinityPool) Restore(s types.Simulator, b []byte) error {
+	var c subnetAffinityPoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	p.Init(s)
+	for _, ip := range c.All {
+		p.all.Add(ip)
+	}
+	for _, sc := range c.Subnets {
+		free := util.NewIPSet()
+		for _, ip := range sc.IPs {
+			free.Add(ip)
+		}
+		p.subnets[sc.Subnet] = free
+	}
+	p.queue.restore(c.Queue)
+	for _, tc := range c.Tenants {
+		p.tenants[tc.ID] = &subnetTenant{tc.Held, tc.Last, tc.HasLast}
+	}
+	return nil
+}
@@ -1,23 +1,47 @@
 package policies
 
-import "github.com/MadSP-McDaniel/eipsim/types"
+import (
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
 
 type taggedPoolEntry struct {
 	ip    types.IPAddress
 	owner types.TenantId
 	valid bool
 	added types.Duration
+	ready types.Duration // End of the IP's cooldown, after which its previous owner can take it back
 }
 
-// TaggedPool uses an arraylist to track a FIFO queue of IP ownership. It additionally holds FIFO queues for each tenant in slices. Tenant IPs are initially drawn from their slices, then from the pool at large.
+// TaggedPool uses an arraylist to track a FIFO queue of IP ownership. It additionally holds FIFO queues for each tenant in slices. Tenant IPs are initially drawn from their slices once their Cooldown has passed (30 minutes by default), then from the pool at large. OwnerReuses counts the allocations served from a tenant's own slice, and OwnerMisses the requests from tenants with IPs tagged to them that none of those could serve.
 type TaggedPool struct {
 	allIPs     []*taggedPoolEntry
 	ownerPools map[types.TenantId][]*taggedPoolEntry
 	BasePolicy
+	Cooldown Cooldown
+
+	OwnerReuses int
+	OwnerMisses int
 }
 
 func NewTaggedPool() types.PoolPolicy {
-	return &TaggedPool{BasePolicy: BasePolicy{Type: "tagged"}}
+	return &TaggedPool{BasePolicy: BasePolicy{Type: "tagged"}, Cooldown: Cooldown{Duration: 30 * types.Minute}}
+}
+
+// ReportStats reports how many allocations reused the tenant's own IPs, and the tenants with IPs tagged to them
+func (t *TaggedPool) ReportStats(s types.Simulator, stats map[string]interface{}) {
+	stats["ownerReuses"] = t.OwnerReuses
+	stats["ownerMisses"] = t.OwnerMisses
+	owners := 0
+	for _, pool := range t.ownerPools {
+		for _, e := range pool {
+			if e.valid {
+				owners++
+				break
+			}
+		}
+	}
+	stats["owners"] = owners
 }
 
 func (t *TaggedPool) Init(s types.Simulator) {
@@ -25,38 +49,92 @@ func (t *TaggedPool) Init(s types.Simulator) {
 }
 
 func (t *TaggedPool) Seed(s types.Simulator, ip types.IPAddress) {
-	entry := &taggedPoolEntry{ip, types.NilTenant, true, s.GetTime()}
+	entry := &taggedPoolEntry{ip, types.NilTenant, true, s.GetTime(), s.GetTime()}
 	t.allIPs = append(t.allIPs, entry)
 }
 
-func (t *TaggedPool) GetIP(s types.Simulator, tenantID types.TenantId) (ip types.IPAddress) {
+func (t *TaggedPool) GetIP(s types.Simulator, tenantID types.TenantId) (types.IPAddress, error) {
+	owned := len(t.ownerPools[tenantID]) > 0
 	// This tenant has IPs tagged to them, we can take one of those
 	for len(t.ownerPools[tenantID]) > 0 {
 		entry := t.ownerPools[tenantID][0]
-		if entry.added+(30*types.Minute) > s.GetTime() {
+		if entry.ready > s.GetTime() {
 			// IPs are all too new, take from the main pool
 			break
 		}
 		t.ownerPools[tenantID] = t.ownerPools[tenantID][1:]
 		if entry.valid {
 			entry.valid = false
-			return entry.ip
+			t.OwnerReuses++
+			return entry.ip, nil
 		}
 	}
+	if owned {
+		t.OwnerMisses++
+	}
 	// Take the oldest IP from someone else.
 	for len(t.allIPs) > 0 {
 		entry := t.allIPs[0]
 		t.allIPs = t.allIPs[1:]
 		if entry.valid {
 			entry.valid = false
-			return entry.ip
+			return entry.ip, nil
+		}
+	}
+	return 0, types.ErrPoolExhausted
+}
+
+func (t *TaggedPool) RemoveIPs(s types.Simulator, ips []types.IPAddress) {
+	removed := util.NewIPSet()
+	for _, ip := range ips {
+		removed.Add(ip)
+	}
+	// Every valid entry is in allIPs, and shared with any owner pool holding it
+	for _, entry := range t.allIPs {
+		if entry.valid && removed.Contains(entry.ip) {
+			entry.valid = false
 		}
 	}
-	panic("No IPs available")
 }
 
 func (t *TaggedPool) ReleaseIP(s types.Simulator, ip types.IPAddress, tenantID types.TenantId) {
-	entry := &taggedPoolEntry{ip, tenantID, true, s.GetTime()}
+	entry := &taggedPoolEntry{ip, tenantID, true, s.GetTime(), t.Cooldown.readyAt(s, tenantID)}
 	t.ownerPools[tenantID] = append(t.ownerPools[tenantID], entry)
 	t.allIPs = append(t.allIPs, entry)
 }
+
+type taggedPoolCheckpoint struct {
+	Entries    []poolEntryCheckpoint
+	AllIPs     []int
+	OwnerPools map[types.TenantId][]int
+}
+
+func (t *TaggedPool) Checkpoint() ([]byte, error) {
+	var refs entryRefs[taggedPoolEntry]
+	c := taggedPoolCheckpoint{AllIPs: refs.refs(t.allIPs), OwnerPools: map[types.TenantId][]int{}}
+	for id, pool := range t.ownerPools {
+		c.OwnerPools[id] = refs.refs(pool)
+	}
+	for _, e := range refs.entries {
+		c.Entries = append(c.Entries, poolEntryCheckpoint{e.ip, e.owner, e.valid, e.added, e.ready})
+	}
+	return util.EncodeGob(c)
+}
+
+func (t *TaggedPool) Restore(s types.Simulator, b []byte) error {
+	var c taggedPoolCheckpoint
+	err := util.DecodeGob(b, &c)
+	if err != nil {
+		return err
+	}
+	entries := make([]*taggedPoolEntry, len(c.Entries))
+	for i, e := range c.Entries {
+		entries[i] = &taggedPoolEntry{e.IP, e.Owner, e.Valid, e.Added, e.Ready}
+	}
+	t.allIPs = derefs(entries, c.AllIPs)
+	t.ownerPools = map[types.TenantId][]*taggedPoolEntry{}
+	for id, pool := range c.OwnerPools {
+		t.ownerPools[id] = derefs(entries, pool)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+/*
+Package policytest checks that a types.PoolPolicy upholds the simulator's contract, so that policies fail with a clear message rather than a panic deep inside a simulation.
+
+A policy's tests call Run with a factory for the policy:
+
+	func TestMyPolicy(t *testing.T) {
+		policytest.Run(t, func() types.PoolPolicy { return NewMyPolicy() })
+	}
+*/
+package policytest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+// Number of tenants allocating and releasing IPs
+const numTenants = 10
+
+// The harness allocates and releases IPs at random for two days, then releases every IP (again after half a day, once queued requests have been served) and leaves the pool idle. For the last two hours, a single tenant takes every IP it can.
+const (
+	drainAt = 2 * types.Day
+	endAt   = 3 * types.Day
+)
+
+type harnessCase struct {
+	name       string
+	ips        int
+	exhaustion string
+	timeDelta  types.Duration
+}
+
+var cases = []harnessCase{
+	{"single-ip", 1, simulator.ExhaustionReject, 1},
+	{"small-pool", 10, simulator.ExhaustionReject, 1},
+	{"large-pool", 200, simulator.ExhaustionReject, 1},
+	{"queue", 50, simulator.ExhaustionQueue, 1},
+	{"bypass-cooldown", 50, simulator.ExhaustionBypassCooldown, 1},
+	{"time-delta", 50, simulator.ExhaustionReject, 5},
+}
+
+/*
+Run drives policies made by factory through randomized sequences of allocations and releases by tenants with a range of hold times, benign and not, under each exhaustion behavior, with pools from a single IP to more than policies typically sample, and with a TimeDelta above 1. Each case uses a new policy from factory.
+
+It checks that:
+  - every IP the policy gives out is free, and was seeded into it
+  - if the policy implements types.CooldownDeclarer, GetIP never gives an IP to another tenant before the declared cooldown of its release has passed
+  - GetIP and GetCooldownIP only fail with types.ErrPoolExhausted
+  - after every IP has been released and the pool left idle, a single tenant can be given the whole pool within two hours (so that policies which only act on ended timers when they're next called can catch up)
+*/
+func Run(t *testing.T, factory func() types.PoolPolicy) {
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			c.run(t, factory())
+		})
+	}
+}
+
+func (c harnessCase) run(t *testing.T, policy types.PoolPolicy) {
+	checked := newChecker(t, policy)
+	s := simulator.NewSimulator(c.ips, checked, c.timeDelta)
+	s.Seed = 1
+	s.MaxTime = endAt
+	s.Exhaustion = c.exhaustion
+	s.AddAgent(&agent{t: t})
+	s.ProcessAll()
+	if s.Failures == 0 {
+		t.Errorf("the pool was never exhausted in %d allocations", s.GetAllocated())
+	}
+}
+
+// release is the most recent release of a free IP
+type release struct {
+	tenant types.TenantId // NilTenant for seeded IPs
+	at     types.Duration
+	ready  types.Duration // End of the declared cooldown
+}
+
+// checker wraps a policy, checking every IP it gives out
+type checker struct {
+	t      *testing.T
+	policy types.PoolPolicy
+	free   map[types.IPAddress]release
+	held   map[types.IPAddress]types.TenantId
+}
+
+func newChecker(t *testing.T, policy types.PoolPolicy) *checker {
+	return &checker{t: t, policy: policy}
+}
+
+func (c *checker) GetType() string {
+	return c.policy.GetType()
+}
+
+func (c *checker) Init(s types.Simulator) {
+	c.free = make(map[types.IPAddress]release)
+	c.held = make(map[types.IPAddress]types.TenantId)
+	c.policy.Init(s)
+}
+
+func (c *checker) Seed(s types.Simulator, ip types.IPAddress) {
+	c.free[ip] = release{tenant: types.NilTenant}
+	c.policy.Seed(s, ip)
+}
+
+func (c *checker) GetIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	ip, err := c.policy.GetIP(s, id)
+	c.check(s, "GetIP", id, ip, err)
+	return ip, err
+}
+
+func (c *checker) GetCooldownIP(s types.Simulator, id types.TenantId) (types.IPAddress, error) {
+	b, ok := c.policy.(types.CooldownBypasser)
+	if !ok {
+		return 0, types.ErrPoolExhausted
+	}
+	ip, err := b.GetCooldownIP(s, id)
+	c.check(s, "GetCooldownIP", id, ip, err)
+	return ip, err
+}
+
+// check fails the test if the policy gave out an IP it shouldn't have, and otherwise records the IP as held
+func (c *checker) check(s types.Simulator, method string, id types.TenantId, ip types.IPAddress, err error) {
+	t := s.GetTime()
+	if err != nil {
+		if !errors.Is(err, types.ErrPoolExhausted) {
+			c.t.Fatalf("%s failed for tenant %d at %v with %v, rather than types.ErrPoolExhausted", method, id, t, err)
+		}
+		return
+	}
+	if owner, ok := c.held[ip]; ok {
+		c.t.Fatalf("%s gave tenant %d IP %d at %v, which tenant %d already holds", method, id, ip, t, owner)
+	}
+	r, ok := c.free[ip]
+	if !ok {
+		c.t.Fatalf("%s gave tenant %d IP %d at %v, which was never seeded", method, id, ip, t)
+	}
+	if method == "GetIP" && r.tenant != types.NilTenant && r.tenant != id && t < r.ready {
+		c.t.Fatalf("GetIP gave tenant %d IP %d at %v, released by tenant %d at %v, before its declared cooldown ended at %v", id, ip, t, r.tenant, r.at, r.ready)
+	}
+	delete(c.free, ip)
+	c.held[ip] = id
+}
+
+func (c *checker) ReleaseIP(s types.Simulator, ip types.IPAddress, id types.TenantId) {
+	t := s.GetTime()
+	r := release{tenant: id, at: t, ready: t}
+	if d, ok := c.policy.(types.CooldownDeclarer); ok {
+		r.ready += d.MinCooldown(s, id)
+	}
+	delete(c.held, ip)
+	c.free[ip] = r
+	c.policy.ReleaseIP(s, ip, id)
+}
+
+// agent allocates and releases IPs at random. Tenants are numbered from 0, and the first half tend to allocate more than they release, so that the pool is exhausted.
+type agent struct {
+	t       *testing.T
+	minID   types.TenantId
+	ips     [numTenants][]types.IPAddress
+	pending [numTenants]int // Queued requests. Tenants make one at a time until the pool is left idle.
+	next    types.Duration
+	done    bool
+	want    int // Free IPs once the pool was left idle
+}
+
+func (a *agent) GetType() string {
+	return "policytest"
+}
+
+func (a *agent) Init(s types.Simulator, minID types.TenantId, maxID types.TenantId) {
+	a.minID = minID
+	a.next = s.GetTime()
+}
+
+func (a *agent) NextWakeup(s types.Simulator) types.Duration {
+	if a.done {
+		return types.Never
+	}
+	return a.next
+}
+
+// tick rounds t up to the simulator's next time step
+func tick(s types.Simulator, t types.Duration) types.Duration {
+	d := s.GetTimeDelta()
+	return (t + d - 1) / d * d
+}
+
+func (a *agent) Process(s types.Simulator) {
+	t := s.GetTime()
+	switch {
+	case t < drainAt:
+		for i := s.Rand().Intn(5); i >= 0; i-- {
+			a.act(s, s.Rand().Intn(numTenants))
+		}
+		a.next = tick(s, t+1+types.Duration(s.Rand().Intn(600)))
+	case t < endAt-12*types.Hour:
+		for i := range a.ips {
+			a.releaseAll(s, i)
+		}
+		a.next = endAt - 12*types.Hour
+	case t < endAt-2*types.Hour:
+		for i := range a.ips {
+			a.releaseAll(s, i)
+		}
+		a.want = int(s.AvailableIPs())
+		a.next = endAt - 2*types.Hour
+	default:
+		a.takeAll(s)
+		a.next = tick(s, t+10*types.Minute)
+		if a.next >= endAt {
+			if len(a.ips[0]) != a.want {
+				a.t.Errorf("after the pool was left idle, a tenant was only given %d of its %d IPs", len(a.ips[0]), a.want)
+			}
+			a.done = true
+		}
+	}
+}
+
+// act has a tenant either allocate or release an IP
+func (a *agent) act(s types.Simulator, tenant int) {
+	id := a.minID + types.TenantId(tenant)
+	held := a.ips[tenant]
+	releaseProbability := float64(tenant+1) / (numTenants + 1)
+	if len(held) == 0 || s.Rand().Float64() >= releaseProbability {
+		if a.pending[tenant] > 0 {
+			return
+		}
+		ip, err := s.GetIP(id)
+		if err == nil {
+			a.ips[tenant] = append(held, ip)
+		} else if errors.Is(err, types.ErrRequestQueued) {
+			a.pending[tenant]++
+		} else if !errors.Is(err, types.ErrPoolExhausted) {
+			a.t.Errorf("GetIP failed with %v, rather than types.ErrPoolExhausted", err)
+		}
+		return
+	}
+	i := s.Rand().Intn(len(held))
+	ip := held[i]
+	a.ips[tenant] = append(held[:i], held[i+1:]...)
+	benign := s.Rand().Float64() < 0.8
+	if err := s.ReleaseIP(ip, id, benign); err != nil {
+		a.t.Fatalf("ReleaseIP failed with %v", err)
+	}
+}
+
+func (a *agent) releaseAll(s types.Simulator, tenant int) {
+	for _, ip := range a.ips[tenant] {
+		if err := s.ReleaseIP(ip, a.minID+types.TenantId(tenant), true); err != nil {
+			a.t.Fatalf("ReleaseIP failed with %v", err)
+		}
+	}
+	a.ips[tenant] = nil
+}
+
+// ReceiveIP serves a queued request. Once the pool is draining, the IP is released again straight away, unless it's for the tenant taking every IP at the end.
+func (a *agent) ReceiveIP(s types.Simulator, id types.TenantId, ip types.IPAddress) {
+	tenant := int(id - a.minID)
+	a.pending[tenant]--
+	a.ips[tenant] = append(a.ips[tenant], ip)
+	if t := s.GetTime(); t >= drainAt && (t < endAt-2*types.Hour || tenant != 0) {
+		a.releaseAll(s, tenant)
+	}
+}
+
+// takeAll has the first tenant take every IP the policy will give it
+func (a *agent) takeAll(s types.Simulator) {
+	for len(a.ips[0])+a.pending[0] < a.want {
+		ip, err := s.GetIP(a.minID)
+		if errors.Is(err, types.ErrRequestQueued) {
+			a.pending[0]++
+			continue
+		}
+		if err != nil {
+			return
+		}
+		a.ips[0] = append(a.ips[0], ip)
+	}
+}
@@ -0,0 +1,25 @@
+package policytest_test
+
+import (
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/policies"
+	"github.com/MadSP-McDaniel/eipsim/policytest"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+// Every built-in policy, with its default configuration, should pass the conformance tests
+func TestRegistered(t *testing.T) {
+	for _, name := range policies.Registered() {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			policytest.Run(t, func() types.PoolPolicy {
+				p, err := policies.New(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return p
+			})
+		})
+	}
+}
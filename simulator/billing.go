@@ -0,0 +1,99 @@
+package simulator
+
+import (
+	"sort"
+
+	"github.com/MadSP-McDaniel/eipsim/billing"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+// agentBill returns the bill of the agent a tenant belongs to, or nil if it isn't one of the simulator's agents
+func (s *Simulator) agentBill(tenantID types.TenantId) *billing.Bill {
+	agent := s.agentOf(tenantID)
+	if agent < 0 {
+		return nil
+	}
+	for len(s.bills) <= agent {
+		s.bills = append(s.bills, billing.Bill{})
+	}
+	return &s.bills[agent]
+}
+
+// chargeAllocation bills a tenant's agent for an allocation, and for the tenant's account if this is its first allocation
+func (s *Simulator) chargeAllocation(tenantID types.TenantId) {
+	b := s.agentBill(tenantID)
+	if b == nil {
+		return
+	}
+	if _, ok := s.accounts[tenantID]; !ok {
+		s.accounts[tenantID] = struct{}{}
+		b.Accounts += s.Billing.AccountCost()
+	}
+	b.Allocations += s.Billing.AllocationCost()
+}
+
+// holdCost prices a tenant's hold of an IP, asking its agent how long the IP was idle
+func (s *Simulator) holdCost(ip types.IPAddress, tenantID types.TenantId, held types.Duration) float64 {
+	var idle types.Duration
+	if t, ok := s.Agents[s.agentOf(tenantID)].Agent.(types.IdleTracker); ok {
+		idle = t.IdleTime(ip, tenantID, held)
+	}
+	return s.Billing.HoldCost(held, idle)
+}
+
+func (s *Simulator) chargeHold(ip types.IPAddress, tenantID types.TenantId, held types.Duration) {
+	b := s.agentBill(tenantID)
+	if b == nil {
+		return
+	}
+	b.Holding += s.holdCost(ip, tenantID, held)
+}
+
+// currentBills returns the bill of each agent, including the IPs its tenants hold up to the current time
+func (s *Simulator) currentBills() []billing.Bill {
+	bills := make([]billing.Bill, len(s.Agents))
+	copy(bills, s.bills)
+	var held []*types.IPInfo
+	for _, info := range s.ipMeta {
+		if info.Owner != types.NilTenant && s.agentOf(info.Owner) >= 0 {
+			held = append(held, info)
+		}
+	}
+	// Sum in a fixed order, so that the totals don't depend on map iteration
+	sort.Slice(held, func(i, j int) bool { return held[i].Address < held[j].Address })
+	for _, info := range held {
+		bills[s.agentOf(info.Owner)].Holding += s.holdCost(info.Address, info.Owner, s.t-info.AllocatedAt)
+	}
+	return bills
+}
+
+func (s *Simulator) GetBill(tenantID types.TenantId) (float64, bool) {
+	agent := s.agentOf(tenantID)
+	if s.Billing == nil || agent < 0 {
+		return 0, false
+	}
+	return s.currentBills()[agent].Total(), true
+}
+
+func (s *Simulator) collectBillingOverallStats() {
+	var bills []map[string]interface{}
+	for i, b := range s.currentBills() {
+		bills = append(bills, map[string]interface{}{
+			"agent":       s.Agents[i].Type,
+			"holding":     b.Holding,
+			"allocations": b.Allocations,
+			"accounts":    b.Accounts,
+			"total":       b.Total(),
+		})
+	}
+	s.OverallStats["bills"] = bills
+}
+
+func (s *Simulator) checkpointAccounts() []types.TenantId {
+	var accounts []types.TenantId
+	for id := range s.accounts {
+		accounts = append(accounts, id)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i] < accounts[j] })
+	return accounts
+}
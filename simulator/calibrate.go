@@ -0,0 +1,99 @@
+package simulator
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/MadSP-McDaniel/eipsim/policies"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+// DefaultCalibrationCooldown matches the cooldown of the built-in policies, so that calibrated pools leave room for IPs that can't yet be reallocated.
+const DefaultCalibrationCooldown = 30 * types.Minute
+
+// Calibration records the peak IP demand of a scenario, used to size pools for a target allocation ratio.
+type Calibration struct {
+	// Max number of IPs simultaneously allocated or in cooldown
+	PeakDemand int
+	// Max number of IPs simultaneously allocated
+	MaxUsedIPs int
+	Cooldown   types.Duration
+}
+
+// PoolSize returns the pool size at which peak demand is allocRatio percent of the pool.
+func (c *Calibration) PoolSize(allocRatio int) int {
+	return c.PeakDemand * 100 / allocRatio
+}
+
+/*
+Calibrate runs a copy of the scenario against an unbounded pool to measure its peak demand, counting IPs that are still in cooldown.
+
+The scenario's pool size and policy are ignored, and the scenario itself is not modified. IPs are created only when no IP has been free for longer than the cooldown, so the number of IPs created is exactly the pool size needed to serve every request without violating cooldown.
+*/
+func Calibrate(scenario *Simulator) (*Calibration, error) {
+	return CalibrateWithCooldown(scenario, DefaultCalibrationCooldown)
+}
+
+// CalibrateWithCooldown is Calibrate with a non-default cooldown.
+func CalibrateWithCooldown(scenario *Simulator, cooldown types.Duration) (*Calibration, error) {
+	if len(scenario.Regions) > 0 {
+		return nil, errors.New("scenarios with regions can't be calibrated")
+	}
+	b, err := json.Marshal(scenario)
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulator{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, err
+	}
+	pool := &calibrationPool{Cooldown: cooldown, BasePolicy: policies.BasePolicy{Type: "calibration"}}
+	s.Policy = policies.PoolPolicyWrapper{Type: pool.GetType(), PoolPolicy: pool}
+	s.TotalIPs = 0
+	s.StatCollectionInterval = 0
+	s.Capacity = nil
+	s.ProcessAll()
+	return &Calibration{PeakDemand: s.TotalIPs, MaxUsedIPs: s.MaxUsedIPs, Cooldown: cooldown}, nil
+}
+
+type calibrationQueueEntry struct {
+	ip       types.IPAddress
+	released types.Duration
+}
+
+// calibrationPool serves IPs that have finished cooldown, and adds IPs to the simulator whenever there are none.
+type calibrationPool struct {
+	sim   *Simulator
+	free  []types.IPAddress
+	queue []calibrationQueueEntry
+
+	Cooldown types.Duration
+	policies.BasePolicy
+}
+
+func (c *calibrationPool) Init(s types.Simulator) {
+	c.sim = s.(*Simulator)
+}
+
+func (c *calibrationPool) Seed(s types.Simulator, ip types.IPAddress) {
+	c.free = append(c.free, ip)
+}
+
+func (c *calibrationPool) GetIP(s types.Simulator, id types.TenantId) (ip types.IPAddress, err error) {
+	t := s.GetTime()
+	for len(c.queue) > 0 && c.queue[0].released+c.Cooldown <= t {
+		c.free = append(c.free, c.queue[0].ip)
+		c.queue = c.queue[1:]
+	}
+	if len(c.free) == 0 {
+		c.sim.addIP(types.IPAddress(len(c.sim.ipMeta)), c.sim.pools[0])
+		c.sim.TotalIPs++
+	}
+	ip, c.free = c.free[len(c.free)-1], c.free[:len(c.free)-1]
+	return ip, nil
+}
+
+func (c *calibrationPool) ReleaseIP(s types.Simulator, ip types.IPAddress, _ types.TenantId) {
+	c.queue = append(c.queue, calibrationQueueEntry{ip, s.GetTime()})
+}
@@ -0,0 +1,197 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+const defaultCapacityCheckInterval = types.Hour
+
+// CapacityChange adds or drains blocks of IPs at a given time.
+type CapacityChange struct {
+	At    types.Duration
+	Add   int
+	Drain int
+}
+
+/*
+Capacity manages the pool's address blocks over the course of a simulation, the way a provider grows a region when it runs hot and retires blocks it no longer needs.
+
+The pool is divided into blocks of BlockSize consecutive IPs, starting with the simulator's initial TotalIPs. Blocks are added or drained on a schedule, and reactively whenever the fraction of IPs allocated to tenants goes above ExpandAbove or below DrainBelow (checked every CheckInterval). Added IPs are seeded to the policy. Draining a block removes its free IPs from the policy immediately (which must implement types.IPRemover), and removes each allocated IP once its tenant releases it.
+*/
+type Capacity struct {
+	BlockSize int
+	Schedule  []CapacityChange `json:",omitempty"`
+
+	// Utilization thresholds for reactive changes (0 to disable)
+	ExpandAbove   float64        `json:",omitempty"`
+	DrainBelow    float64        `json:",omitempty"`
+	CheckInterval types.Duration `json:",omitempty"`
+	// Bounds on the number of active blocks for reactive changes (MaxBlocks 0 for no limit)
+	MinBlocks int `json:",omitempty"`
+	MaxBlocks int `json:",omitempty"`
+
+	blocks       []int // Active blocks, in the order they were added
+	nextBlock    int
+	nextSchedule int // Index of the next scheduled change
+	added        int
+	drained      int
+}
+
+// capacityCheckpoint is the state of a Capacity saved in simulator checkpoints
+type capacityCheckpoint struct {
+	Blocks       []int
+	NextBlock    int
+	NextSchedule int
+	Added        int
+	Drained      int
+}
+
+func (c *Capacity) validate(policy types.PoolPolicy) error {
+	if c.BlockSize <= 0 {
+		return errors.New("capacity must have a positive BlockSize")
+	}
+	drains := c.DrainBelow > 0
+	for _, change := range c.Schedule {
+		drains = drains || change.Drain > 0
+	}
+	if _, ok := policy.(types.IPRemover); drains && !ok {
+		return fmt.Errorf("policy %s can't remove IPs, so blocks can't be drained", policy.GetType())
+	}
+	return nil
+}
+
+func (c *Capacity) reactive() bool {
+	return c.ExpandAbove > 0 || c.DrainBelow > 0
+}
+
+// init divides the initial pool into blocks
+func (c *Capacity) init(s *Simulator) {
+	sort.SliceStable(c.Schedule, func(i, j int) bool { return c.Schedule[i].At < c.Schedule[j].At })
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = defaultCapacityCheckInterval
+	}
+	if c.MinBlocks <= 0 {
+		c.MinBlocks = 1
+	}
+	c.nextBlock = (s.TotalIPs + c.BlockSize - 1) / c.BlockSize
+	c.blocks = nil
+	for b := 0; b < c.nextBlock; b++ {
+		c.blocks = append(c.blocks, b)
+	}
+}
+
+// nextEvent returns when capacity should next be changed or checked
+func (c *Capacity) nextEvent(s *Simulator) types.Duration {
+	next := types.Never
+	if c.nextSchedule < len(c.Schedule) {
+		next = max(c.Schedule[c.nextSchedule].At, s.t)
+	}
+	if c.reactive() {
+		next = min(next, (s.t/c.CheckInterval+1)*c.CheckInterval)
+	}
+	return next
+}
+
+// process applies scheduled changes that are due, then reacts to the current utilization
+func (c *Capacity) process(s *Simulator) {
+	for c.nextSchedule < len(c.Schedule) && c.Schedule[c.nextSchedule].At <= s.t {
+		change := c.Schedule[c.nextSchedule]
+		c.nextSchedule++
+		for i := 0; i < change.Add; i++ {
+			c.addBlock(s)
+		}
+		for i := 0; i < change.Drain && len(c.blocks) > 0; i++ {
+			c.drainBlock(s)
+		}
+	}
+	if !c.reactive() || s.t%c.CheckInterval != 0 || s.TotalIPs == 0 {
+		return
+	}
+	utilization := float64(s.TotalIPs-len(s.freeIPs)) / float64(s.TotalIPs)
+	if c.ExpandAbove > 0 && utilization > c.ExpandAbove && (c.MaxBlocks == 0 || len(c.blocks) < c.MaxBlocks) {
+		c.addBlock(s)
+	} else if c.DrainBelow > 0 && utilization < c.DrainBelow && len(c.blocks) > c.MinBlocks {
+		c.drainBlock(s)
+	}
+}
+
+func (c *Capacity) addBlock(s *Simulator) {
+	b := c.nextBlock
+	if uint64((b+1)*c.BlockSize) > s.AddressSpace.Size() {
+		// Out of address space
+		return
+	}
+	c.nextBlock++
+	c.blocks = append(c.blocks, b)
+	c.added++
+	for i := 0; i < c.BlockSize; i++ {
+		s.addIP(types.IPAddress(b*c.BlockSize+i), s.pools[0])
+		s.TotalIPs++
+	}
+}
+
+// drainBlock retires the active block with the fewest allocated IPs
+func (c *Capacity) drainBlock(s *Simulator) {
+	best, bestUsed := -1, 0
+	for i, b := range c.blocks {
+		used := 0
+		for ip := b * c.BlockSize; ip < (b+1)*c.BlockSize; ip++ {
+			if _, ok := s.ipMeta[types.IPAddress(ip)]; !ok {
+				continue
+			}
+			if _, free := s.freeIPs[types.IPAddress(ip)]; !free {
+				used++
+			}
+		}
+		if best == -1 || used < bestUsed {
+			best, bestUsed = i, used
+		}
+	}
+	b := c.blocks[best]
+	c.blocks = append(c.blocks[:best], c.blocks[best+1:]...)
+	c.drained++
+
+	remover, ok := s.Policy.PoolPolicy.(types.IPRemover)
+	if !ok {
+		panic("Policy " + s.Policy.Type + " can't remove IPs")
+	}
+	var free []types.IPAddress
+	for i := 0; i < c.BlockSize; i++ {
+		ip := types.IPAddress(b*c.BlockSize + i)
+		info, ok := s.ipMeta[ip]
+		if !ok {
+			continue
+		}
+		if _, ok := s.freeIPs[ip]; ok {
+			free = append(free, ip)
+		} else {
+			// Removed once its tenant releases it
+			info.Draining = true
+		}
+	}
+	remover.RemoveIPs(s, free)
+	for _, ip := range free {
+		s.removeIP(ip)
+	}
+}
+
+func (c *Capacity) checkpoint() *capacityCheckpoint {
+	return &capacityCheckpoint{c.blocks, c.nextBlock, c.nextSchedule, c.added, c.drained}
+}
+
+func (c *Capacity) restore(cp *capacityCheckpoint) {
+	c.blocks = cp.Blocks
+	c.nextBlock = cp.NextBlock
+	c.nextSchedule = cp.NextSchedule
+	c.added = cp.Added
+	c.drained = cp.Drained
+}
+
+func (c *Capacity) collectOverallStats(stats map[string]interface{}) {
+	stats["blocksAdded"] = c.added
+	stats["blocksDrained"] = c.drained
+}
@@ -0,0 +1,248 @@
+package simulator
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+
+	"github.com/MadSP-McDaniel/eipsim/billing"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+type allocationCheckpoint struct {
+	At      types.Duration
+	ID      types.TenantId
+	HeldFor types.Duration
+	FreeFor types.Duration
+}
+
+type queuedRequestCheckpoint struct {
+	Tenant types.TenantId
+	Agent  int
+	At     types.Duration
+	Region string
+}
+
+type eventCheckpoint struct {
+	At    types.Duration
+	Agent int
+}
+
+// checkpoint is the serialized state of a simulator
+type checkpoint struct {
+	// The simulator marshalled as JSON, holding its configuration and collected stats
+	Config []byte
+
+	Time          types.Duration
+	Done          bool
+	Allocated     int
+	Released      int
+	TotalTimeHeld types.Duration
+	Allocations   []allocationCheckpoint
+	SimStats      SimStats
+
+	IPs     []*types.IPInfo // Ordered by address
+	FreeIPs []types.IPAddress
+
+	RandSeed  int64
+	RandDraws uint64
+
+	Events            []eventCheckpoint
+	Queue             []queuedRequestCheckpoint
+	InitializedAgents int
+	NextTenantID      types.TenantId
+	TenantIDBlock     types.TenantId
+
+	Capacity *capacityCheckpoint
+	Usage    []tenantUsageCheckpoint
+	Bills    []billing.Bill
+	Accounts []types.TenantId
+
+	Policy []byte
+	Agents [][]byte
+
+	// Stats of every region, and the policies of regions other than the default
+	RegionStats    []RegionStats
+	RegionPolicies [][]byte
+}
+
+/*
+Checkpoint writes the full state of an initialized simulator, including its policy and agents, so that it can be resumed with Restore.
+
+This allows an expensive warm-up to be run once and forked into many variants: run the simulator with MaxTime set to the end of the warm-up, checkpoint it, then restore a copy for each variant, change its configuration (e.g. MaxTime or the adversary's parameters), and call ProcessAll. A restored simulator continues exactly as the original would have.
+
+The policy and every agent must implement types.Checkpointer. Stat collectors and callbacks registered from outside the simulator's policy and agents are not saved.
+*/
+func (s *Simulator) Checkpoint(w io.Writer) error {
+	if s.rand == nil {
+		return errors.New("simulator has not been initialized")
+	}
+	c := checkpoint{
+		Time:              s.t,
+		Done:              s.done,
+		Allocated:         s.allocated,
+		Released:          s.released,
+		TotalTimeHeld:     s.totalTimeHeld,
+		SimStats:          s.SimStats,
+		RandSeed:          s.source.seed,
+		RandDraws:         s.source.draws,
+		InitializedAgents: s.initializedAgents,
+		NextTenantID:      s.nextTenantID,
+		TenantIDBlock:     s.tenantIDBlock,
+	}
+	if s.Capacity != nil {
+		c.Capacity = s.Capacity.checkpoint()
+	}
+	c.Usage = s.checkpointUsage()
+	c.Bills = s.bills
+	c.Accounts = s.checkpointAccounts()
+	var err error
+	c.Config, err = json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	for _, a := range s.allAllocations {
+		c.Allocations = append(c.Allocations, allocationCheckpoint{a.at, a.id, a.heldFor, a.freeFor})
+	}
+	for _, info := range s.ipMeta {
+		c.IPs = append(c.IPs, info)
+	}
+	sort.Slice(c.IPs, func(i, j int) bool { return c.IPs[i].Address < c.IPs[j].Address })
+	for ip := range s.freeIPs {
+		c.FreeIPs = append(c.FreeIPs, ip)
+	}
+	sort.Slice(c.FreeIPs, func(i, j int) bool { return c.FreeIPs[i] < c.FreeIPs[j] })
+	for _, e := range s.events {
+		c.Events = append(c.Events, eventCheckpoint{e.at, e.agent})
+	}
+	for _, r := range s.queue {
+		c.Queue = append(c.Queue, queuedRequestCheckpoint{r.tenant, r.agent, r.at, r.pool.name})
+	}
+
+	for i, p := range s.pools {
+		c.RegionStats = append(c.RegionStats, p.RegionStats)
+		policy, ok := p.policy.PoolPolicy.(types.Checkpointer)
+		if !ok {
+			return fmt.Errorf("policy %s does not support checkpoints", p.policy.Type)
+		}
+		b, err := policy.Checkpoint()
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", p.policy.Type, err)
+		}
+		if i == 0 {
+			c.Policy = b
+		} else {
+			c.RegionPolicies = append(c.RegionPolicies, b)
+		}
+	}
+	for i, agent := range s.Agents[:s.initializedAgents] {
+		a, ok := agent.Agent.(types.Checkpointer)
+		if !ok {
+			return fmt.Errorf("agent %d (%s) does not support checkpoints", i, agent.Type)
+		}
+		b, err := a.Checkpoint()
+		if err != nil {
+			return fmt.Errorf("agent %d (%s): %w", i, agent.Type, err)
+		}
+		c.Agents = append(c.Agents, b)
+	}
+	return gob.NewEncoder(w).Encode(&c)
+}
+
+// Restore reads a simulator written by Checkpoint. The simulator resumes from the time of the checkpoint when processed.
+func Restore(r io.Reader) (*Simulator, error) {
+	var c checkpoint
+	err := gob.NewDecoder(r).Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulator{}
+	err = json.Unmarshal(c.Config, s)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Agents) != c.InitializedAgents || c.InitializedAgents > len(s.Agents) {
+		return nil, errors.New("checkpoint agents don't match its configuration")
+	}
+	if len(c.RegionPolicies) != len(s.Regions) || len(c.RegionStats) != len(s.Regions)+1 {
+		return nil, errors.New("checkpoint regions don't match its configuration")
+	}
+	s.initPools()
+
+	s.t = c.Time
+	s.done = c.Done
+	s.allocated = c.Allocated
+	s.released = c.Released
+	s.totalTimeHeld = c.TotalTimeHeld
+	s.SimStats = c.SimStats
+	for _, a := range c.Allocations {
+		s.allAllocations = append(s.allAllocations, allocation{a.At, a.ID, a.HeldFor, a.FreeFor})
+	}
+	for _, info := range c.IPs {
+		if info.Configurations == nil {
+			info.Configurations = make(map[types.TenantId]types.Duration)
+		}
+		s.ipMeta[info.Address] = info
+	}
+	for _, ip := range c.FreeIPs {
+		s.freeIPs[ip] = struct{}{}
+		s.region(s.ipMeta[ip].Region).free++
+	}
+	s.source = newCountingSource(c.RandSeed, c.RandDraws)
+	s.rand = rand.New(s.source)
+	for _, e := range c.Events {
+		s.schedule(e.At, e.Agent)
+	}
+	for _, r := range c.Queue {
+		p := s.region(r.Region)
+		p.queued++
+		s.queue = append(s.queue, queuedRequest{r.Tenant, r.Agent, r.At, p})
+	}
+	s.processing = noAgent
+	if s.Capacity != nil && c.Capacity != nil {
+		s.Capacity.restore(c.Capacity)
+	}
+	s.initializedAgents = c.InitializedAgents
+	s.nextTenantID = c.NextTenantID
+	s.tenantIDBlock = c.TenantIDBlock
+	s.usage = make(map[types.TenantId]*tenantUsage)
+	if s.Limits != nil {
+		s.restoreUsage(c.Usage)
+	}
+	s.bills = c.Bills
+	s.accounts = make(map[types.TenantId]struct{}, len(c.Accounts))
+	for _, id := range c.Accounts {
+		s.accounts[id] = struct{}{}
+	}
+
+	for i, p := range s.pools {
+		p.RegionStats = c.RegionStats[i]
+		policy, ok := p.policy.PoolPolicy.(types.Checkpointer)
+		if !ok {
+			return nil, fmt.Errorf("policy %s does not support checkpoints", p.policy.Type)
+		}
+		b := c.Policy
+		if i > 0 {
+			b = c.RegionPolicies[i-1]
+		}
+		err = policy.Restore(s, b)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", p.policy.Type, err)
+		}
+	}
+	for i, b := range c.Agents {
+		a, ok := s.Agents[i].Agent.(types.Checkpointer)
+		if !ok {
+			return nil, fmt.Errorf("agent %d (%s) does not support checkpoints", i, s.Agents[i].Type)
+		}
+		err = a.Restore(s, b)
+		if err != nil {
+			return nil, fmt.Errorf("agent %d (%s): %w", i, s.Agents[i].Type, err)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,67 @@
+package simulator
+
+import "github.com/MadSP-McDaniel/eipsim/types"
+
+// adversarial returns whether a tenant belongs to an agent that is adversarial
+func (s *Simulator) adversarial(tenantID types.TenantId) bool {
+	agent := s.agentOf(tenantID)
+	if agent < 0 {
+		return false
+	}
+	a, ok := s.Agents[agent].Agent.(types.Adversary)
+	return ok && a.Adversarial()
+}
+
+// collectClassifierOverallStats scores the tenants flagged by policies that classify tenants against which agents are really adversarial. A tenant counts as flagged if any region's policy flagged it.
+func (s *Simulator) collectClassifierOverallStats() {
+	var tenants map[types.TenantId]bool
+	for _, p := range s.pools {
+		c, ok := p.policy.PoolPolicy.(types.TenantClassifier)
+		if !ok {
+			continue
+		}
+		classified := c.ClassifiedTenants()
+		if classified == nil {
+			continue
+		}
+		if tenants == nil {
+			tenants = map[types.TenantId]bool{}
+		}
+		for id, flagged := range classified {
+			tenants[id] = tenants[id] || flagged
+		}
+	}
+	if tenants == nil {
+		return
+	}
+
+	var tp, fp, fn, tn int
+	for id, flagged := range tenants {
+		switch adversarial := s.adversarial(id); {
+		case flagged && adversarial:
+			tp++
+		case flagged:
+			fp++
+		case adversarial:
+			fn++
+		default:
+			tn++
+		}
+	}
+	stats := map[string]interface{}{
+		"truePositives":  tp,
+		"falsePositives": fp,
+		"falseNegatives": fn,
+		"trueNegatives":  tn,
+	}
+	if tp+fp > 0 {
+		stats["precision"] = float64(tp) / float64(tp+fp)
+	}
+	if tp+fn > 0 {
+		stats["recall"] = float64(tp) / float64(tp+fn)
+	}
+	if fp+tn > 0 {
+		stats["falsePositiveRate"] = float64(fp) / float64(fp+tn)
+	}
+	s.OverallStats["classifier"] = stats
+}
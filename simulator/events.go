@@ -0,0 +1,74 @@
+package simulator
+
+import (
+	"container/heap"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+// statsEvent is the agent index of periodic stat collection events
+const statsEvent = -1
+
+// capacityEvent is the agent index of capacity management events
+const capacityEvent = -2
+
+// noAgent is the index of the processing agent when no agent is being processed
+const noAgent = -1
+
+type event struct {
+	at    types.Duration
+	agent int
+}
+
+// eventQueue is a min-heap of events. Events at the same time are ordered with capacity changes first, then stat collection, then agents by index, matching the order in which agents are processed each tick.
+type eventQueue []event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].agent < q[j].agent
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(event)) }
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// schedule adds an event, unless it would never happen
+func (s *Simulator) schedule(at types.Duration, agent int) {
+	if at == types.Never {
+		return
+	}
+	if agent >= 0 {
+		s.pendingAgents++
+	}
+	heap.Push(&s.events, event{at, agent})
+}
+
+// scheduleStats schedules the first stat collection
+func (s *Simulator) scheduleStats() {
+	if s.StatCollectionInterval != 0 {
+		s.schedule((s.t/s.StatCollectionInterval+1)*s.StatCollectionInterval, statsEvent)
+	}
+}
+
+// nextWakeup returns when an agent that was just processed should next be processed
+func (s *Simulator) nextWakeup(agent types.Agent) types.Duration {
+	next := s.t + s.TimeDelta
+	if w, ok := agent.(types.Waker); ok {
+		next = w.NextWakeup(s)
+		if next <= s.t {
+			next = s.t + s.TimeDelta
+		}
+	}
+	return next
+}
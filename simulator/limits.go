@@ -0,0 +1,189 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+// TenantLimits caps the number of IPs a tenant can hold and the rate of its API calls. Zero values are unlimited.
+type TenantLimits struct {
+	MaxIPs int `json:",omitempty"`
+	// Token bucket rates (calls per second) and burst sizes of GetIP and ReleaseIP calls. Bursts default to a single call.
+	AllocateRate  float64 `json:",omitempty"`
+	AllocateBurst float64 `json:",omitempty"`
+	ReleaseRate   float64 `json:",omitempty"`
+	ReleaseBurst  float64 `json:",omitempty"`
+}
+
+// LimitOverride replaces the non-zero limits of a range of an agent's tenants.
+type LimitOverride struct {
+	// Index of the agent in the simulator
+	Agent int
+	// Range of the agent's tenants, as offsets from its first tenant ID (all of its tenants if both are 0)
+	FirstTenant types.TenantId `json:",omitempty"`
+	LastTenant  types.TenantId `json:",omitempty"`
+	TenantLimits
+}
+
+/*
+Limits are the per-tenant quotas and API rate limits that the simulator enforces, like a provider's per-account IP quota and throttling of allocation calls.
+
+A tenant that holds MaxIPs IPs (including requests queued on its behalf) can't allocate more, and GetIP returns types.ErrQuotaExceeded. Calls over a tenant's rate limit fail with types.ErrThrottled and have no effect, so a throttled release leaves the IP with its tenant. Neither counts as an allocation failure.
+*/
+type Limits struct {
+	TenantLimits
+	Overrides []LimitOverride `json:",omitempty"`
+}
+
+// tokenBucket rate limits calls, starting full
+type tokenBucket struct {
+	Tokens float64
+	At     types.Duration
+}
+
+// take refills the bucket to time t and takes a token, returning false if there was none
+func (b *tokenBucket) take(rate, burst float64, t types.Duration) bool {
+	if rate <= 0 {
+		return true
+	}
+	burst = max(burst, 1)
+	b.Tokens = min(burst, b.Tokens+rate*float64(t-b.At))
+	b.At = t
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+// full returns whether the bucket would be full at time t
+func (b *tokenBucket) full(rate, burst float64, t types.Duration) bool {
+	return rate <= 0 || b.Tokens+rate*float64(t-b.At) >= max(burst, 1)
+}
+
+// tenantUsage tracks a tenant's use of its limits
+type tenantUsage struct {
+	limits   TenantLimits
+	held     int // IPs held by the tenant, and requests queued for it
+	allocate tokenBucket
+	release  tokenBucket
+}
+
+func (l *Limits) validate(numAgents int) error {
+	for _, o := range l.Overrides {
+		if o.Agent < 0 || o.Agent >= numAgents {
+			return fmt.Errorf("limit override for nonexistent agent %d", o.Agent)
+		}
+		if o.LastTenant < o.FirstTenant {
+			return errors.New("limit override has an empty range of tenants")
+		}
+	}
+	return nil
+}
+
+// tenantLimits returns the limits of a tenant, after applying any overrides of its range
+func (s *Simulator) tenantLimits(tenantID types.TenantId) TenantLimits {
+	limits := s.Limits.TenantLimits
+	agent, offset := s.TenantAgent(tenantID)
+	for _, o := range s.Limits.Overrides {
+		if o.Agent != agent || (o.LastTenant != 0 && (offset < o.FirstTenant || offset > o.LastTenant)) {
+			continue
+		}
+		if o.MaxIPs != 0 {
+			limits.MaxIPs = o.MaxIPs
+		}
+		if o.AllocateRate != 0 {
+			limits.AllocateRate = o.AllocateRate
+		}
+		if o.AllocateBurst != 0 {
+			limits.AllocateBurst = o.AllocateBurst
+		}
+		if o.ReleaseRate != 0 {
+			limits.ReleaseRate = o.ReleaseRate
+		}
+		if o.ReleaseBurst != 0 {
+			limits.ReleaseBurst = o.ReleaseBurst
+		}
+	}
+	return limits
+}
+
+func (s *Simulator) tenantUsage(tenantID types.TenantId) *tenantUsage {
+	u, ok := s.usage[tenantID]
+	if !ok {
+		u = &tenantUsage{limits: s.tenantLimits(tenantID)}
+		u.allocate.Tokens = max(u.limits.AllocateBurst, 1)
+		u.release.Tokens = max(u.limits.ReleaseBurst, 1)
+		s.usage[tenantID] = u
+	}
+	return u
+}
+
+// reserveIP checks a tenant's limits before it is given an IP, and counts the IP toward its quota
+func (s *Simulator) reserveIP(tenantID types.TenantId) error {
+	u := s.tenantUsage(tenantID)
+	if !u.allocate.take(u.limits.AllocateRate, u.limits.AllocateBurst, s.t) {
+		s.ThrottledAllocations++
+		s.WindowThrottled++
+		return types.ErrThrottled
+	}
+	if u.limits.MaxIPs > 0 && u.held >= u.limits.MaxIPs {
+		s.QuotaRejections++
+		s.WindowQuotaRejections++
+		return types.ErrQuotaExceeded
+	}
+	u.held++
+	return nil
+}
+
+// unreserveIP returns a reserved IP to the tenant's quota
+func (s *Simulator) unreserveIP(tenantID types.TenantId) {
+	u := s.usage[tenantID]
+	u.held--
+	if u.held == 0 && u.allocate.full(u.limits.AllocateRate, u.limits.AllocateBurst, s.t) && u.release.full(u.limits.ReleaseRate, u.limits.ReleaseBurst, s.t) {
+		// The tenant's usage no longer differs from a new tenant's
+		delete(s.usage, tenantID)
+	}
+}
+
+// throttleRelease checks a tenant's release rate limit
+func (s *Simulator) throttleRelease(tenantID types.TenantId) error {
+	u := s.tenantUsage(tenantID)
+	if !u.release.take(u.limits.ReleaseRate, u.limits.ReleaseBurst, s.t) {
+		s.ThrottledReleases++
+		s.WindowThrottled++
+		return types.ErrThrottled
+	}
+	return nil
+}
+
+func (s *Simulator) collectLimitOverallStats() {
+	s.OverallStats["throttledAllocations"] = s.ThrottledAllocations
+	s.OverallStats["throttledReleases"] = s.ThrottledReleases
+	s.OverallStats["quotaRejections"] = s.QuotaRejections
+}
+
+type tenantUsageCheckpoint struct {
+	Tenant   types.TenantId
+	Held     int
+	Allocate tokenBucket
+	Release  tokenBucket
+}
+
+func (s *Simulator) checkpointUsage() []tenantUsageCheckpoint {
+	var c []tenantUsageCheckpoint
+	for id, u := range s.usage {
+		c = append(c, tenantUsageCheckpoint{id, u.held, u.allocate, u.release})
+	}
+	sort.Slice(c, func(i, j int) bool { return c[i].Tenant < c[j].Tenant })
+	return c
+}
+
+func (s *Simulator) restoreUsage(c []tenantUsageCheckpoint) {
+	for _, u := range c {
+		s.usage[u.Tenant] = &tenantUsage{s.tenantLimits(u.Tenant), u.Held, u.Allocate, u.Release}
+	}
+}
@@ -0,0 +1,35 @@
+package simulator
+
+import "math/rand"
+
+// countingSource wraps the simulator's random source and counts the values drawn from it, so that its state can be checkpointed and later replayed.
+type countingSource struct {
+	src   rand.Source64
+	seed  int64
+	draws uint64
+}
+
+// newCountingSource creates a source with the given seed, advanced past its first draws values
+func newCountingSource(seed int64, draws uint64) *countingSource {
+	c := &countingSource{src: rand.NewSource(seed).(rand.Source64), seed: seed}
+	for c.draws < draws {
+		c.Uint64()
+	}
+	return c
+}
+
+func (c *countingSource) Int63() int64 {
+	c.draws++
+	return c.src.Int63()
+}
+
+func (c *countingSource) Uint64() uint64 {
+	c.draws++
+	return c.src.Uint64()
+}
+
+func (c *countingSource) Seed(seed int64) {
+	c.src.Seed(seed)
+	c.seed = seed
+	c.draws = 0
+}
@@ -0,0 +1,133 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/MadSP-McDaniel/eipsim/policies"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+/*
+Region is an additional pool of IPs hosted by the simulator, with its own size and policy.
+
+The simulator's own TotalIPs and Policy make up the types.DefaultRegion, and each region's IPs follow it in order. Agents allocate from a region with GetIPInRegion, while IPs are always released back to the region they came from. Exhaustion behavior and latent configuration are shared by all regions.
+*/
+type Region struct {
+	Name     string
+	TotalIPs int
+	Policy   policies.PoolPolicyWrapper
+}
+
+// RegionStats holds the allocation stats of a single region.
+type RegionStats struct {
+	WindowAllocated int
+	WindowRequests  int
+	WindowFailures  int
+
+	Allocated  int
+	Requests   int
+	Failures   int
+	MaxUsedIPs int
+}
+
+// pool is the state of a region during a simulation
+type pool struct {
+	name   string
+	policy *policies.PoolPolicyWrapper
+	size   *int
+	RegionStats
+	free   int
+	queued int // Requests in the simulator's queue for this region
+}
+
+func (s *Simulator) validateRegions() error {
+	if len(s.Regions) == 0 {
+		return nil
+	}
+	if s.Capacity != nil {
+		return errors.New("capacity can't be managed in a simulator with regions")
+	}
+	names := map[string]bool{types.DefaultRegion: true, "": true}
+	for _, r := range s.Regions {
+		if names[r.Name] {
+			return fmt.Errorf("invalid or duplicate region name %q", r.Name)
+		}
+		names[r.Name] = true
+		if r.TotalIPs <= 0 {
+			return fmt.Errorf("region %s must have a positive TotalIPs", r.Name)
+		}
+		if r.Policy.PoolPolicy == nil {
+			return fmt.Errorf("region %s has no pool policy", r.Name)
+		}
+	}
+	return nil
+}
+
+// initPools creates the pool of each region, with the default region first
+func (s *Simulator) initPools() {
+	s.pools = []*pool{{name: types.DefaultRegion, policy: &s.Policy, size: &s.TotalIPs}}
+	for i := range s.Regions {
+		r := &s.Regions[i]
+		s.pools = append(s.pools, &pool{name: r.Name, policy: &r.Policy, size: &r.TotalIPs})
+	}
+	s.poolsByName = make(map[string]*pool, len(s.pools)+1)
+	for _, p := range s.pools {
+		s.poolsByName[p.name] = p
+	}
+	s.poolsByName[""] = s.pools[0]
+}
+
+// poolSize returns the total size of all regions
+func (s *Simulator) poolSize() int {
+	size := s.TotalIPs
+	for _, r := range s.Regions {
+		size += r.TotalIPs
+	}
+	return size
+}
+
+func (s *Simulator) region(name string) *pool {
+	p, ok := s.poolsByName[name]
+	if !ok {
+		panic("Unknown region " + name)
+	}
+	return p
+}
+
+func (s *Simulator) collectRegionPeriodicStats(newStats map[string]interface{}) {
+	regions := make(map[string]interface{}, len(s.pools))
+	for _, p := range s.pools {
+		stats := map[string]interface{}{
+			"availableIPs": p.free,
+			"allocated":    p.WindowAllocated,
+		}
+		if p.WindowFailures > 0 {
+			stats["allocationFailures"] = p.WindowFailures
+			stats["allocationFailureRate"] = float64(p.WindowFailures) / float64(p.WindowRequests)
+		}
+		s.collectPolicyStats(p.policy.PoolPolicy, stats)
+		regions[p.name] = stats
+		p.WindowAllocated = 0
+		p.WindowRequests = 0
+		p.WindowFailures = 0
+	}
+	newStats["regions"] = regions
+}
+
+func (s *Simulator) collectRegionOverallStats() {
+	regions := make(map[string]interface{}, len(s.pools))
+	for _, p := range s.pools {
+		stats := map[string]interface{}{
+			"allocated":  p.Allocated,
+			"maxUsedIPs": p.MaxUsedIPs,
+		}
+		if p.Failures > 0 {
+			stats["allocationFailures"] = p.Failures
+			stats["allocationFailureRate"] = float64(p.Failures) / float64(p.Requests)
+		}
+		s.collectPolicyStats(p.policy.PoolPolicy, stats)
+		regions[p.name] = stats
+	}
+	s.OverallStats["regions"] = regions
+}
@@ -0,0 +1,74 @@
+package simulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// LoadScenario reads a JSON scenario describing a simulator (the same format that a simulator is marshalled to) and returns a simulator ready for ProcessAll.
+func LoadScenario(r io.Reader) (*Simulator, error) {
+	s := &Simulator{}
+	err := json.NewDecoder(r).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Policy.PoolPolicy == nil {
+		return nil, errors.New("scenario has no pool policy")
+	}
+	if s.TotalIPs <= 0 {
+		return nil, errors.New("scenario must have a positive TotalIPs")
+	}
+	err = s.AddressSpace.Validate()
+	if err != nil {
+		return nil, err
+	}
+	err = s.validateRegions()
+	if err != nil {
+		return nil, err
+	}
+	if s.Limits != nil {
+		err = s.Limits.validate(len(s.Agents))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if uint64(s.poolSize()) > s.AddressSpace.Size() {
+		return nil, fmt.Errorf("address space only has room for %d IPs", s.AddressSpace.Size())
+	}
+	switch s.Exhaustion {
+	case "", ExhaustionReject, ExhaustionQueue, ExhaustionBypassCooldown:
+	default:
+		return nil, fmt.Errorf("unknown exhaustion behavior %q", s.Exhaustion)
+	}
+	if s.Capacity != nil {
+		err = s.Capacity.validate(s.Policy.PoolPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// LoadScenarioFile is LoadScenario for a scenario stored at the given path.
+func LoadScenarioFile(filename string) (*Simulator, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadScenario(f)
+}
+
+// WriteJSONL writes the marshalled simulator, including its collected stats, as a single line of JSON.
+func (s *Simulator) WriteJSONL(w io.Writer) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = w.Write(data)
+	return err
+}
@@ -1,10 +1,15 @@
 package simulator
 
 import (
+	"container/heap"
+	"encoding/json"
+	"errors"
 	"math"
 	"math/rand"
+	"net/netip"
 
 	"github.com/MadSP-McDaniel/eipsim/agents"
+	"github.com/MadSP-McDaniel/eipsim/billing"
 	"github.com/MadSP-McDaniel/eipsim/policies"
 	"github.com/MadSP-McDaniel/eipsim/types"
 	"github.com/MadSP-McDaniel/eipsim/util"
@@ -23,11 +28,48 @@ type SimStats struct {
 	// Window allocations
 	WindowAllocated int
 	WindowConf      int
+	WindowRequests  int
+	WindowFailures  int
 
 	// Overall allocations
 	TotalConf int
 
 	MaxUsedIPs int
+
+	// Requests that couldn't be served immediately because the pool was exhausted
+	Requests         int
+	Failures         int
+	CooldownBypasses int
+	Queued           int
+	TotalQueueWait   types.Duration
+
+	// Requests to recover a specific IP, and those that succeeded
+	RecoveryRequests int
+	Recoveries       int
+
+	// Calls rejected by tenant limits
+	WindowThrottled       int
+	WindowQuotaRejections int
+	ThrottledAllocations  int
+	ThrottledReleases     int
+	QuotaRejections       int
+}
+
+// Behaviors when the pool has no IP to give a tenant
+const (
+	// The request fails, and GetIP returns types.ErrPoolExhausted
+	ExhaustionReject = "reject"
+	// The request is queued, and served before any later request once an IP is available. GetIP returns types.ErrRequestQueued, and the IP is given to the agent through types.IPReceiver. Requests from agents that don't implement IPReceiver are rejected.
+	ExhaustionQueue = "queue"
+	// The policy gives out an IP that is still in its cooldown, if it implements types.CooldownBypasser. Otherwise the request is rejected.
+	ExhaustionBypassCooldown = "bypass-cooldown"
+)
+
+type queuedRequest struct {
+	tenant types.TenantId
+	agent  int
+	at     types.Duration
+	pool   *pool
 }
 
 type Simulator struct {
@@ -58,7 +100,31 @@ type Simulator struct {
 
 	TotalIPs int
 
+	// Additional pools, each with its own size and policy
+	Regions []Region `json:",omitempty"`
+
+	// Real addresses of the pool's IPs (IPv4 addresses equal to each IP's index by default)
+	AddressSpace *types.AddressSpace `json:",omitempty"`
+	// Collect the number of tenants holding IPs in each subnet of the address space
+	SubnetStats bool `json:",omitempty"`
+
+	// What to do when the pool is exhausted (ExhaustionReject by default)
+	Exhaustion string `json:",omitempty"`
+
+	// Adds and drains blocks of IPs during the simulation
+	Capacity *Capacity `json:",omitempty"`
+
+	// Per-tenant quotas and API rate limits
+	Limits *Limits `json:",omitempty"`
+
+	// Prices charged to each agent
+	Billing *billing.ModelWrapper `json:",omitempty"`
+
+	// Seed for the simulator's random source, which all agents and policies draw from
+	Seed int64
+
 	rand            *rand.Rand
+	source          *countingSource
 	TimeSeriesStats map[types.Duration]map[string]interface{}
 	OverallStats    map[string]interface{}
 
@@ -66,6 +132,25 @@ type Simulator struct {
 
 	statCollectors        []types.StatCollector
 	ipAllocationCallbacks []types.IPAllocationCallback
+
+	events        eventQueue
+	pendingAgents int // Number of agent events in the queue
+
+	processing int // Index of the agent being processed, or noAgent
+	queue      []queuedRequest
+
+	pools       []*pool // The pool of each region, starting with the default region
+	poolsByName map[string]*pool
+
+	usage map[types.TenantId]*tenantUsage // Tenants' use of their Limits
+
+	bills    []billing.Bill // Charges to each agent for completed holds
+	accounts map[types.TenantId]struct{}
+
+	// Tenant IDs are handed out to agents in blocks as they're initialized
+	initializedAgents int
+	nextTenantID      types.TenantId
+	tenantIDBlock     types.TenantId
 }
 
 func (s *Simulator) GetTimeDelta() types.Duration {
@@ -78,6 +163,26 @@ func NewSimulator(ips int, p types.PoolPolicy, ts types.Duration) *Simulator {
 	return s
 }
 
+// UnmarshalJSON loads a simulator configuration (pool size, policy, agents, etc.) so that it is ready to run.
+func (s *Simulator) UnmarshalJSON(b []byte) error {
+	type w Simulator
+
+	err := json.Unmarshal(b, (*w)(s))
+	if err != nil {
+		return err
+	}
+	if s.ipMeta == nil {
+		s.ipMeta = make(map[types.IPAddress]*types.IPInfo)
+	}
+	if s.freeIPs == nil {
+		s.freeIPs = make(map[types.IPAddress]struct{})
+	}
+	if s.TimeDelta == 0 {
+		s.TimeDelta = 1
+	}
+	return nil
+}
+
 func (s *Simulator) RegisterStatCollector(sc types.StatCollector) {
 	s.statCollectors = append(s.statCollectors, sc)
 }
@@ -111,18 +216,49 @@ func (s *Simulator) CollectPeriodicStats() {
 	s.TimeSeriesStats[s.t] = newStats
 }
 
+/*
+Process advances the simulation to the time of the next scheduled event, and handles all events at that time. It returns false once the simulation is over.
+
+Agents are processed every TimeDelta unless they implement types.Waker, in which case the simulator skips straight to their next wakeup. Agents are processed at times before MaxTime, and periodic stats are collected up to and including MaxTime.
+*/
 func (s *Simulator) Process() bool {
-	if s.MaxTime != 0 && s.t >= s.MaxTime {
+	if s.done || len(s.events) == 0 || (s.MaxTime == 0 && s.pendingAgents == 0) {
 		return false
 	}
-	if s.done {
+	next := s.events[0]
+	if s.MaxTime != 0 && (next.at > s.MaxTime || (next.at == s.MaxTime && next.agent >= 0)) {
+		s.t = s.MaxTime
 		return false
 	}
-	for _, agent := range s.Agents {
+	s.t = next.at
+	s.serveQueue()
+	for len(s.events) > 0 && s.events[0].at == s.t {
+		if s.MaxTime != 0 && s.t == s.MaxTime && s.events[0].agent >= 0 {
+			break
+		}
+		e := heap.Pop(&s.events).(event)
+		switch e.agent {
+		case statsEvent:
+			s.CollectPeriodicStats()
+			s.schedule(s.t+s.StatCollectionInterval, statsEvent)
+			continue
+		case capacityEvent:
+			s.Capacity.process(s)
+			s.schedule(s.Capacity.nextEvent(s), capacityEvent)
+			continue
+		}
+		s.pendingAgents--
+		agent := s.Agents[e.agent]
+		s.processing = e.agent
 		agent.Process(s)
+		s.processing = noAgent
+		s.schedule(s.nextWakeup(agent.Agent), e.agent)
+	}
+	if s.done {
+		// The simulation ends after the step in which an agent finished
+		s.t += s.TimeDelta
+		s.CollectPeriodicStats()
 	}
-	s.t = s.t + s.TimeDelta
-	s.CollectPeriodicStats()
 	return true
 }
 
@@ -130,25 +266,83 @@ func (s *Simulator) Rand() *rand.Rand {
 	return s.rand
 }
 
+/*
+InitAgents initializes the pool and all agents, and schedules their first processing at the current time.
+
+Calling InitAgents again (or running a restored simulator) only initializes agents added since, which start at the next time step with a fresh range of tenant IDs.
+*/
 func (s *Simulator) InitAgents() {
-	s.rand = rand.New(rand.NewSource(0))
-	s.Policy.Init(s)
-	for len(s.ipMeta) < s.TotalIPs {
-		ip := types.IPAddress(len(s.ipMeta))
-		hll, err := hyperloglog.New(16)
-		if err != nil {
-			panic(err)
+	start := s.t + s.TimeDelta
+	if s.rand == nil {
+		s.processing = noAgent
+		s.source = newCountingSource(s.Seed, 0)
+		s.rand = rand.New(s.source)
+		s.initPools()
+		s.usage = make(map[types.TenantId]*tenantUsage)
+		s.accounts = make(map[types.TenantId]struct{})
+		for _, p := range s.pools {
+			p.policy.Init(s)
+			for start := len(s.ipMeta); len(s.ipMeta) < start+*p.size; {
+				s.addIP(types.IPAddress(len(s.ipMeta)), p)
+			}
 		}
-		s.ipMeta[ip] = &types.IPInfo{Address: ip, Released: 0, Owners: hll, Configurations: make(map[types.TenantId]types.Duration), Owner: types.NilTenant}
-		s.Policy.Seed(s, ip)
-		s.freeIPs[ip] = struct{}{}
+		s.tenantIDBlock = types.TenantId(math.MaxUint32) / types.TenantId(max(len(s.Agents), 1)) / 3
+		s.nextTenantID = 1
+		s.scheduleStats()
+		if s.Capacity != nil {
+			s.Capacity.init(s)
+			s.schedule(s.Capacity.nextEvent(s), capacityEvent)
+		}
+		start = s.t
 	}
-	idAllocSize := types.TenantId(math.MaxUint32) / types.TenantId(len(s.Agents)) / 3
-	id := types.TenantId(1)
-	for _, agent := range s.Agents {
-		agent.Init(s, id, id+idAllocSize)
-		id += 2 * idAllocSize
+	for ; s.initializedAgents < len(s.Agents); s.initializedAgents++ {
+		id := s.nextTenantID
+		if uint64(id)+uint64(s.tenantIDBlock) > math.MaxUint32 {
+			panic("No tenant IDs left for new agents")
+		}
+		s.Agents[s.initializedAgents].Init(s, id, id+s.tenantIDBlock)
+		s.nextTenantID += 2 * s.tenantIDBlock
+		s.schedule(start, s.initializedAgents)
+	}
+}
+
+// agentOf returns the index of the agent that a tenant ID was handed out to, or -1 if there is none
+func (s *Simulator) agentOf(tenantID types.TenantId) int {
+	agent := int((tenantID - 1) / (2 * s.tenantIDBlock))
+	if tenantID == types.NilTenant || agent >= s.initializedAgents || (tenantID-1)%(2*s.tenantIDBlock) >= s.tenantIDBlock {
+		return -1
+	}
+	return agent
+}
+
+func (s *Simulator) TenantAgent(tenantID types.TenantId) (int, types.TenantId) {
+	agent := s.agentOf(tenantID)
+	if agent < 0 {
+		return -1, 0
+	}
+	return agent, (tenantID - 1) % (2 * s.tenantIDBlock)
+}
+
+// addIP creates a new free IP in a region and seeds it to the region's policy
+func (s *Simulator) addIP(ip types.IPAddress, p *pool) {
+	hll, err := hyperloglog.New(16)
+	if err != nil {
+		panic(err)
+	}
+	s.ipMeta[ip] = &types.IPInfo{Address: ip, Released: 0, Owners: hll, Configurations: make(map[types.TenantId]types.Duration), Owner: types.NilTenant, AddedAt: s.t, Subnet: s.AddressSpace.Subnet(ip), Region: p.name}
+	p.policy.Seed(s, ip)
+	s.freeIPs[ip] = struct{}{}
+	p.free++
+}
+
+// removeIP removes a free IP from the pool, after it has been removed from the pool policy
+func (s *Simulator) removeIP(ip types.IPAddress) {
+	if _, ok := s.freeIPs[ip]; ok {
+		s.region(s.ipMeta[ip].Region).free--
 	}
+	delete(s.ipMeta, ip)
+	delete(s.freeIPs, ip)
+	s.TotalIPs--
 }
 
 func (s *Simulator) CleanupAgents() {
@@ -184,14 +378,151 @@ func (s *Simulator) GetOverallStats() map[string]interface{} {
 	return s.OverallStats
 }
 
-func (s *Simulator) GetIP(tenantID types.TenantId) (ip types.IPAddress) {
+// GetPrefix returns the real address (or IPv6 prefix) of an IP in the simulator's address space.
+func (s *Simulator) GetPrefix(ip types.IPAddress) netip.Prefix {
+	return s.AddressSpace.Prefix(ip)
+}
+
+// GetPolicy returns the policy of the default region.
+func (s *Simulator) GetPolicy() types.PoolPolicy {
+	return s.Policy.PoolPolicy
+}
+
+/*
+GetIP allocates an IP to a tenant from the default region.
+
+If the pool is exhausted, the request is handled according to the simulator's Exhaustion behavior, and an error wrapping types.ErrPoolExhausted is returned unless the request could be served by bypassing cooldown. Requests over the tenant's Limits fail with types.ErrQuotaExceeded or types.ErrThrottled before reaching the pool.
+*/
+func (s *Simulator) GetIP(tenantID types.TenantId) (types.IPAddress, error) {
+	return s.GetIPInRegion(types.DefaultRegion, tenantID)
+}
+
+// GetIPInRegion is GetIP for the named region. It panics if the region doesn't exist.
+func (s *Simulator) GetIPInRegion(region string, tenantID types.TenantId) (types.IPAddress, error) {
+	p := s.region(region)
+	if s.Limits != nil {
+		err := s.reserveIP(tenantID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	s.Requests++
+	s.WindowRequests++
+	p.Requests++
+	p.WindowRequests++
+	var ip types.IPAddress
+	err := types.ErrPoolExhausted
+	if p.queued == 0 {
+		ip, err = p.policy.GetIP(s, tenantID)
+	}
+	if errors.Is(err, types.ErrPoolExhausted) && s.Exhaustion == ExhaustionBypassCooldown {
+		if b, ok := p.policy.PoolPolicy.(types.CooldownBypasser); ok {
+			ip, err = b.GetCooldownIP(s, tenantID)
+			if err == nil {
+				s.CooldownBypasses++
+			}
+		}
+	}
+	if err != nil {
+		s.Failures++
+		s.WindowFailures++
+		p.Failures++
+		p.WindowFailures++
+		if errors.Is(err, types.ErrPoolExhausted) && s.Exhaustion == ExhaustionQueue && s.processing != noAgent {
+			if _, ok := s.Agents[s.processing].Agent.(types.IPReceiver); ok {
+				s.Queued++
+				p.queued++
+				s.queue = append(s.queue, queuedRequest{tenantID, s.processing, s.t, p})
+				return 0, types.ErrRequestQueued
+			}
+		}
+		if s.Limits != nil {
+			s.unreserveIP(tenantID)
+		}
+		return 0, err
+	}
+	s.allocate(ip, tenantID, p)
+	return ip, nil
+}
+
+/*
+GetSpecificIP allocates the given IP to a tenant, if the IP is free and the policy of its region lets the tenant recover it (see types.IPRecoverer). It fails with types.ErrNotRecoverable otherwise; recovery requests are never queued or served from a cooldown bypass. Requests over the tenant's Limits fail as for GetIP.
+*/
+func (s *Simulator) GetSpecificIP(tenantID types.TenantId, ip types.IPAddress) error {
+	s.RecoveryRequests++
+	info, ok := s.ipMeta[ip]
+	if !ok {
+		return types.ErrNotRecoverable
+	}
+	if _, free := s.freeIPs[ip]; !free {
+		return types.ErrNotRecoverable
+	}
+	p := s.region(info.Region)
+	r, ok := p.policy.PoolPolicy.(types.IPRecoverer)
+	if !ok {
+		return types.ErrNotRecoverable
+	}
+	if s.Limits != nil {
+		err := s.reserveIP(tenantID)
+		if err != nil {
+			return err
+		}
+	}
+	if !r.RecoverIP(s, ip, tenantID) {
+		if s.Limits != nil {
+			s.unreserveIP(tenantID)
+		}
+		return types.ErrNotRecoverable
+	}
+	s.Recoveries++
+	s.allocate(ip, tenantID, p)
+	return nil
+}
+
+// serveQueue serves queued requests in order, until each region with queued requests runs out again
+func (s *Simulator) serveQueue() {
+	if len(s.queue) == 0 {
+		return
+	}
+	exhausted := map[*pool]bool{}
+	kept := s.queue[:0]
+	for i, r := range s.queue {
+		if len(exhausted) == len(s.pools) {
+			kept = append(kept, s.queue[i:]...)
+			break
+		}
+		if exhausted[r.pool] {
+			kept = append(kept, r)
+			continue
+		}
+		ip, err := r.pool.policy.GetIP(s, r.tenant)
+		if err != nil {
+			exhausted[r.pool] = true
+			kept = append(kept, r)
+			continue
+		}
+		r.pool.queued--
+		s.allocate(ip, r.tenant, r.pool)
+		s.TotalQueueWait += s.t - r.at
+		s.Agents[r.agent].Agent.(types.IPReceiver).ReceiveIP(s, r.tenant, ip)
+	}
+	s.queue = kept
+}
+
+// allocate records an IP given out by a region's policy as owned by the tenant
+func (s *Simulator) allocate(ip types.IPAddress, tenantID types.TenantId, p *pool) {
 	s.allocated++
-	// No remaining seed IPs, pull from the pool
-	ip = s.Policy.GetIP(s, tenantID)
 	if _, ok := s.freeIPs[ip]; !ok {
 		panic("Pool returned IP address that isn't free")
 	}
 	delete(s.freeIPs, ip)
+	p.free--
+	p.Allocated++
+	p.WindowAllocated++
+	p.MaxUsedIPs = max(p.MaxUsedIPs, *p.size-p.free)
+	if s.Billing != nil {
+		s.chargeAllocation(tenantID)
+	}
 
 	s.ipMeta[ip].Owner = tenantID
 	s.ipMeta[ip].AllocatedAt = s.t
@@ -201,11 +532,10 @@ func (s *Simulator) GetIP(tenantID types.TenantId) (ip types.IPAddress) {
 		s.TotalConf += 1
 	}
 	// Track Max Used IPs
-	usedIps := s.TotalIPs - len(s.freeIPs)
+	usedIps := s.poolSize() - len(s.freeIPs)
 	if usedIps > s.MaxUsedIPs {
 		s.MaxUsedIPs = usedIps
 	}
-	return ip
 }
 
 func (s *Simulator) GetInfo(ip types.IPAddress) *types.IPInfo {
@@ -216,14 +546,21 @@ func (s *Simulator) GetAllMeta() map[types.IPAddress]*types.IPInfo {
 	return s.ipMeta
 }
 
-func (s *Simulator) ReleaseIP(ip types.IPAddress, tenantID types.TenantId, benign bool) {
-	s.released++
+// ReleaseIP returns a tenant's IP to its region's pool. It fails with types.ErrThrottled if the tenant is over its release rate limit, in which case the tenant keeps the IP.
+func (s *Simulator) ReleaseIP(ip types.IPAddress, tenantID types.TenantId, benign bool) error {
 	if s.ipMeta[ip].Owner != tenantID {
 		panic("Tenant returned IP that didn't belong to it")
 	}
 	if _, ok := s.freeIPs[ip]; ok {
 		panic("Tenant released free IP")
 	}
+	if s.Limits != nil {
+		err := s.throttleRelease(tenantID)
+		if err != nil {
+			return err
+		}
+	}
+	s.released++
 	freeFor := s.ipMeta[ip].AllocatedAt - s.ipMeta[ip].Released
 	if s.ipMeta[ip].Released == 0 {
 		freeFor = 0
@@ -240,8 +577,16 @@ func (s *Simulator) ReleaseIP(ip types.IPAddress, tenantID types.TenantId, benig
 
 	s.ipMeta[ip].Owner = types.NilTenant
 	s.totalTimeHeld += s.GetTime() - s.ipMeta[ip].AllocatedAt
-	s.Policy.ReleaseIP(s, ip, tenantID)
-	s.freeIPs[ip] = struct{}{}
+	if s.Billing != nil {
+		s.chargeHold(ip, tenantID, s.GetTime()-s.ipMeta[ip].AllocatedAt)
+	}
+	draining := s.ipMeta[ip].Draining
+	if !draining {
+		p := s.region(s.ipMeta[ip].Region)
+		p.policy.ReleaseIP(s, ip, tenantID)
+		s.freeIPs[ip] = struct{}{}
+		p.free++
+	}
 	for _, cb := range s.ipAllocationCallbacks {
 		cb(s, ip, tenantID)
 	}
@@ -254,6 +599,13 @@ func (s *Simulator) ReleaseIP(ip types.IPAddress, tenantID types.TenantId, benig
 				freeFor,
 			})
 	}
+	if draining {
+		s.removeIP(ip)
+	}
+	if s.Limits != nil {
+		s.unreserveIP(tenantID)
+	}
+	return nil
 }
 
 func (s *Simulator) AddAgent(agent types.Agent) {
@@ -261,7 +613,7 @@ func (s *Simulator) AddAgent(agent types.Agent) {
 }
 
 func (s *Simulator) AvailableIPs() uint32 {
-	return uint32(len(s.freeIPs) + int(s.TotalIPs) - len(s.ipMeta))
+	return uint32(len(s.freeIPs) + s.poolSize() - len(s.ipMeta))
 }
 
 // Run creates and executes a simulator
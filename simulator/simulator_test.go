@@ -0,0 +1,521 @@
+package simulator_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/policies"
+	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+const testScenario = `{
+	"TotalIPs": 3000,
+	"MaxTime": 43200,
+	"StatCollectionInterval": 3600,
+	"AllocationSamplingRate": 10,
+	"LatentConfProbability": 0.5,
+	"Seed": 7,
+	"Policy": {"Type": "POLICY"},
+	"Agents": [
+		{"Type": "autoscale", "NumTenants": 100, "MaxWait": 600, "NMax": 20, "NMin": 2, "TenantChurn": 21600},
+		{"Type": "multi", "MaxIPs": 200, "MinIPs": 10, "MaxChangeInterval": 600, "MaxPerCycle": 5, "NumTenants": 20},
+		{"Type": "adversary", "MaxIPs": 20, "HoldDuration": 600, "MaxPerCycle": 5, "StartTime": 21600, "AllocationsPerTenant": 20, "MaxTenants": 5}
+	]
+}`
+
+func runScenario(t *testing.T, policy string) []byte {
+	s, err := simulator.LoadScenario(strings.NewReader(strings.Replace(testScenario, "POLICY", policy, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ProcessAll()
+	var out bytes.Buffer
+	err = s.WriteJSONL(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// A scenario and seed should always produce identical output
+func TestDeterministic(t *testing.T) {
+	for _, policy := range policies.Registered() {
+		first := runScenario(t, policy)
+		second := runScenario(t, policy)
+		if !bytes.Equal(first, second) {
+			t.Errorf("%s: repeated runs produced different output", policy)
+		}
+	}
+}
+
+// Checkpointing a simulator partway through and resuming it should produce the same output as an uninterrupted run
+func TestCheckpoint(t *testing.T) {
+	for _, policy := range policies.Registered() {
+		s, err := simulator.LoadScenario(strings.NewReader(strings.Replace(testScenario, "POLICY", policy, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.MaxTime = 30000
+		s.InitAgents()
+		for s.Process() {
+		}
+		var checkpoint bytes.Buffer
+		err = s.Checkpoint(&checkpoint)
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		restored, err := simulator.Restore(&checkpoint)
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		restored.MaxTime = 43200
+		restored.ProcessAll()
+		var out bytes.Buffer
+		err = restored.WriteJSONL(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), runScenario(t, policy)) {
+			t.Errorf("%s: restored run produced different output", policy)
+		}
+	}
+}
+
+// An undersized pool should report allocation failures under every exhaustion behavior rather than panicking
+func TestExhaustion(t *testing.T) {
+	for _, policy := range policies.Registered() {
+		for _, exhaustion := range []string{simulator.ExhaustionReject, simulator.ExhaustionQueue, simulator.ExhaustionBypassCooldown} {
+			s, err := simulator.LoadScenario(strings.NewReader(strings.Replace(testScenario, "POLICY", policy, 1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.TotalIPs = 500
+			s.Exhaustion = exhaustion
+			s.ProcessAll()
+			stats := s.OverallStats
+			if stats["allocationFailures"] == nil && stats["cooldownBypasses"] == nil {
+				t.Errorf("%s/%s: no allocation failures reported", policy, exhaustion)
+			}
+		}
+	}
+}
+
+// Blocks added and drained mid-run should never be given out while removed, under any policy
+func TestCapacity(t *testing.T) {
+	for _, policy := range policies.Registered() {
+		s, err := simulator.LoadScenario(strings.NewReader(strings.Replace(testScenario, "POLICY", policy, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.TotalIPs = 1000
+		s.Capacity = &simulator.Capacity{
+			BlockSize:     100,
+			Schedule:      []simulator.CapacityChange{{At: 3600, Add: 5}, {At: 25000, Drain: 8}},
+			ExpandAbove:   0.6,
+			DrainBelow:    0.3,
+			CheckInterval: 1800,
+		}
+		s.ProcessAll()
+		if s.OverallStats["blocksAdded"].(int) < 5 || s.OverallStats["blocksDrained"].(int) < 8 {
+			t.Errorf("%s: expected scheduled blocks to be added and drained, got %v added and %v drained", policy, s.OverallStats["blocksAdded"], s.OverallStats["blocksDrained"])
+		}
+	}
+}
+
+// IPs should map onto the scenario's address space, which is kept when the simulator is marshalled
+func TestAddressSpace(t *testing.T) {
+	scenario := strings.Replace(testScenario, `"Seed": 7,`, `"Seed": 7, "AddressSpace": {"Prefixes": ["2600:1f00::/40"], "Bits": 80},`, 1)
+	s, err := simulator.LoadScenario(strings.NewReader(strings.Replace(scenario, "POLICY", "random", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ProcessAll()
+	if p := s.GetPrefix(65537).String(); p != "2600:1f00:0:1:1::/80" {
+		t.Errorf("IP 65537 mapped to %s", p)
+	}
+	var out bytes.Buffer
+	err = s.WriteJSONL(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"AddressSpace":{"Prefixes":["2600:1f00::/40"],"Bits":80}`) {
+		t.Error("address space missing from output")
+	}
+}
+
+func TestSubnets(t *testing.T) {
+	scenario := strings.Replace(testScenario, `"Seed": 7,`, `"Seed": 7, "SubnetStats": true,`, 1)
+	clustered := map[string]float64{}
+	for _, policy := range []string{"random", "subnet-affinity"} {
+		s, err := simulator.LoadScenario(strings.NewReader(strings.Replace(scenario, "POLICY", policy, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ProcessAll()
+		stats := s.TimeSeriesStats[s.MaxTime/2]
+		if stats["subnetsInUse"] == nil {
+			t.Fatalf("%s: no subnet stats", policy)
+		}
+		clustered[policy] = stats["avgTenantsPerSubnet"].(float64)
+	}
+	if clustered["subnet-affinity"] >= clustered["random"] {
+		t.Errorf("subnet affinity didn't cluster tenants: %v", clustered)
+	}
+}
+
+// runSplit runs a scenario, optionally checkpointing it at time 30000 and finishing the run from a restored copy. setup is called on the simulator before it is run.
+func runSplit(t *testing.T, scenario string, split bool, setup func(*simulator.Simulator)) (*simulator.Simulator, []byte) {
+	s, err := simulator.LoadScenario(strings.NewReader(scenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(s)
+	}
+	if split {
+		s.MaxTime = 30000
+		s.InitAgents()
+		for s.Process() {
+		}
+		var checkpoint bytes.Buffer
+		err = s.Checkpoint(&checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err = simulator.Restore(&checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.MaxTime = 43200
+	}
+	s.ProcessAll()
+	var out bytes.Buffer
+	err = s.WriteJSONL(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, out.Bytes()
+}
+
+// runRestorable runs a scenario uninterrupted, calling setup on it first, and checks that a run checkpointed partway through and restored (without setup) produces the same output
+func runRestorable(t *testing.T, scenario string, setup func(*simulator.Simulator)) *simulator.Simulator {
+	t.Helper()
+	s, out := runSplit(t, scenario, false, setup)
+	if _, restored := runSplit(t, scenario, true, nil); !bytes.Equal(out, restored) {
+		t.Error("restored run produced different output")
+	}
+	return s
+}
+
+// Agents should allocate from their own region, and a simulator with regions should resume exactly from a checkpoint
+func TestRegions(t *testing.T) {
+	scenario := strings.Replace(testScenario, `"Seed": 7,`, `"Seed": 7, "Exhaustion": "queue", "Regions": [{"Name": "east", "TotalIPs": 300, "Policy": {"Type": "segmented"}}],`, 1)
+	scenario = strings.Replace(scenario, `{"Type": "multi",`, `{"Type": "multi", "Region": "east",`, 1)
+	scenario = strings.Replace(scenario, `{"Type": "adversary",`, `{"Type": "adversary", "Regions": ["default", "east"],`, 1)
+	scenario = strings.Replace(scenario, "POLICY", "random", 1)
+	s := runRestorable(t, scenario, nil)
+	regions := s.OverallStats["regions"].(map[string]interface{})
+	for _, name := range []string{"default", "east"} {
+		stats := regions[name].(map[string]interface{})
+		if stats["allocated"].(int) == 0 {
+			t.Errorf("nothing allocated in region %s", name)
+		}
+	}
+	if regions["east"].(map[string]interface{})["maxUsedIPs"].(int) > 300 {
+		t.Error("region east used more IPs than it has")
+	}
+	if s.OverallStats["queuedRequests"] == nil {
+		t.Error("region east was never exhausted")
+	}
+}
+
+// Tenants should never exceed their quotas, and an adversary without its own limits should be bounded by the provider's rate limit
+func TestLimits(t *testing.T) {
+	scenario := strings.Replace(testScenario, `"Seed": 7,`, `"Seed": 7, "Limits": {"MaxIPs": 3, "AllocateRate": 0.01, "AllocateBurst": 5, "ReleaseRate": 0.05, "Overrides": [{"Agent": 0, "MaxIPs": 50, "AllocateRate": 1, "ReleaseRate": 1}]},`, 1)
+	scenario = strings.Replace(scenario, `"MaxIPs": 20, "HoldDuration": 600, "MaxPerCycle": 5,`, `"MaxIPs": 0, "HoldDuration": 600, "MaxPerCycle": 0,`, 1)
+	scenario = strings.Replace(scenario, "POLICY", "random", 1)
+	most := 0
+	trackHeld := func(s *simulator.Simulator) {
+		s.RegisterStatCollector(func(s types.Simulator, stats map[string]interface{}) {
+			held := map[types.TenantId]int{}
+			for _, info := range s.(*simulator.Simulator).GetAllMeta() {
+				if info.Owner != types.NilTenant {
+					held[info.Owner]++
+					most = max(most, held[info.Owner])
+				}
+			}
+		})
+	}
+	s := runRestorable(t, scenario, trackHeld)
+	if most > 50 {
+		t.Errorf("a tenant held %d IPs", most)
+	}
+	for _, stat := range []string{"quotaRejections", "throttledAllocations", "throttledReleases"} {
+		if s.OverallStats[stat].(int) == 0 {
+			t.Errorf("no %s", stat)
+		}
+	}
+	// 5 adversarial tenants, each with a burst of 5 and 0.01 allocations per second from 21600 to 43200
+	if created := s.OverallStats["adversary"].(map[string]interface{})["totalCreated"].(int); created > 5*(5+216) {
+		t.Errorf("adversary created %d IPs", created)
+	}
+}
+
+// Every agent should be billed, and the adversary's cost should be divided over what it obtained
+func TestBilling(t *testing.T) {
+	scenario := strings.Replace(testScenario, `"Seed": 7,`, `"Seed": 7, "Billing": {"Type": "linear", "IdleHourlyRate": 0.01, "AllocationFee": 0.001, "AccountFee": 1},`, 1)
+	scenario = strings.Replace(scenario, "POLICY", "random", 1)
+	s := runRestorable(t, scenario, nil)
+	bills := s.OverallStats["bills"].([]map[string]interface{})
+	for _, b := range bills {
+		if b["holding"].(float64) <= 0 || b["allocations"].(float64) <= 0 {
+			t.Errorf("%s was not billed", b["agent"])
+		}
+	}
+	// The adversary pays for its 5 accounts, 0.001 per allocation, and 0.015 per hour of holding (all of it idle)
+	adversary := s.OverallStats["adversary"].(map[string]interface{})
+	created := adversary["totalCreated"].(int)
+	if bills[2]["accounts"].(float64) != 5 || math.Abs(bills[2]["allocations"].(float64)-0.001*float64(created)) > 1e-9 {
+		t.Errorf("adversary billed %v for %d allocations", bills[2], created)
+	}
+	cost := adversary["cost"].(float64)
+	if cost != bills[2]["total"].(float64) || adversary["dollarsPerUniqueIP"].(float64) != cost/float64(adversary["newUniques"].(uint64)) {
+		t.Errorf("adversary cost %v doesn't match its bill %v", adversary, bills[2])
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	// Jittered cooldowns reorder the cooldown queues, which should survive checkpointing
+	jitter := `{"Type": "jitter", "Duration": 600, "Jitter": 3600}`
+	for _, policy := range policies.Registered() {
+		config := `"Cooldown": ` + jitter
+		p, err := policies.New(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Middleware has no Cooldown of its own, so its inner policy's is jittered, along with the cooldown middleware's own
+		if _, ok := p.(interface{ Unwrap() types.PoolPolicy }); ok {
+			config = `"Inner": {"Type": "random", "Cooldown": ` + jitter + `}`
+			if policy == "cooldown" {
+				config += `, "Mode": "jitter", "Duration": 600, "Jitter": 3600`
+			}
+		}
+		scenario := strings.Replace(testScenario, `"POLICY"}`, `"`+policy+`", `+config+`}`, 1)
+		t.Run(policy, func(t *testing.T) { runRestorable(t, scenario, nil) })
+	}
+
+	// A longer cooldown gives latent configurations more time to expire before their IPs are reused
+	latentConfs := func(cooldown string) uint64 {
+		scenario := strings.Replace(testScenario, `"POLICY"}`, `"random", "Cooldown": `+cooldown+`}`, 1)
+		s, _ := runSplit(t, scenario, false, nil)
+		return s.OverallStats["adversary"].(map[string]interface{})["newLatentConfs"].(uint64)
+	}
+	if short, long := latentConfs("0"), latentConfs("14400"); long >= short {
+		t.Errorf("4 hour cooldown exposed %d latent configurations, no cooldown exposed %d", long, short)
+	}
+}
+
+func TestSegmentedSelection(t *testing.T) {
+	// The timer index is rebuilt rather than checkpointed, so it should be rebuilt identically
+	for _, selection := range []string{policies.SegmentedNearest, policies.SegmentedNearestUnder, policies.SegmentedSample} {
+		scenario := strings.Replace(testScenario, `"POLICY"}`, `"segmented", "Selection": "`+selection+`"}`, 1)
+		t.Run(selection, func(t *testing.T) { runRestorable(t, scenario, nil) })
+	}
+	_, err := simulator.LoadScenario(strings.NewReader(strings.Replace(testScenario, `"POLICY"}`, `"segmented", "Selection": "closest"}`, 1)))
+	if err == nil {
+		t.Error("unknown selection was accepted")
+	}
+}
+
+func TestSegmentedAdaptive(t *testing.T) {
+	s, _ := runSplit(t, strings.Replace(testScenario, "POLICY", "segmented-adaptive", 1), false, nil)
+	multipliers := map[float64]bool{}
+	for _, stats := range s.TimeSeriesStats {
+		multipliers[policyStats(stats, "segmented-adaptive")["timerMultiplier"].(float64)] = true
+	}
+	if len(multipliers) < 2 {
+		t.Errorf("multiplier was never adjusted: %v", multipliers)
+	}
+}
+
+// Policies should report their metrics in the time-series and overall stats, and keep reporting them after a restore
+func TestPolicyStats(t *testing.T) {
+	scenario := strings.Replace(testScenario, "POLICY", "segmented", 1)
+	s := runRestorable(t, scenario, nil)
+	for at, stats := range s.TimeSeriesStats {
+		deciles := policyStats(stats, "segmented")["freeTimerDeciles"].([]types.Duration)
+		if len(deciles) != 11 || !sort.SliceIsSorted(deciles, func(i, j int) bool { return deciles[i] < deciles[j] }) || deciles[0] < 0 {
+			t.Errorf("free timer deciles at %v: %v", at, deciles)
+		}
+	}
+	overall := policyStats(s.OverallStats, "segmented")
+	if overall["ownerReuses"].(int) == 0 || overall["ownerMisses"].(int) == 0 {
+		t.Errorf("owner reuses and misses weren't both counted: %v", overall)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	scenario := strings.Replace(testScenario, "POLICY", "quarantine", 1)
+	s := runRestorable(t, scenario, nil)
+	classifier := s.OverallStats["classifier"].(map[string]interface{})
+	// The adversary's 5 tenants should be caught without flagging benign tenants
+	if classifier["truePositives"] != 5 || classifier["falseNegatives"] != 0 || classifier["falsePositives"] != 0 {
+		t.Errorf("classifier stats %v", classifier)
+	}
+	if s.Policy.PoolPolicy.(*policies.QuarantinePool).QuarantineHits == 0 {
+		t.Error("flagged tenants weren't served from the quarantine")
+	}
+}
+
+func TestReputation(t *testing.T) {
+	s, _ := runSplit(t, strings.Replace(testScenario, "POLICY", "reputation", 1), false, nil)
+	p := s.Policy.PoolPolicy.(*policies.ReputationPool)
+	served := 0
+	for _, n := range p.Served {
+		served += n
+	}
+	// Every allocation is served from exactly one tier
+	if served != s.GetAllocated() {
+		t.Errorf("served %d allocations from tiers %v, simulator allocated %d", served, p.Served, s.GetAllocated())
+	}
+	if p.OwnerReuses == 0 || p.Served[len(p.Served)-1] == 0 {
+		t.Errorf("no IPs were given back to their owners, or no risky IPs were served: %v", p.Served)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	recoverRun := func(policy string) *simulator.Simulator {
+		scenario := strings.Replace(testScenario, `"POLICY"}`, policy+`}`, 1)
+		scenario = strings.Replace(scenario, `"TenantChurn": 21600}`, `"TenantChurn": 21600, "RecoverProbability": 0.5}`, 1)
+		return runRestorable(t, scenario, nil)
+	}
+	// Policies that don't support recovery reject every request
+	s := recoverRun(`"random"`)
+	if s.RecoveryRequests == 0 || s.Recoveries != 0 {
+		t.Errorf("random: %d of %d recovery requests succeeded", s.Recoveries, s.RecoveryRequests)
+	}
+	s = recoverRun(`"recovery", "Hold": 14400`)
+	if s.Recoveries == 0 || s.Recoveries != s.Policy.PoolPolicy.(*policies.AffinityPolicy).Recoveries {
+		t.Errorf("recovery: %d of %d recovery requests succeeded", s.Recoveries, s.RecoveryRequests)
+	}
+
+	// IP 0 is recovered like any other, when it's the only IP autoscale tenants can release
+	scenario := `{"TotalIPs": 1, "MaxTime": 172800, "Seed": 7, "Policy": {"Type": "recovery", "Hold": 14400}, "Agents": [{"Type": "autoscale", "NumTenants": 1, "MaxWait": 600, "NMax": 3, "NMin": 1, "RecoverProbability": 1}]}`
+	s, _ = runSplit(t, scenario, false, nil)
+	if s.Recoveries == 0 {
+		t.Errorf("IP 0: %d of %d recovery requests succeeded", s.Recoveries, s.RecoveryRequests)
+	}
+
+	// Only the tenant an IP is held for can recover it
+	s, err := simulator.LoadScenario(strings.NewReader(`{"TotalIPs": 10, "MaxTime": 100, "Policy": {"Type": "recovery", "Inner": {"Type": "fifo"}}, "Agents": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddAgent(&scriptAgent{run: func(s types.Simulator) {
+		ip, err := s.GetIP(1)
+		if err != nil || ip != 0 {
+			t.Fatalf("got IP %d (%v), rather than IP 0", ip, err)
+		}
+		if err := s.ReleaseIP(ip, 1, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.GetSpecificIP(2, ip); !errors.Is(err, types.ErrNotRecoverable) {
+			t.Errorf("another tenant recovering a held IP got %v, rather than types.ErrNotRecoverable", err)
+		}
+		if err := s.GetSpecificIP(1, ip); err != nil {
+			t.Errorf("recovering a held IP failed with %v", err)
+		}
+	}})
+	s.ProcessAll()
+	if s.Recoveries != 1 || s.RecoveryRequests != 2 {
+		t.Errorf("%d of %d recovery requests succeeded, rather than 1 of 2", s.Recoveries, s.RecoveryRequests)
+	}
+}
+
+// scriptAgent runs a function once, at the start of a simulation
+type scriptAgent struct {
+	run  func(types.Simulator)
+	done bool
+}
+
+func (a *scriptAgent) GetType() string { return "script" }
+
+func (a *scriptAgent) Init(s types.Simulator, minID types.TenantId, maxID types.TenantId) {}
+
+func (a *scriptAgent) Process(s types.Simulator) {
+	a.run(s)
+	a.done = true
+}
+
+func (a *scriptAgent) NextWakeup(s types.Simulator) types.Duration {
+	if a.done {
+		return types.Never
+	}
+	return s.GetTime()
+}
+
+// policyStats returns the metrics that the policy at the end of a path of policy types, from the simulator's policy through its inner policies, reported in a period's stats, or nil if there are none
+func policyStats(stats map[string]interface{}, path ...string) map[string]interface{} {
+	m, _ := stats["policyStats"].(map[string]interface{})
+	for _, policy := range path {
+		m, _ = m[policy].(map[string]interface{})
+	}
+	return m
+}
+
+// cooldownBacklogs removes the policy's metrics from a simulator's stats, which differ between policies even when they behave alike, and returns the cooldown backlog in each period
+func cooldownBacklogs(s *simulator.Simulator) map[types.Duration]int {
+	backlogs := map[types.Duration]int{}
+	for t, stats := range s.TimeSeriesStats {
+		backlogs[t] = policyStats(stats, s.Policy.Type)["cooldownBacklog"].(int)
+		delete(stats, "policyStats")
+	}
+	delete(s.OverallStats, "policyStats")
+	return backlogs
+}
+
+func TestMiddleware(t *testing.T) {
+	// A cooldown wrapping FIFO is the same as FIFO's own cooldown
+	wrapped, _ := runSplit(t, strings.Replace(testScenario, `"POLICY"}`, `"cooldown", "Duration": 1800, "Inner": {"Type": "fifo"}}`, 1), false, nil)
+	builtin, _ := runSplit(t, strings.Replace(testScenario, `"POLICY"}`, `"fifo", "Cooldown": 1800}`, 1), false, nil)
+	wrappedBacklog, builtinBacklog := cooldownBacklogs(wrapped), cooldownBacklogs(builtin)
+	if !reflect.DeepEqual(wrappedBacklog, builtinBacklog) {
+		t.Errorf("cooldown middleware backlog %v differs from FIFO's %v", wrappedBacklog, builtinBacklog)
+	}
+	if !reflect.DeepEqual(wrapped.OverallStats, builtin.OverallStats) || !reflect.DeepEqual(wrapped.TimeSeriesStats, builtin.TimeSeriesStats) {
+		t.Error("cooldown middleware differs from FIFO with a cooldown")
+	}
+
+	// The first 300 IPs are reserved for the first half of the autoscale agent's tenants
+	scenario := strings.Replace(testScenario, `"POLICY"}`, `"cooldown", "Duration": 1800, "Inner": {"Type": "affinity", "Inner": {"Type": "reserved", "NumIPs": 300, "Agent": 0, "LastTenant": 49, "Inner": {"Type": "random", "Cooldown": 0}}}}`, 1)
+	reservedAllocations := 0
+	s := runRestorable(t, scenario, func(s *simulator.Simulator) {
+		s.RegisterIPAllocationCallback(func(s types.Simulator, ip types.IPAddress, tenant types.TenantId) {
+			if ip < 300 {
+				reservedAllocations++
+				if agent, offset := s.TenantAgent(tenant); agent != 0 || offset > 49 {
+					t.Errorf("reserved IP %d given to tenant %d", ip, tenant)
+				}
+			}
+		})
+	})
+	if reservedAllocations == 0 {
+		t.Error("no reserved IPs were used")
+	}
+	affinity := s.Policy.PoolPolicy.(*policies.CooldownPolicy).Unwrap().(*policies.AffinityPolicy)
+	if affinity.Reuses == 0 {
+		t.Error("no IPs were reused by their tenant")
+	}
+	// Each level of the stack reports its metrics under its own type
+	_, reserved := policyStats(s.OverallStats, "cooldown", "affinity", "reserved")["freeReserved"]
+	_, random := policyStats(s.OverallStats, "cooldown", "affinity", "reserved", "random")["cooldownBacklog"]
+	if !reserved || !random {
+		t.Errorf("policy stats %v aren't nested by policy type", s.OverallStats["policyStats"])
+	}
+}
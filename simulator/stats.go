@@ -13,9 +13,34 @@ func (s *Simulator) CollectSimulatorPeriodicStats(newStats map[string]interface{
 	newStats["availableIPs"] = s.AvailableIPs()
 	newStats["allocated"] = s.WindowAllocated
 	newStats["latentConf"] = s.WindowConf
+	if s.Capacity != nil {
+		newStats["totalIPs"] = s.TotalIPs
+	}
+	if s.SubnetStats {
+		s.collectSubnetStats(newStats)
+	}
+	if len(s.Regions) > 0 {
+		s.collectRegionPeriodicStats(newStats)
+	} else {
+		s.collectPolicyStats(s.Policy.PoolPolicy, newStats)
+	}
+	if s.WindowThrottled > 0 {
+		newStats["throttled"] = s.WindowThrottled
+	}
+	if s.WindowQuotaRejections > 0 {
+		newStats["quotaRejections"] = s.WindowQuotaRejections
+	}
+	if s.WindowFailures > 0 {
+		newStats["allocationFailures"] = s.WindowFailures
+		newStats["allocationFailureRate"] = float64(s.WindowFailures) / float64(s.WindowRequests)
+	}
 
 	s.WindowAllocated = 0
 	s.WindowConf = 0
+	s.WindowRequests = 0
+	s.WindowFailures = 0
+	s.WindowThrottled = 0
+	s.WindowQuotaRejections = 0
 	//log.Println(s.GetTime(), newStats)
 }
 
@@ -23,11 +48,79 @@ func (s *Simulator) CollectSimulatorOverallStats() {
 	s.OverallStats["maxUsedIPs"] = s.MaxUsedIPs
 	s.OverallStats["allocated"] = s.GetAllocated()
 	s.OverallStats["latentConf"] = s.SimStats.TotalConf
+	if s.Failures > 0 || s.CooldownBypasses > 0 {
+		s.OverallStats["allocationFailures"] = s.Failures
+		s.OverallStats["allocationFailureRate"] = float64(s.Failures) / float64(s.Requests)
+		s.OverallStats["cooldownBypasses"] = s.CooldownBypasses
+		s.OverallStats["queuedRequests"] = s.Queued
+		s.OverallStats["unservedRequests"] = len(s.queue)
+	}
+	if s.RecoveryRequests > 0 {
+		s.OverallStats["recoveryRequests"] = s.RecoveryRequests
+		s.OverallStats["recoveries"] = s.Recoveries
+	}
+	if s.Queued > len(s.queue) {
+		s.OverallStats["avgQueueWait"] = float64(s.TotalQueueWait) / float64(s.Queued-len(s.queue))
+	}
+	if s.Capacity != nil {
+		s.Capacity.collectOverallStats(s.OverallStats)
+	}
+	if len(s.Regions) > 0 {
+		s.collectRegionOverallStats()
+	} else {
+		s.collectPolicyStats(s.Policy.PoolPolicy, s.OverallStats)
+	}
+	if s.Limits != nil {
+		s.collectLimitOverallStats()
+	}
+	if s.Billing != nil {
+		s.collectBillingOverallStats()
+	}
+	s.collectClassifierOverallStats()
 
 	s.collectAllocationDurationCDF()
 	s.collectFreeDurationCDF()
 }
 
+// collectPolicyStats records the internal metrics of a policy under its type, if it reports any
+func (s *Simulator) collectPolicyStats(policy types.PoolPolicy, stats map[string]interface{}) {
+	r, ok := policy.(types.StatsReporter)
+	if !ok {
+		return
+	}
+	m := map[string]interface{}{}
+	r.ReportStats(s, m)
+	if len(m) > 0 {
+		stats["policyStats"] = map[string]interface{}{policy.GetType(): m}
+	}
+}
+
+// collectSubnetStats counts the distinct tenants holding IPs in each subnet
+func (s *Simulator) collectSubnetStats(newStats map[string]interface{}) {
+	tenants := map[types.Subnet]map[types.TenantId]struct{}{}
+	for _, info := range s.ipMeta {
+		if info.Owner == types.NilTenant {
+			continue
+		}
+		owners, ok := tenants[info.Subnet]
+		if !ok {
+			owners = map[types.TenantId]struct{}{}
+			tenants[info.Subnet] = owners
+		}
+		owners[info.Owner] = struct{}{}
+	}
+	total, most := 0, 0
+	for _, owners := range tenants {
+		total += len(owners)
+		most = max(most, len(owners))
+	}
+	newStats["subnetsInUse"] = len(tenants)
+	newStats["maxTenantsPerSubnet"] = most
+	if len(tenants) > 0 {
+		newStats["avgTenantsPerSubnet"] = float64(total) / float64(len(tenants))
+	}
+}
+
 func (s *Simulator) outputAllocationTrace() {
 	log.Println("Sorting allocs...")
 	sort.Slice(s.allAllocations, func(i, j int) bool {
@@ -0,0 +1,120 @@
+package sweep
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/types"
+	"github.com/MadSP-McDaniel/eipsim/util"
+)
+
+// Aggregate summarizes a single metric across replicates.
+type Aggregate struct {
+	// Number of replicates that reported the metric
+	N      int
+	Mean   float64
+	StdDev float64
+	// Half-width of the 95% confidence interval for the mean
+	CI95 float64
+}
+
+func aggregate(xs []float64) Aggregate {
+	return Aggregate{N: len(xs), Mean: util.Mean(xs), StdDev: util.StdDev(xs), CI95: util.CI95(xs)}
+}
+
+/*
+Summary aggregates the stats of several replicates of the same scenario.
+
+Every numeric stat is aggregated, with nested stats (e.g., those of the adversary) named by their dot-separated path such as "adversary.newUniques". Non-numeric stats such as CDFs are not aggregated, and neither are the axis values recorded in each replicate's OverallStats, which are given by Point.
+*/
+type Summary struct {
+	Point           Point
+	Seeds           []int64
+	OverallStats    map[string]Aggregate
+	TimeSeriesStats map[types.Duration]map[string]Aggregate
+}
+
+// Summarize aggregates the stats of simulators that have been run.
+func Summarize(p Point, sims []*simulator.Simulator) *Summary {
+	summary := &Summary{Point: p, OverallStats: map[string]Aggregate{}, TimeSeriesStats: map[types.Duration]map[string]Aggregate{}}
+	overall := map[string][]float64{}
+	series := map[types.Duration]map[string][]float64{}
+	for _, s := range sims {
+		summary.Seeds = append(summary.Seeds, s.Seed)
+		flattenStats(s.OverallStats, overall)
+		for t, stats := range s.TimeSeriesStats {
+			if series[t] == nil {
+				series[t] = map[string][]float64{}
+			}
+			flattenStats(stats, series[t])
+		}
+	}
+	sort.Slice(summary.Seeds, func(i, j int) bool { return summary.Seeds[i] < summary.Seeds[j] })
+	for k, xs := range overall {
+		if !p.tags(k) {
+			summary.OverallStats[k] = aggregate(xs)
+		}
+	}
+	for t, stats := range series {
+		summary.TimeSeriesStats[t] = map[string]Aggregate{}
+		for k, xs := range stats {
+			summary.TimeSeriesStats[t][k] = aggregate(xs)
+		}
+	}
+	return summary
+}
+
+// tags returns whether a flattened stat is the value of one of the point's axes, or within it
+func (p Point) tags(stat string) bool {
+	for name := range p {
+		if stat == name || strings.HasPrefix(stat, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenStats appends the numeric values of stats to out, which is keyed by each value's path
+func flattenStats(stats map[string]interface{}, out map[string][]float64) {
+	// Round-trip through JSON so that all numeric types are handled alike
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return
+	}
+	var v interface{}
+	if json.Unmarshal(b, &v) != nil {
+		return
+	}
+	flatten("", v, out)
+}
+
+func flatten(prefix string, v interface{}, out map[string][]float64) {
+	switch n := v.(type) {
+	case float64:
+		out[prefix] = append(out[prefix], n)
+	case map[string]interface{}:
+		for k, child := range n {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flatten(k, child, out)
+		}
+	}
+}
+
+// Replicate runs n replicates of a scenario with consecutive seeds, starting at the scenario's seed, and summarizes their stats. Each replicate is rebuilt from the scenario, so setup (if not nil) is called on it before it is run, like a sweep's Setup.
+func Replicate(base *simulator.Simulator, n int, workers int, setup func(*simulator.Simulator, Point) error) (*Summary, error) {
+	if n <= 0 {
+		return nil, errors.New("replicate count must be positive")
+	}
+	sw := &Sweep{Base: base, Replicates: n, Workers: workers, Setup: setup}
+	var summary *Summary
+	err := sw.run(func(v interface{}) error {
+		summary = v.(*Summary)
+		return nil
+	})
+	return summary, err
+}
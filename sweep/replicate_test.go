@@ -0,0 +1,103 @@
+package sweep
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/MadSP-McDaniel/eipsim/simulator"
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+const testScenario = `{
+	"TotalIPs": 100,
+	"MaxTime": 21600,
+	"StatCollectionInterval": 3600,
+	"Seed": 7,
+	"Policy": {"Type": "random"},
+	"Agents": [{"Type": "autoscale", "NumTenants": 10, "MaxWait": 600, "NMax": 20, "NMin": 2}]
+}`
+
+func loadScenario(t *testing.T) *simulator.Simulator {
+	s, err := simulator.LoadScenario(strings.NewReader(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// checkAggregate checks that a metric was aggregated from the values each replicate reported
+func checkAggregate(t *testing.T, name string, a Aggregate, xs []float64) {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	mean := sum / float64(len(xs))
+	var squares float64
+	for _, x := range xs {
+		squares += (x - mean) * (x - mean)
+	}
+	sd := math.Sqrt(squares / float64(len(xs)-1))
+	// 4.303 is the critical value for 2 degrees of freedom
+	ci := 4.303 * sd / math.Sqrt(float64(len(xs)))
+	near := func(a, b float64) bool { return math.Abs(a-b) <= 1e-9*max(1, math.Abs(b)) }
+	if a.N != len(xs) || !near(a.Mean, mean) || !near(a.StdDev, sd) || !near(a.CI95, ci) {
+		t.Errorf("%s: aggregate %+v of %v, want mean %v, std %v, ci %v", name, a, xs, mean, sd, ci)
+	}
+}
+
+// Replicates should run with consecutive seeds, and every numeric stat should be aggregated across them
+func TestReplicate(t *testing.T) {
+	var setups atomic.Int32
+	summary, err := Replicate(loadScenario(t), 3, 2, func(s *simulator.Simulator, p Point) error {
+		setups.Add(1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary.Seeds, []int64{7, 8, 9}) {
+		t.Errorf("seeds %v, want [7 8 9]", summary.Seeds)
+	}
+	if n := setups.Load(); n != 3 {
+		t.Errorf("setup called %d times, want once for each replicate", n)
+	}
+
+	overall := map[string][]float64{}
+	series := map[types.Duration]map[string][]float64{}
+	for seed := int64(7); seed <= 9; seed++ {
+		s := loadScenario(t)
+		s.Seed = seed
+		s.ProcessAll()
+		flattenStats(s.OverallStats, overall)
+		for at, stats := range s.TimeSeriesStats {
+			if series[at] == nil {
+				series[at] = map[string][]float64{}
+			}
+			flattenStats(stats, series[at])
+		}
+	}
+	if a := summary.OverallStats["allocated"]; a.Mean == 0 || a.StdDev == 0 {
+		t.Fatalf("allocations %+v don't vary between seeds", a)
+	}
+
+	if len(summary.OverallStats) != len(overall) {
+		t.Errorf("%d overall stats aggregated, want %d", len(summary.OverallStats), len(overall))
+	}
+	for name, xs := range overall {
+		checkAggregate(t, name, summary.OverallStats[name], xs)
+	}
+	if len(summary.TimeSeriesStats) != len(series) || len(series) != 6 {
+		t.Errorf("%d periods aggregated, want %d (6 hours)", len(summary.TimeSeriesStats), len(series))
+	}
+	for at, stats := range series {
+		if len(summary.TimeSeriesStats[at]) != len(stats) {
+			t.Errorf("at %v: %d stats aggregated, want %d", at, len(summary.TimeSeriesStats[at]), len(stats))
+		}
+		for name, xs := range stats {
+			checkAggregate(t, name, summary.TimeSeriesStats[at][name], xs)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+/*
+Package sweep runs a base scenario across a grid of parameter values.
+
+A Sweep substitutes the values of each Axis into a JSON-encoded copy of the base simulator, so any field of the scenario (pool size, policy, agent parameters, etc.) can be swept without writing nested loops. Each completed simulator is written as one line of JSONL, with the values of every axis recorded in its OverallStats under the axis name.
+*/
+package sweep
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MadSP-McDaniel/eipsim/simulator"
+)
+
+// Axis is a named parameter of the sweep.
+type Axis struct {
+	// Name is used to identify the axis in filters and output stats, so it can't be the name of one of the simulator's own OverallStats (such as "allocated" or an agent's type)
+	Name string
+	// Path is the dot-separated location in the scenario JSON that values are substituted into (e.g. "Policy" or "Agents.1.MaxTenants").
+	// Axes with no path are not substituted, and are only available to filters and Setup.
+	Path   string
+	Values []interface{}
+}
+
+// Point holds the value of each axis for a single simulation.
+type Point map[string]interface{}
+
+// Filter returns whether a point should be simulated.
+type Filter func(Point) bool
+
+type Sweep struct {
+	Base *simulator.Simulator
+	Axes []Axis
+	// Zip pairs the i-th values of all axes together, rather than simulating the cartesian product of axes.
+	Zip bool
+	// Include keeps only points matching at least one condition. A condition matches if, for every axis it names, the point takes one of the listed values.
+	Include []map[string][]interface{}
+	// Max number of simulations to run at once (defaults to the number of CPUs)
+	Workers int
+
+	// Replicates runs each point with this many consecutive seeds (starting at the base scenario's seed), and writes a Summary of their stats instead of each simulator.
+	Replicates int
+
+	// AllocRatio names an axis holding target allocation ratios (in percent). Each simulator's pool is sized from Calibration to reach that ratio.
+	AllocRatio string
+	// Calibration of the base scenario, computed by Calibrate if not given
+	Calibration *simulator.Calibration
+
+	Filters []Filter `json:"-"`
+	// Setup is called on each simulator before it is run
+	Setup func(*simulator.Simulator, Point) error `json:"-"`
+}
+
+// Values converts a list of axis values to the form used by Axis.
+func Values[T any](vs ...T) []interface{} {
+	values := make([]interface{}, len(vs))
+	for i, v := range vs {
+		values[i] = v
+	}
+	return values
+}
+
+// Points lists the points of the sweep that pass all filters, in order.
+func (sw *Sweep) Points() ([]Point, error) {
+	var points []Point
+	if sw.Zip {
+		n := -1
+		for _, axis := range sw.Axes {
+			if n != -1 && len(axis.Values) != n {
+				return nil, fmt.Errorf("zipped axis %s has %d values, expected %d", axis.Name, len(axis.Values), n)
+			}
+			n = len(axis.Values)
+		}
+		for i := 0; i < n; i++ {
+			p := Point{}
+			for _, axis := range sw.Axes {
+				p[axis.Name] = axis.Values[i]
+			}
+			points = append(points, p)
+		}
+	} else {
+		points = []Point{{}}
+		for _, axis := range sw.Axes {
+			var next []Point
+			for _, p := range points {
+				for _, v := range axis.Values {
+					np := Point{}
+					for k, pv := range p {
+						np[k] = pv
+					}
+					np[axis.Name] = v
+					next = append(next, np)
+				}
+			}
+			points = next
+		}
+	}
+
+	var kept []Point
+	for _, p := range points {
+		if sw.keep(p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
+
+func (sw *Sweep) keep(p Point) bool {
+	for _, f := range sw.Filters {
+		if !f(p) {
+			return false
+		}
+	}
+	if len(sw.Include) == 0 {
+		return true
+	}
+	for _, cond := range sw.Include {
+		if p.matches(cond) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Point) matches(cond map[string][]interface{}) bool {
+	for name, allowed := range cond {
+		found := false
+		for _, v := range allowed {
+			if valuesEqual(p[name], v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesEqual compares values by their JSON encoding, so that values loaded from JSON match those given in Go.
+func valuesEqual(a, b interface{}) bool {
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(ab) == string(bb)
+}
+
+// Simulator creates the simulator for a single point of the sweep.
+func (sw *Sweep) Simulator(p Point) (*simulator.Simulator, error) {
+	scenario, err := jsonValue(sw.Base)
+	if err != nil {
+		return nil, err
+	}
+	for _, axis := range sw.Axes {
+		if axis.Path == "" {
+			continue
+		}
+		scenario, err = setPath(scenario, strings.Split(axis.Path, "."), p[axis.Name])
+		if err != nil {
+			return nil, fmt.Errorf("axis %s: %w", axis.Name, err)
+		}
+	}
+	b, err := json.Marshal(scenario)
+	if err != nil {
+		return nil, err
+	}
+	s := &simulator.Simulator{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, err
+	}
+	if sw.AllocRatio != "" {
+		if sw.Calibration == nil {
+			return nil, errors.New("sweep has not been calibrated")
+		}
+		ar, err := intValue(p[sw.AllocRatio])
+		if err != nil || ar <= 0 {
+			return nil, fmt.Errorf("invalid allocation ratio %v", p[sw.AllocRatio])
+		}
+		s.TotalIPs = sw.Calibration.PoolSize(ar)
+	}
+	if sw.Setup != nil {
+		err = sw.Setup(s, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// tagStats records the value of each axis in a simulator's OverallStats, under the axis name
+func tagStats(s *simulator.Simulator, axes []Axis, p Point) error {
+	for _, axis := range axes {
+		if _, ok := s.OverallStats[axis.Name]; ok {
+			return fmt.Errorf("axis %q has the same name as a stat", axis.Name)
+		}
+	}
+	for _, axis := range axes {
+		s.OverallStats[axis.Name] = p[axis.Name]
+	}
+	return nil
+}
+
+func intValue(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64:
+		if n != float64(int(n)) {
+			return 0, errors.New("not an integer")
+		}
+		return int(n), nil
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err
+	}
+	return 0, errors.New("not an integer")
+}
+
+// Calibrate measures the peak demand of the base scenario, if the sweep sizes pools by allocation ratio and has no calibration yet.
+func (sw *Sweep) Calibrate() error {
+	if sw.AllocRatio == "" || sw.Calibration != nil {
+		return nil
+	}
+	c, err := simulator.Calibrate(sw.Base)
+	if err != nil {
+		return err
+	}
+	sw.Calibration = c
+	return nil
+}
+
+func setPath(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, err := setPath(n[path[0]], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = child
+		return n, nil
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(n) {
+			return nil, fmt.Errorf("invalid index %s", path[0])
+		}
+		n[i], err = setPath(n[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case nil:
+		return setPath(map[string]interface{}{}, path, value)
+	default:
+		// Values substituted by an earlier axis (e.g. a whole policy) are converted to JSON objects so later axes can reach inside them
+		v, err := jsonValue(n)
+		if err != nil {
+			return nil, err
+		}
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return setPath(v, path, value)
+		}
+		return nil, errors.New("path " + path[0] + " does not refer to an object or array")
+	}
+}
+
+// jsonValue converts v to the generic form of its JSON encoding, keeping numbers exact
+func jsonValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	err = d.Decode(&out)
+	return out, err
+}
+
+// Run simulates every point of the sweep, writing each simulator (or Summary, if the sweep has replicates) as a line of JSONL as it completes.
+func (sw *Sweep) Run(w io.Writer) error {
+	var mu sync.Mutex
+	return sw.run(func(v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, err = w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+type job struct {
+	point     int
+	replicate int
+}
+
+func (sw *Sweep) run(emit func(interface{}) error) error {
+	points, err := sw.Points()
+	if err != nil {
+		return err
+	}
+	err = sw.Calibrate()
+	if err != nil {
+		return err
+	}
+	workers := sw.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	replicates := sw.Replicates
+	if replicates <= 0 {
+		replicates = 1
+	}
+
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	collected := make([][]*simulator.Simulator, len(points))
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				p := points[j.point]
+				s, err := sw.Simulator(p)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				s.Seed += int64(j.replicate)
+				s.ProcessAll()
+				err = tagStats(s, sw.Axes, p)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				if sw.Replicates <= 0 {
+					err = emit(s)
+					if err != nil {
+						fail(err)
+					}
+					continue
+				}
+
+				// Only the stats of each replicate are kept until all replicates are done
+				s = &simulator.Simulator{Seed: s.Seed, OverallStats: s.OverallStats, TimeSeriesStats: s.TimeSeriesStats}
+				mu.Lock()
+				collected[j.point] = append(collected[j.point], s)
+				done := collected[j.point]
+				if len(done) == replicates {
+					collected[j.point] = nil
+				}
+				mu.Unlock()
+				if len(done) == replicates {
+					err = emit(Summarize(p, done))
+					if err != nil {
+						fail(err)
+					}
+				}
+			}
+		}()
+	}
+	for i := range points {
+		for r := 0; r < replicates; r++ {
+			jobs <- job{i, r}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
+
+// Load reads a JSON-encoded sweep.
+func Load(r io.Reader) (*Sweep, error) {
+	sw := &Sweep{}
+	err := json.NewDecoder(r).Decode(sw)
+	if err != nil {
+		return nil, err
+	}
+	if sw.Base == nil {
+		return nil, errors.New("sweep has no base scenario")
+	}
+	return sw, nil
+}
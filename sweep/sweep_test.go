@@ -0,0 +1,166 @@
+package sweep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// pointNames describes each point as its axis values in order, for comparison
+func pointNames(points []Point, axes ...string) []string {
+	var names []string
+	for _, p := range points {
+		name := ""
+		for _, axis := range axes {
+			name += fmt.Sprint(p[axis])
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestPoints(t *testing.T) {
+	axes := []Axis{
+		{Name: "a", Values: Values(1, 2, 3)},
+		{Name: "b", Values: Values("x", "y", "z")},
+	}
+	for _, c := range []struct {
+		name    string
+		sweep   Sweep
+		want    []string
+		wantErr bool
+	}{
+		{"cartesian", Sweep{Axes: axes}, []string{"1x", "1y", "1z", "2x", "2y", "2z", "3x", "3y", "3z"}, false},
+		{"zip", Sweep{Axes: axes, Zip: true}, []string{"1x", "2y", "3z"}, false},
+		{"zip mismatch", Sweep{Axes: []Axis{axes[0], {Name: "b", Values: Values("x", "y")}}, Zip: true}, nil, true},
+		// Values loaded from JSON are floats, but match the ints of the axis
+		{"include", Sweep{Axes: axes, Include: []map[string][]interface{}{{"a": Values(1.0)}, {"a": Values(2, 3), "b": Values("z")}}}, []string{"1x", "1y", "1z", "2z", "3z"}, false},
+		{"filter", Sweep{Axes: axes, Filters: []Filter{func(p Point) bool { return p["b"] != "y" }}}, []string{"1x", "1z", "2x", "2z", "3x", "3z"}, false},
+	} {
+		points, err := c.sweep.Points()
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error %v", c.name, err)
+			continue
+		}
+		if got := pointNames(points, "a", "b"); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: points %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// Each point should be simulated with its values substituted into the scenario, and tagged with them in its row
+func TestRun(t *testing.T) {
+	sw := &Sweep{
+		Base: loadScenario(t),
+		Axes: []Axis{
+			{Name: "pool", Path: "TotalIPs", Values: Values(50, 80)},
+			{Name: "tenants", Path: "Agents.0.NumTenants", Values: Values(2, 5)},
+			// Later axes reach inside values substituted by earlier ones
+			{Name: "policy", Path: "Policy", Values: Values(map[string]interface{}{"Type": "random"}, map[string]interface{}{"Type": "fifo"})},
+			{Name: "cooldown", Path: "Policy.Cooldown", Values: Values(600)},
+			{Name: "label", Values: Values("run")},
+		},
+		Include: []map[string][]interface{}{{"pool": Values(50)}, {"tenants": Values(5)}},
+		Workers: 2,
+	}
+	var out bytes.Buffer
+	err := sw.Run(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		var row struct {
+			TotalIPs int
+			Policy   struct {
+				Type     string
+				Cooldown struct{ Duration int }
+			}
+			Agents       []struct{ NumTenants int }
+			OverallStats map[string]interface{}
+		}
+		err := json.Unmarshal(scanner.Bytes(), &row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := row.OverallStats
+		policy := tags["policy"].(map[string]interface{})["Type"]
+		got = append(got, fmt.Sprint(tags["pool"], "/", tags["tenants"], "/", policy, "/", tags["cooldown"], "/", tags["label"]))
+		// The substituted scenario is the one that ran
+		if float64(row.TotalIPs) != tags["pool"] || float64(row.Agents[0].NumTenants) != tags["tenants"] || row.Policy.Type != policy || row.Policy.Cooldown.Duration != 600 {
+			t.Errorf("row tagged %v ran TotalIPs %d, NumTenants %d, policy %+v", tags, row.TotalIPs, row.Agents[0].NumTenants, row.Policy)
+		}
+	}
+	// Rows are written as they complete, so their order varies
+	want := map[string]bool{}
+	for _, pool := range []int{50, 80} {
+		for _, tenants := range []int{2, 5} {
+			if pool != 50 && tenants != 5 {
+				continue
+			}
+			for _, policy := range []string{"random", "fifo"} {
+				want[fmt.Sprint(pool, "/", tenants, "/", policy, "/600/run")] = true
+			}
+		}
+	}
+	gotSet := map[string]bool{}
+	for _, g := range got {
+		gotSet[g] = true
+	}
+	if len(got) != len(want) || !reflect.DeepEqual(gotSet, want) {
+		t.Errorf("rows %v, want %v", got, want)
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	sw := &Sweep{Base: loadScenario(t), Axes: []Axis{{Name: "bad", Path: "Agents.3.NumTenants", Values: Values(1)}}}
+	if _, err := sw.Simulator(Point{"bad": 1}); err == nil {
+		t.Error("an out of range agent index was accepted")
+	}
+	sw.Axes[0].Path = "TotalIPs.Size"
+	if _, err := sw.Simulator(Point{"bad": 1}); err == nil {
+		t.Error("a path into a number was accepted")
+	}
+}
+
+// Axis values shouldn't replace the simulator's stats, or be aggregated as if they were stats
+func TestAxisStats(t *testing.T) {
+	sw := &Sweep{Base: loadScenario(t), Axes: []Axis{{Name: "allocated", Path: "TotalIPs", Values: Values(50)}}}
+	var out bytes.Buffer
+	err := sw.Run(&out)
+	if err == nil || out.Len() > 0 {
+		t.Errorf("axis named like a stat wrote %q (%v)", out.String(), err)
+	}
+
+	sw.Axes[0].Name = "pool"
+	sw.Axes = append(sw.Axes, Axis{Name: "policy", Path: "Policy", Values: Values(map[string]interface{}{"Type": "random", "Cooldown": 600})})
+	sw.Replicates = 2
+	out.Reset()
+	err = sw.Run(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary Summary
+	err = json.Unmarshal(out.Bytes(), &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := summary.OverallStats["allocated"]; !ok {
+		t.Errorf("stats %v weren't aggregated", summary.OverallStats)
+	}
+	for name := range summary.OverallStats {
+		if name == "pool" || strings.HasPrefix(name, "policy.") {
+			t.Errorf("axis value %s was aggregated", name)
+		}
+	}
+	if summary.Point["pool"] != 50.0 {
+		t.Errorf("summary point %v, want pool 50", summary.Point)
+	}
+}
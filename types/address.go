@@ -0,0 +1,171 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/netip"
+	"sort"
+)
+
+/*
+AddressSpace maps the simulator's IPAddress indexes onto real addresses.
+
+The space is a list of CIDR prefixes of a single family, divided into allocation units with prefix length Bits. IPv4 spaces usually allocate single addresses (Bits 32), while IPv6 spaces can allocate prefixes to tenants (e.g. Bits 80 or 96). Indexes are assigned to units in order, starting with the first unit of the first prefix.
+
+The space is also divided into subnets of length SubnetBits, which are numbered in order across the prefixes. A prefix smaller than a subnet is treated as a subnet of its own.
+
+The zero value of a *AddressSpace (nil) maps each index to the IPv4 address with the same value, with /24 subnets.
+*/
+type AddressSpace struct {
+	Prefixes []netip.Prefix
+	// Prefix length of each allocated unit (defaults to 32 for IPv4 and 128 for IPv6)
+	Bits int `json:",omitempty"`
+	// Prefix length of subnets (defaults to 24 for IPv4 and 64 for IPv6)
+	SubnetBits int `json:",omitempty"`
+
+	offsets       []uint64 // Index of the first unit of each prefix, and the total number of units
+	subnetOffsets []uint64 // Index of the first subnet of each prefix
+	subnetBits    []int    // Length of the subnets of each prefix
+}
+
+// Subnet identifies a subnet of the address space (e.g. a /24).
+type Subnet uint32
+
+const defaultIPv4SubnetBits = 24
+const defaultIPv6SubnetBits = 64
+
+func (a *AddressSpace) init() error {
+	if a.offsets != nil {
+		return nil
+	}
+	if len(a.Prefixes) == 0 {
+		return errors.New("address space has no prefixes")
+	}
+	is4 := a.Prefixes[0].Addr().Is4()
+	if a.Bits == 0 {
+		a.Bits = 128
+		if is4 {
+			a.Bits = 32
+		}
+	}
+	length := a.SubnetBits
+	if length == 0 {
+		length = defaultIPv6SubnetBits
+		if is4 {
+			length = defaultIPv4SubnetBits
+		}
+	}
+	offsets := []uint64{0}
+	subnetOffsets := []uint64{0}
+	var subnetBits []int
+	for _, p := range a.Prefixes {
+		if !p.IsValid() || p.Addr().Is4() != is4 {
+			return fmt.Errorf("address space prefixes must be valid and of a single family: %v", p)
+		}
+		if a.Bits < p.Bits() || a.Bits > p.Addr().BitLen() {
+			return fmt.Errorf("allocation units of /%d don't fit in %v", a.Bits, p)
+		}
+		units := uint64(math.MaxUint32) + 1
+		if a.Bits-p.Bits() < 32 {
+			units = 1 << (a.Bits - p.Bits())
+		}
+		offsets = append(offsets, min(offsets[len(offsets)-1]+units, uint64(math.MaxUint32)+1))
+		units = offsets[len(offsets)-1] - offsets[len(offsets)-2]
+		subnetBits = append(subnetBits, min(max(length, p.Bits()), a.Bits))
+		shift := a.subnetShift(subnetBits[len(subnetBits)-1])
+		subnetOffsets = append(subnetOffsets, subnetOffsets[len(subnetOffsets)-1]+(units+1<<shift-1)>>shift)
+	}
+	a.offsets = offsets
+	a.subnetOffsets = subnetOffsets
+	a.subnetBits = subnetBits
+	return nil
+}
+
+// subnetShift returns log2 of the number of indexable units in a subnet of the given length
+func (a *AddressSpace) subnetShift(subnetBits int) int {
+	return min(a.Bits-subnetBits, 32)
+}
+
+// Validate checks that the address space is well formed.
+func (a *AddressSpace) Validate() error {
+	if a == nil {
+		return nil
+	}
+	return a.init()
+}
+
+// Size returns the number of allocation units in the space, up to the 2^32 that IPAddress can index.
+func (a *AddressSpace) Size() uint64 {
+	if a == nil {
+		return uint64(math.MaxUint32) + 1
+	}
+	if a.init() != nil {
+		return 0
+	}
+	return a.offsets[len(a.offsets)-1]
+}
+
+// Prefix returns the unit of the space with the given index (a single-address prefix for single IPs).
+func (a *AddressSpace) Prefix(ip IPAddress) netip.Prefix {
+	if a == nil {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(ip))
+		return netip.PrefixFrom(netip.AddrFrom4(b), 32)
+	}
+	if a.init() != nil || uint64(ip) >= a.Size() {
+		return netip.Prefix{}
+	}
+	i := a.prefixIndex(ip)
+	base := a.Prefixes[i].Masked().Addr()
+	offset := uint64(ip) - a.offsets[i]
+	return netip.PrefixFrom(addOffset(base, offset, base.BitLen()-a.Bits), a.Bits)
+}
+
+// Subnet returns the subnet containing the unit with the given index.
+func (a *AddressSpace) Subnet(ip IPAddress) Subnet {
+	if a == nil {
+		return Subnet(ip >> (32 - defaultIPv4SubnetBits))
+	}
+	if a.init() != nil || uint64(ip) >= a.Size() {
+		return 0
+	}
+	i := a.prefixIndex(ip)
+	return Subnet(a.subnetOffsets[i] + (uint64(ip)-a.offsets[i])>>a.subnetShift(a.subnetBits[i]))
+}
+
+func (a *AddressSpace) prefixIndex(ip IPAddress) int {
+	return sort.Search(len(a.Prefixes), func(i int) bool { return a.offsets[i+1] > uint64(ip) })
+}
+
+func splitAddr(a netip.Addr) (hi, lo uint64) {
+	b := a.As16()
+	return binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+}
+
+// addOffset returns base + offset<<shift
+func addOffset(base netip.Addr, offset uint64, shift int) netip.Addr {
+	hi, lo := splitAddr(base)
+	var oHi, oLo uint64
+	if shift >= 64 {
+		oHi = offset << (shift - 64)
+	} else {
+		oLo = offset << shift
+		if shift > 0 {
+			oHi = offset >> (64 - shift)
+		}
+	}
+	var carry uint64
+	lo, carry = bits.Add64(lo, oLo, 0)
+	hi, _ = bits.Add64(hi, oHi, carry)
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], hi)
+	binary.BigEndian.PutUint64(b[8:], lo)
+	addr := netip.AddrFrom16(b)
+	if base.Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
@@ -1,17 +1,42 @@
 package types
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"net/netip"
 	"time"
 )
 
 type IPAddress uint32
 
+// ErrPoolExhausted is returned when the pool has no IP to give a tenant
+var ErrPoolExhausted = errors.New("pool exhausted")
+
+// ErrRequestQueued is returned by Simulator.GetIP when an exhausted pool queues the request. The IP is later given to the requesting agent through IPReceiver.
+var ErrRequestQueued = fmt.Errorf("%w: request queued", ErrPoolExhausted)
+
+// ErrQuotaExceeded is returned by Simulator.GetIP when the tenant already holds as many IPs as its quota allows
+var ErrQuotaExceeded = errors.New("tenant IP quota exceeded")
+
+// ErrThrottled is returned by Simulator.GetIP and ReleaseIP when the tenant has exceeded its API rate limit. The call has no effect, and can be retried later.
+var ErrThrottled = errors.New("request throttled")
+
+// ErrNotRecoverable is returned by Simulator.GetSpecificIP when the IP isn't free, or the region's policy doesn't let the tenant recover it
+var ErrNotRecoverable = errors.New("IP not recoverable")
+
+// DefaultRegion names the simulator's own pool, which GetIP allocates from
+const DefaultRegion = "default"
+
 type Simulator interface {
 	GetTime() Duration
-	GetIP(TenantId) IPAddress
-	ReleaseIP(IPAddress, TenantId, bool)
+	GetIP(TenantId) (IPAddress, error)
+	// GetIPInRegion allocates an IP from the named region's pool ("" for DefaultRegion)
+	GetIPInRegion(string, TenantId) (IPAddress, error)
+	// GetSpecificIP allocates a particular free IP to a tenant, such as one it recently released, if the IP's policy allows it
+	GetSpecificIP(TenantId, IPAddress) error
+	ReleaseIP(IPAddress, TenantId, bool) error
 	GetInfo(IPAddress) *IPInfo
 	Done()
 	AvailableIPs() uint32
@@ -23,11 +48,17 @@ type Simulator interface {
 	RegisterIPAllocationCallback(IPAllocationCallback)
 	GetTimeDelta() Duration
 	GetOverallStats() map[string]interface{}
+	GetPolicy() PoolPolicy
+	GetPrefix(IPAddress) netip.Prefix
+	// GetBill returns the total charged so far to the agent owning a tenant, or false if the simulator has no billing model
+	GetBill(TenantId) (float64, bool)
+	// TenantAgent returns the index of the agent that a tenant ID was handed out to, or -1 if there is none, and the ID's offset from the agent's first tenant ID
+	TenantAgent(TenantId) (int, TenantId)
 }
 
 type PoolPolicy interface {
-	// GetIP requests an IP for a given tenant
-	GetIP(Simulator, TenantId) IPAddress
+	// GetIP requests an IP for a given tenant, returning ErrPoolExhausted if there is none to give
+	GetIP(Simulator, TenantId) (IPAddress, error)
 	// ReleaseIP releases an IP used by a given tenant
 	ReleaseIP(Simulator, IPAddress, TenantId)
 	GetType() string
@@ -42,6 +73,9 @@ const Minute Duration = 60 * Second
 const Hour Duration = 60 * Minute
 const Day Duration = 24 * Hour
 
+// Never is a time that is never reached
+const Never Duration = math.MaxInt64
+
 func (x Duration) Abs() Duration {
 	if x < 0 {
 		return -x
@@ -63,6 +97,62 @@ type Cleanuper interface {
 	Cleanup(Simulator)
 }
 
+// IPReceiver is implemented by agents that can have their requests queued when the pool is exhausted. ReceiveIP is called with the IP once the request is served, outside of the agent's Process.
+type IPReceiver interface {
+	ReceiveIP(Simulator, TenantId, IPAddress)
+}
+
+// IPRemover is implemented by policies that support IPs being removed from the pool. RemoveIPs is called with IPs that are free (though they may still be in cooldown), which the policy must never give out again.
+type IPRemover interface {
+	RemoveIPs(Simulator, []IPAddress)
+}
+
+// CooldownBypasser is implemented by policies that hold released IPs in a cooldown. GetCooldownIP returns an IP that is still in its cooldown, for use when the pool is otherwise exhausted.
+type CooldownBypasser interface {
+	GetCooldownIP(Simulator, TenantId) (IPAddress, error)
+}
+
+// IPRecoverer is implemented by policies that let tenants recover specific IPs. RecoverIP is called with a free IP, and returns whether the tenant is eligible for it under the policy's rules (such as having released it recently), in which case the policy must treat the IP as given out.
+type IPRecoverer interface {
+	RecoverIP(Simulator, IPAddress, TenantId) bool
+}
+
+// CooldownDeclarer is implemented by policies that guarantee a cooldown. MinCooldown returns the least time that an IP released by the tenant is held back before GetIP can give it to another tenant; GetCooldownIP is exempt.
+type CooldownDeclarer interface {
+	MinCooldown(Simulator, TenantId) Duration
+}
+
+// StatsReporter is implemented by policies that expose their internal metrics, such as their cooldown backlog. ReportStats adds them to the map, which the simulator records under "policyStats" and the policy's type in each period's time-series stats and in the overall stats (in each region's stats, for a simulator with regions).
+type StatsReporter interface {
+	ReportStats(Simulator, map[string]interface{})
+}
+
+// Waker is implemented by agents that know when they next need to act. After each call to Process, the simulator calls NextWakeup and skips the agent until the returned time (or forever, if it returns Never). Agents that don't implement Waker are processed every TimeDelta.
+type Waker interface {
+	NextWakeup(Simulator) Duration
+}
+
+// IdleTracker is implemented by agents that hold IPs without using them. IdleTime returns how much of the time a tenant held an IP it spent idle, which billing models may charge a surcharge for.
+type IdleTracker interface {
+	IdleTime(ip IPAddress, tenant TenantId, held Duration) Duration
+}
+
+// Adversary is implemented by agents whose tenants are adversarial. It is the ground truth that the simulator scores TenantClassifier policies against, and must not be used by policies themselves.
+type Adversary interface {
+	Adversarial() bool
+}
+
+// TenantClassifier is implemented by policies that flag tenants they suspect are adversarial. ClassifiedTenants returns every tenant the policy has seen, and whether it is flagged, or nil if the policy doesn't classify tenants after all (as for middleware wrapping a policy that doesn't).
+type TenantClassifier interface {
+	ClassifiedTenants() map[TenantId]bool
+}
+
+// Checkpointer is implemented by policies and agents so that their internal state can be saved by a simulator checkpoint. On restore, the policy or agent is unmarshalled from its JSON configuration and Restore is called in place of Init, so Restore must also re-register any stat collectors or callbacks.
+type Checkpointer interface {
+	Checkpoint() ([]byte, error)
+	Restore(Simulator, []byte) error
+}
+
 type TenantId uint32
 
 var NilTenant TenantId = 0
@@ -12,18 +12,26 @@ type IPInfo struct {
 	Configurations map[TenantId]Duration
 	Owner          TenantId
 	AllocatedAt    Duration
+	// When the IP was added to the pool (0 for the initial pool)
+	AddedAt Duration
+	Subnet  Subnet
+	Region  string
+	// The IP's block is being retired, and it will be removed from the pool when released
+	Draining bool
 }
 
+// HasConfig returns whether any tenant other than tenantId has left latent configuration on the IP, including configuration that expires by time t, which is then removed.
 func (i *IPInfo) HasConfig(t Duration, tenantId TenantId) bool {
+	found := false
 	for other, expiration := range i.Configurations {
 		if expiration <= t {
 			delete(i.Configurations, other)
 		}
 		if other != tenantId {
-			return true
+			found = true
 		}
 	}
-	return false
+	return found
 }
 
 func (i *IPInfo) UniqueOwners() int {
@@ -0,0 +1,18 @@
+package util
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// EncodeGob encodes v with encoding/gob, for saving the internal state of policies and agents in checkpoints
+func EncodeGob(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	return b.Bytes(), err
+}
+
+// DecodeGob decodes state saved by EncodeGob into v
+func DecodeGob(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"math/rand"
+
+	"github.com/MadSP-McDaniel/eipsim/types"
+)
+
+/*
+IPSet is a set of IP addresses supporting constant-time insertion, removal, and uniform random selection.
+
+Unlike ranging over a map, the order of IPs in the set depends only on the sequence of operations performed on it, so selections are reproducible given the same random source.
+*/
+type IPSet struct {
+	ips   []types.IPAddress
+	index map[types.IPAddress]int
+}
+
+func NewIPSet() *IPSet {
+	return &IPSet{index: map[types.IPAddress]int{}}
+}
+
+// Add inserts ip, returning false if it was already present
+func (s *IPSet) Add(ip types.IPAddress) bool {
+	if _, ok := s.index[ip]; ok {
+		return false
+	}
+	s.index[ip] = len(s.ips)
+	s.ips = append(s.ips, ip)
+	return true
+}
+
+// Remove deletes ip, returning false if it wasn't present. The last IP in the set takes its position.
+func (s *IPSet) Remove(ip types.IPAddress) bool {
+	i, ok := s.index[ip]
+	if !ok {
+		return false
+	}
+	last := s.ips[len(s.ips)-1]
+	s.ips[i] = last
+	s.index[last] = i
+	s.ips = s.ips[:len(s.ips)-1]
+	delete(s.index, ip)
+	return true
+}
+
+func (s *IPSet) Contains(ip types.IPAddress) bool {
+	_, ok := s.index[ip]
+	return ok
+}
+
+func (s *IPSet) Len() int {
+	return len(s.ips)
+}
+
+// At returns the i-th IP of the set
+func (s *IPSet) At(i int) types.IPAddress {
+	return s.ips[i]
+}
+
+// Random returns a uniformly random IP from a non-empty set, without removing it
+func (s *IPSet) Random(r *rand.Rand) types.IPAddress {
+	return s.ips[r.Intn(len(s.ips))]
+}
+
+// Slice returns the IPs of the set in order. The slice is only valid until the set is next modified.
+func (s *IPSet) Slice() []types.IPAddress {
+	return s.ips
+}
@@ -0,0 +1,21 @@
+package util
+
+import "encoding/json"
+
+// WithType adds a Type field to a marshalled component (agent, policy, etc.) that doesn't set one itself, so that it can be unmarshalled again by its wrapper.
+func WithType(b []byte, typeName string) ([]byte, error) {
+	var typed struct{ Type *string }
+	if json.Unmarshal(b, &typed) != nil || (typed.Type != nil && *typed.Type != "") {
+		return b, nil
+	}
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return nil, err
+	}
+	fields["Type"], err = json.Marshal(typeName)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
@@ -8,3 +8,52 @@ import (
 func SampleExponential(r *rand.Rand, lambda float64) float64 {
 	return -math.Log(1-r.Float64()) / lambda
 }
+
+func Mean(xs []float64) float64 {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// StdDev returns the sample standard deviation
+func StdDev(xs []float64) float64 {
+	if len(xs) < 2 {
+		return 0
+	}
+	mean := Mean(xs)
+	var sum float64
+	for _, x := range xs {
+		sum += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(sum / float64(len(xs)-1))
+}
+
+// Two-sided 95% critical values of Student's t distribution, indexed by degrees of freedom
+var studentT95 = []float64{math.Inf(1),
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// CI95 returns the half-width of the 95% confidence interval for the mean of xs
+func CI95(xs []float64) float64 {
+	if len(xs) < 2 {
+		return 0
+	}
+	df := len(xs) - 1
+	// Beyond the table, use the value for the next lowest tabulated df (slightly conservative)
+	t := 1.980
+	switch {
+	case df < len(studentT95):
+		t = studentT95[df]
+	case df < 40:
+		t = 2.042
+	case df < 60:
+		t = 2.021
+	case df < 120:
+		t = 2.000
+	}
+	return t * StdDev(xs) / math.Sqrt(float64(len(xs)))
+}
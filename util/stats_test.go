@@ -0,0 +1,57 @@
+package util
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStdDev(t *testing.T) {
+	// The sum of squared deviations is 32, so the population standard deviation is 2 while the sample standard deviation is sqrt(32/7)
+	xs := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	if m := Mean(xs); m != 5 {
+		t.Errorf("mean %v, want 5", m)
+	}
+	if sd, want := StdDev(xs), math.Sqrt(32.0/7); math.Abs(sd-want) > 1e-12 {
+		t.Errorf("standard deviation %v, want %v", sd, want)
+	}
+	if sd := StdDev([]float64{3}); sd != 0 {
+		t.Errorf("standard deviation of a single value %v, want 0", sd)
+	}
+}
+
+func TestCI95(t *testing.T) {
+	if ci := CI95([]float64{3}); ci != 0 {
+		t.Errorf("confidence interval of a single value %v, want 0", ci)
+	}
+	// The critical value used for each sample size, recovered from the interval's half-width
+	for _, c := range []struct {
+		n int
+		t float64
+	}{
+		{2, 12.706},
+		{3, 4.303},
+		{11, 2.228},
+		{31, 2.042}, // The last tabulated df
+		{32, 2.042},
+		{40, 2.042},
+		{41, 2.021}, // df 40
+		{60, 2.021},
+		{61, 2.000}, // df 60
+		{120, 2.000},
+		{121, 1.980}, // df 120
+		{1000, 1.980},
+	} {
+		xs := make([]float64, c.n)
+		for i := range xs {
+			xs[i] = float64(i)
+		}
+		got := CI95(xs) * math.Sqrt(float64(c.n)) / StdDev(xs)
+		if math.Abs(got-c.t) > 1e-9 {
+			t.Errorf("n=%d: critical value %v, want %v", c.n, got, c.t)
+		}
+	}
+	// Two values one apart have a standard deviation of sqrt(1/2), so the half-width is 12.706 * sqrt(1/2) / sqrt(2)
+	if ci := CI95([]float64{1, 2}); math.Abs(ci-12.706/2) > 1e-9 {
+		t.Errorf("confidence interval %v, want %v", ci, 12.706/2)
+	}
+}
@@ -0,0 +1,146 @@
+package util
+
+import "github.com/MadSP-McDaniel/eipsim/types"
+
+type timerNode struct {
+	timer       types.Duration
+	ip          types.IPAddress
+	priority    uint64
+	left, right *timerNode
+}
+
+// less orders nodes by timer, then by IP
+func (n *timerNode) less(timer types.Duration, ip types.IPAddress) bool {
+	return n.timer < timer || (n.timer == timer && n.ip < ip)
+}
+
+/*
+TimerIndex is a set of IPs ordered by a timer value, supporting insertion, removal, and lookup of the nearest timer to a target in O(log n) time. Ties between equal timers are broken by IP.
+
+It is a treap whose priorities are a hash of each IP, so its shape depends only on its contents, and it draws nothing from the simulation's random source.
+*/
+type TimerIndex struct {
+	root *timerNode
+	len  int
+}
+
+func NewTimerIndex() *TimerIndex {
+	return &TimerIndex{}
+}
+
+// timerPriority is the splitmix64 hash of an IP
+func timerPriority(ip types.IPAddress) uint64 {
+	z := uint64(ip) + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Len returns the number of IPs in the index
+func (x *TimerIndex) Len() int {
+	return x.len
+}
+
+// Insert adds ip with the given timer. The IP must not already be in the index.
+func (x *TimerIndex) Insert(ip types.IPAddress, timer types.Duration) {
+	x.root = insertTimer(x.root, &timerNode{timer: timer, ip: ip, priority: timerPriority(ip)})
+	x.len++
+}
+
+func insertTimer(n, node *timerNode) *timerNode {
+	if n == nil {
+		return node
+	}
+	if n.less(node.timer, node.ip) {
+		n.right = insertTimer(n.right, node)
+		if n.right.priority > n.priority {
+			r := n.right
+			n.right, r.left = r.left, n
+			return r
+		}
+	} else {
+		n.left = insertTimer(n.left, node)
+		if n.left.priority > n.priority {
+			l := n.left
+			n.left, l.right = l.right, n
+			return l
+		}
+	}
+	return n
+}
+
+// Remove deletes ip, which must have been inserted with the given timer, returning false if it wasn't present
+func (x *TimerIndex) Remove(ip types.IPAddress, timer types.Duration) bool {
+	var removed bool
+	x.root, removed = removeTimer(x.root, timer, ip)
+	if removed {
+		x.len--
+	}
+	return removed
+}
+
+func removeTimer(n *timerNode, timer types.Duration, ip types.IPAddress) (*timerNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+	var removed bool
+	switch {
+	case n.less(timer, ip):
+		n.right, removed = removeTimer(n.right, timer, ip)
+	case n.timer != timer || n.ip != ip:
+		n.left, removed = removeTimer(n.left, timer, ip)
+	default:
+		return mergeTimers(n.left, n.right), true
+	}
+	return n, removed
+}
+
+// mergeTimers joins two treaps, where every node of l is ordered before every node of r
+func mergeTimers(l, r *timerNode) *timerNode {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	if l.priority > r.priority {
+		l.right = mergeTimers(l.right, r)
+		return l
+	}
+	r.left = mergeTimers(l, r.left)
+	return r
+}
+
+// Floor returns the IP with the greatest timer not exceeding timer (the greatest IP among ties)
+func (x *TimerIndex) Floor(timer types.Duration) (types.IPAddress, types.Duration, bool) {
+	var best *timerNode
+	for n := x.root; n != nil; {
+		if n.timer <= timer {
+			best = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	if best == nil {
+		return 0, 0, false
+	}
+	return best.ip, best.timer, true
+}
+
+// Ceil returns the IP with the least timer not below timer (the least IP among ties)
+func (x *TimerIndex) Ceil(timer types.Duration) (types.IPAddress, types.Duration, bool) {
+	var best *timerNode
+	for n := x.root; n != nil; {
+		if n.timer >= timer {
+			best = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	if best == nil {
+		return 0, 0, false
+	}
+	return best.ip, best.timer, true
+}